@@ -0,0 +1,108 @@
+//go:build !android
+// +build !android
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"ssh2socks5/proxy"
+)
+
+// version задаётся при сборке: -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+func runCheck(args []string) int {
+	fs := newFlagSet("check")
+	opts := addProxyFlags(fs)
+	offline := fs.Bool("offline", false, "Only validate the configuration, do not connect")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	config, err := opts.load(fs)
+	if err != nil {
+		printConfigError(err)
+		return exitUsage
+	}
+	fmt.Println("Configuration OK")
+
+	if *offline {
+		return exitOK
+	}
+
+	client, err := proxy.DialSSH(config)
+	if err != nil {
+		log.Printf("SSH connection error: %v", err)
+		return exitSSHFailed
+	}
+	defer client.Close()
+
+	fmt.Printf("SSH connection to %s:%s OK (server %s)\n", config.SSHHost, config.SSHPort, client.ServerVersion())
+	return exitOK
+}
+
+func runStatus(args []string) int {
+	fs := newFlagSet("status")
+	adminAddr := fs.String("admin", "127.0.0.1:1792", "Admin server address of the running proxy")
+	token := fs.String("token", os.Getenv("SSH2SOCKS5_ADMIN_TOKEN"), "Admin token (default $SSH2SOCKS5_ADMIN_TOKEN)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+*adminAddr+"/status", nil)
+	if err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to query proxy status: %v", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Failed to read proxy status: %v", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Proxy returned %s: %s", resp.Status, bytes.TrimSpace(body))
+		return 1
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		os.Stdout.Write(body)
+		return exitOK
+	}
+	out.WriteTo(os.Stdout)
+	return exitOK
+}
+
+func runVersion() {
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				v += "+" + s.Value
+			}
+		}
+	}
+	fmt.Printf("ssh2socks5 %s (%s %s/%s)\n", v, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
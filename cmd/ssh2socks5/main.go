@@ -5,77 +5,127 @@ package main
 
 import (
 	"context"
-	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"ssh2socks5/proxy"
 )
 
+const usage = `Usage: %[1]s <command> [options]
+
+Commands:
+  run      Start the proxy (default when no command is given)
+  check    Validate the configuration and test the SSH connection
+  status   Show the state of a running proxy
+  stdio    Connect stdin/stdout to host:port through SSH (for ProxyCommand)
+  version  Print version information
+
+Run '%[1]s <command> -h' for command options.
+`
+
 func main() {
-	sshHost := flag.String("host", "", "SSH server address (required)")
-	sshPort := flag.String("port", "22", "SSH server port (default 22)")
-	sshUser := flag.String("user", "", "SSH username (required)")
-	sshPassword := flag.String("password", "", "SSH password (used if key not provided)")
-	keyPath := flag.String("key", "", "Path to SSH private key")
-	localPort := flag.String("lport", "1080", "Local SOCKS5 proxy port (default 1080)")
-	proxyType := flag.String("proxyType", "socks5", "Local SOCKS5 proxy port (default 1080)")
-
-	flag.Parse()
-
-	config := &proxy.ProxyConfig{
-		SSHHost:     *sshHost,
-		SSHPort:     *sshPort,
-		SSHUser:     *sshUser,
-		SSHPassword: *sshPassword,
-		KeyPath:     *keyPath,
-		LocalPort:   *localPort,
-		LogPath:     filepath.Join("logs", "proxy.log"),
-		ProxyType:   *proxyType,
+	command := "run"
+	args := os.Args[1:]
+	// Без подкоманды работаем как раньше: ssh2socks5 -host ... -user ...
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "run":
+		os.Exit(runProxy(args))
+	case "check":
+		os.Exit(runCheck(args))
+	case "status":
+		os.Exit(runStatus(args))
+	case "stdio":
+		os.Exit(runStdio(args, os.Stdin, os.Stdout))
+	case "version":
+		runVersion()
+	case "help":
+		fmt.Printf(usage, os.Args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(exitUsage)
+	}
+}
+
+func runProxy(args []string) int {
+	fs := newFlagSet("run")
+	opts := addProxyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
 	}
 
-	if config.SSHHost == "" || config.SSHUser == "" || (config.SSHPassword == "" && config.KeyPath == "") {
-		log.Fatal("Must specify host, user, and either password or key.")
+	config, err := opts.load(fs)
+	if err != nil {
+		printConfigError(err)
+		return exitUsage
 	}
 
 	proxyServer, err := proxy.NewProxyServer(config)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return 1
 	}
+	// Сообщения log.Printf идут в тот же журнал, что и сообщения прокси
+	slog.SetDefault(proxyServer.Logger())
 
 	if err := proxyServer.Start(); err != nil {
 		log.Printf("SSH connection error: %v", err)
-		return
+		return 1
 	}
 
 	log.Printf("Proxy listening on :%s", config.LocalPort)
 	log.Printf("SSH connection established to %s:%s", config.SSHHost, config.SSHPort)
 
+	// Перечитываем тот же файл и те же флаги, что и при запуске
+	proxyServer.SetConfigLoader(func() (*proxy.ProxyConfig, error) {
+		return opts.load(fs)
+	})
+
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	<-sigChan
-	log.Println("Shutting down gracefully...")
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Println("Reloading configuration...")
+		if err := proxyServer.ReloadConfig(); err != nil {
+			log.Printf("Reload failed: %v", err)
+		}
+		slog.SetDefault(proxyServer.Logger())
+	}
+	drainTimeout := time.Duration(proxyServer.Config().DrainTimeout)
+	log.Printf("Shutting down, waiting up to %v for active connections (send the signal again to force)...", drainTimeout)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
-
-	done := make(chan struct{})
 	go func() {
-		if err := proxyServer.Stop(); err != nil {
-			log.Printf("Error stopping proxy: %v", err)
+		select {
+		case <-sigChan:
+			log.Println("Forcing shutdown")
+			cancel()
+		case <-ctx.Done():
 		}
-		close(done)
 	}()
 
-	select {
-	case <-ctx.Done():
-		log.Println("Shutdown timed out")
-	case <-done:
+	cut, err := proxyServer.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error stopping proxy: %v", err)
+	}
+	if cut > 0 {
+		log.Printf("Shutdown completed, %d connections were cut", cut)
+	} else {
 		log.Println("Shutdown completed successfully")
 	}
+	return exitOK
 }
@@ -0,0 +1,122 @@
+//go:build !android
+// +build !android
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"ssh2socks5/proxy"
+)
+
+// Коды выхода режима stdio, как у ssh -W
+const (
+	exitOK        = 0
+	exitTarget    = 1
+	exitUsage     = 2
+	exitSSHFailed = 255
+)
+
+// sshTunnel - SSH клиент, через который открывается соединение с целью.
+type sshTunnel interface {
+	Dial(network, addr string) (net.Conn, error)
+	Close() error
+}
+
+// dialSSH подключается к SSH серверу; тесты подменяют его.
+var dialSSH = func(config *proxy.ProxyConfig) (sshTunnel, error) {
+	client, err := proxy.DialSSH(config)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// runStdio подключается к host:port через SSH и соединяет с ним
+// stdin/stdout. Для использования как ProxyCommand:
+//
+//	ProxyCommand ssh2socks5 stdio -host jump -user me -key ~/.ssh/id %h %p
+func runStdio(args []string, stdin io.Reader, stdout io.Writer) int {
+	fs := flag.NewFlagSet("stdio", flag.ContinueOnError)
+	sshOpts := addSSHFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stdio [options] host port\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := sshOpts.load(fs)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		printConfigError(err)
+		return exitUsage
+	}
+	if config.SSHPasswordFrom == "stdin" || config.KeyPassphraseFrom == "stdin" {
+		log.Print("stdin is used for the tunnel in stdio mode and cannot be a secret source")
+		return exitUsage
+	}
+	target := net.JoinHostPort(fs.Arg(0), fs.Arg(1))
+
+	client, err := dialSSH(config)
+	if err != nil {
+		log.Printf("SSH connection error: %v", err)
+		return exitSSHFailed
+	}
+	defer client.Close()
+
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		log.Printf("Failed to connect to %s: %v", target, err)
+		return exitTarget
+	}
+	defer conn.Close()
+
+	if err := pipeStdio(conn, stdin, stdout); err != nil {
+		log.Printf("Connection to %s: %v", target, err)
+		return exitTarget
+	}
+	return exitOK
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipeStdio копирует stdin в conn и conn в stdout. EOF на stdin передаётся
+// удалённой стороне как half-close, соединение работает до тех пор, пока
+// удалённая сторона не закроет свою половину.
+func pipeStdio(conn net.Conn, stdin io.Reader, stdout io.Writer) error {
+	stdinErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, stdin)
+		if cw, ok := conn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		stdinErr <- err
+	}()
+
+	if _, err := io.Copy(stdout, conn); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-stdinErr:
+		return err
+	default:
+		// stdin ещё открыт, но удалённая сторона закончила - выходим
+		return nil
+	}
+}
@@ -0,0 +1,155 @@
+//go:build !android
+// +build !android
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"ssh2socks5/proxy"
+)
+
+// tcpPair возвращает два конца TCP соединения: у net.Pipe нет CloseWrite.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	local, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local, remote
+}
+
+// serveEOFEcho отвечает, только получив EOF, и закрывает соединение.
+func serveEOFEcho(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	data, _ := io.ReadAll(conn)
+	conn.Write(append([]byte("echo "), data...))
+}
+
+func TestPipeStdioHalfClose(t *testing.T) {
+	local, remote := tcpPair(t)
+	go serveEOFEcho(remote)
+
+	// EOF на stdin доходит до удалённой стороны, ответ после него читается
+	var stdout bytes.Buffer
+	if err := pipeStdio(local, strings.NewReader("hello"), &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "echo hello" {
+		t.Errorf("stdout %q", stdout.String())
+	}
+}
+
+func TestPipeStdioRemoteClose(t *testing.T) {
+	local, remote := tcpPair(t)
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	// Удалённая сторона закрылась, stdin ещё открыт: выходим без ошибки
+	done := make(chan error, 1)
+	var stdout bytes.Buffer
+	go func() { done <- pipeStdio(local, stdin, &stdout) }()
+	remote.Write([]byte("bye"))
+	remote.Close()
+	select {
+	case err := <-done:
+		if err != nil || stdout.String() != "bye" {
+			t.Errorf("pipeStdio: %v, stdout %q", err, stdout.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pipeStdio waits for stdin after the remote side closed")
+	}
+}
+
+// fakeTunnel отдаёт заранее подготовленное соединение вместо SSH канала.
+type fakeTunnel struct {
+	conn   net.Conn
+	err    error
+	target string
+}
+
+func (f *fakeTunnel) Dial(network, addr string) (net.Conn, error) {
+	f.target = addr
+	return f.conn, f.err
+}
+
+func (f *fakeTunnel) Close() error {
+	return nil
+}
+
+func TestRunStdioExitCodes(t *testing.T) {
+	defer func(orig func(*proxy.ProxyConfig) (sshTunnel, error)) { dialSSH = orig }(dialSSH)
+	args := []string{"-host", "jump", "-user", "me", "-password-from", "env:SSH2SOCKS5_TEST_PASSWORD", "db.internal", "5432"}
+
+	for _, tt := range []struct {
+		name   string
+		args   []string
+		tunnel func(t *testing.T) (*fakeTunnel, error)
+		want   int
+		stdout string
+	}{
+		{"no target", args[:6], nil, exitUsage, ""},
+		{"stdin secret", []string{"-host", "jump", "-user", "me", "-password-from", "stdin", "db.internal", "5432"}, nil, exitUsage, ""},
+		{"ssh failed", args, func(t *testing.T) (*fakeTunnel, error) {
+			return nil, errors.New("ssh: handshake failed")
+		}, exitSSHFailed, ""},
+		{"target refused", args, func(t *testing.T) (*fakeTunnel, error) {
+			return &fakeTunnel{err: errors.New("ssh: rejected: connect failed")}, nil
+		}, exitTarget, ""},
+		{"ok", args, func(t *testing.T) (*fakeTunnel, error) {
+			local, remote := tcpPair(t)
+			go serveEOFEcho(remote)
+			return &fakeTunnel{conn: local}, nil
+		}, exitOK, "echo hello"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var tunnel *fakeTunnel
+			dialSSH = func(config *proxy.ProxyConfig) (sshTunnel, error) {
+				if tt.tunnel == nil {
+					t.Fatal("SSH dialed")
+				}
+				f, err := tt.tunnel(t)
+				if err != nil {
+					return nil, err
+				}
+				tunnel = f
+				return f, nil
+			}
+			var stdout bytes.Buffer
+			if code := runStdio(tt.args, strings.NewReader("hello"), &stdout); code != tt.want {
+				t.Fatalf("exit code %d, want %d", code, tt.want)
+			}
+			if stdout.String() != tt.stdout {
+				t.Errorf("stdout %q, want %q", stdout.String(), tt.stdout)
+			}
+			if tunnel != nil && tunnel.target != "db.internal:5432" {
+				t.Errorf("dialed %q", tunnel.target)
+			}
+		})
+	}
+}
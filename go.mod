@@ -3,9 +3,11 @@ module ssh2socks5
 go 1.22.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
 	golang.org/x/crypto v0.32.0
 	golang.org/x/net v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Списки доступа клиентов. Адрес клиента проверяется сразу после accept,
+// до рукопожатия SOCKS5/HTTP, так что чужие клиенты не видят даже
+// приветствия прокси.
+
+// Как часто проверять, не изменились ли файлы списков
+const aclCheckInterval = 5 * time.Second
+
+// ClientACL ограничивает, с каких адресов можно подключаться к слушателю.
+// Сначала проверяется Deny; если задан Allow (или AllowFile), адрес должен
+// в него входить. Файлы содержат адрес или подсеть в строке, "#" начинает
+// комментарий; они перечитываются при изменении.
+type ClientACL struct {
+	Allow     []string `json:"allow,omitempty"`
+	Deny      []string `json:"deny,omitempty"`
+	AllowFile string   `json:"allow_file,omitempty"`
+	DenyFile  string   `json:"deny_file,omitempty"`
+}
+
+func (c *ClientACL) empty() bool {
+	return c == nil || (len(c.Allow) == 0 && len(c.Deny) == 0 && c.AllowFile == "" && c.DenyFile == "")
+}
+
+func (c *ClientACL) validate() error {
+	if c == nil {
+		return nil
+	}
+	var errs []error
+	for _, entry := range append(append([]string(nil), c.Allow...), c.Deny...) {
+		if _, err := parseCIDR(entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func clientACLEqual(a, b *ClientACL) bool {
+	if a.empty() || b.empty() {
+		return a.empty() == b.empty()
+	}
+	return fmt.Sprint(*a) == fmt.Sprint(*b)
+}
+
+type aclRules struct {
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	hasAllow bool
+}
+
+func (r *aclRules) allowed(ip net.IP) bool {
+	for _, n := range r.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if !r.hasAllow {
+		return true
+	}
+	for _, n := range r.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerACL - действующий список доступа слушателя. Меняется при
+// перезагрузке конфигурации и изменении файлов, не пересоздавая слушатель.
+type listenerACL struct {
+	name  string
+	rules atomic.Pointer[aclRules]
+
+	lock   sync.Mutex
+	config *ClientACL
+	mtimes map[string]time.Time
+}
+
+func newListenerACL(name string, config *ClientACL) (*listenerACL, error) {
+	a := &listenerACL{name: name}
+	if err := a.update(config); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// update применяет новую конфигурацию. При ошибке прежний список остаётся.
+func (a *listenerACL) update(config *ClientACL) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rules := &aclRules{}
+	mtimes := make(map[string]time.Time)
+	if !config.empty() {
+		var err error
+		if rules.allow, err = loadACLEntries(config.Allow, config.AllowFile, mtimes); err != nil {
+			return fmt.Errorf("allow: %v", err)
+		}
+		if rules.deny, err = loadACLEntries(config.Deny, config.DenyFile, mtimes); err != nil {
+			return fmt.Errorf("deny: %v", err)
+		}
+		rules.hasAllow = len(config.Allow) > 0 || config.AllowFile != ""
+	}
+	a.config = config
+	a.mtimes = mtimes
+	a.rules.Store(rules)
+	return nil
+}
+
+// filesChanged сообщает, изменились ли файлы списков с последней загрузки.
+func (a *listenerACL) filesChanged() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for path, mtime := range a.mtimes {
+		if !fileModTime(path).Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// markSeen запоминает текущее время изменения файлов, чтобы после
+// неудачной загрузки не повторять её, пока файл не изменится снова.
+func (a *listenerACL) markSeen() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for path := range a.mtimes {
+		a.mtimes[path] = fileModTime(path)
+	}
+}
+
+// fileModTime возвращает время изменения файла, нулевое - если его нет.
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (a *listenerACL) allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	return a.rules.Load().allowed(ip)
+}
+
+func loadACLEntries(entries []string, path string, mtimes map[string]time.Time) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		n, err := parseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	if path == "" {
+		return nets, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	mtimes[path] = info.ModTime()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		n, err := parseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, scanner.Err()
+}
+
+// aclListener отклоняет соединения клиентов, не прошедших список доступа.
+type aclListener struct {
+	net.Listener
+	acl *listenerACL
+	p   *ProxyServer
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		l.p.metrics.aclDenied.inc(l.acl.name)
+		l.p.Logger().Info("Connection denied by ACL", "listener", l.acl.name, "client", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// withACL оборачивает слушатель проверкой списка доступа.
+func (p *ProxyServer) withACL(listener net.Listener, acl *listenerACL) net.Listener {
+	return &aclListener{Listener: listener, acl: acl, p: p}
+}
+
+// listenerACLs возвращает списки доступа всех слушателей.
+func (p *ProxyServer) listenerACLs() []*listenerACL {
+	acls := []*listenerACL{p.proxyACL, p.adminACL}
+	p.forwardsLock.Lock()
+	for _, f := range p.localForwards {
+		acls = append(acls, f.acl)
+	}
+	p.forwardsLock.Unlock()
+	return acls
+}
+
+// watchACLFiles перечитывает изменившиеся файлы списков доступа.
+func (p *ProxyServer) watchACLFiles() {
+	ticker := time.NewTicker(aclCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.reloadACLFiles()
+	}
+}
+
+func (p *ProxyServer) reloadACLFiles() {
+	for _, acl := range p.listenerACLs() {
+		if !acl.filesChanged() {
+			continue
+		}
+		acl.lock.Lock()
+		config := acl.config
+		acl.lock.Unlock()
+		if err := acl.update(config); err != nil {
+			acl.markSeen()
+			p.Logger().Warn("Failed to reload ACL, keeping the previous list", "listener", acl.name, "err", err)
+			continue
+		}
+		p.Logger().Info("ACL reloaded", "listener", acl.name)
+	}
+}
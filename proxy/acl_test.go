@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestACLRules(t *testing.T) {
+	for _, tt := range []struct {
+		acl     *ClientACL
+		allowed map[string]bool
+	}{
+		{nil, map[string]bool{"1.2.3.4": true, "::1": true}},
+		{&ClientACL{Deny: []string{"10.0.0.0/8"}}, map[string]bool{
+			"10.1.2.3": false,
+			"11.0.0.1": true,
+		}},
+		// Deny проверяется первым
+		{&ClientACL{Allow: []string{"192.168.0.0/16"}, Deny: []string{"192.168.1.13"}}, map[string]bool{
+			"192.168.1.1":  true,
+			"192.168.1.13": false,
+			"10.0.0.1":     false,
+		}},
+		{&ClientACL{Allow: []string{"127.0.0.1", "fd00::/8"}}, map[string]bool{
+			"127.0.0.1":        true,
+			"::ffff:127.0.0.1": true,
+			"fd00::1":          true,
+			"::1":              false,
+		}},
+	} {
+		acl, err := newListenerACL("test", tt.acl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ip, want := range tt.allowed {
+			addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}
+			if got := acl.allowed(addr); got != want {
+				t.Errorf("%+v: allowed(%s) = %v, want %v", tt.acl, ip, got, want)
+			}
+		}
+	}
+	if _, err := newListenerACL("test", &ClientACL{Allow: []string{"not an address"}}); err == nil {
+		t.Error("expected an error for an invalid entry")
+	}
+}
+
+// startACLServer принимает соединения через список доступа и отвечает "ok".
+func startACLServer(t *testing.T, p *ProxyServer, acl *listenerACL) string {
+	ln := p.withACL(listen(t), acl)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// aclAllows подключается к серверу: отклонённое соединение закрывается
+// без ответа.
+func aclAllows(t *testing.T, addr string) bool {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data) == "ok"
+}
+
+func newACLTestServer(t *testing.T, config *ProxyConfig) *ProxyServer {
+	t.Helper()
+	config.LogLevel = "error"
+	config.LogPath = ""
+	p, err := NewProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestACLReload(t *testing.T) {
+	config := DefaultConfig()
+	config.ClientACL = &ClientACL{Deny: []string{"127.0.0.0/8"}}
+	p := newACLTestServer(t, config)
+	addr := startACLServer(t, p, p.proxyACL)
+
+	if aclAllows(t, addr) {
+		t.Fatal("denied client accepted")
+	}
+	p.metrics.aclDenied.lock.Lock()
+	denied := p.metrics.aclDenied.values["proxy"]
+	p.metrics.aclDenied.lock.Unlock()
+	if denied != 1 {
+		t.Errorf("denied counter %v", denied)
+	}
+
+	// Как при Reload: список меняется без переоткрытия слушателя
+	reloaded := &ClientACL{Allow: []string{"127.0.0.1"}}
+	if clientACLEqual(config.ClientACL, reloaded) {
+		t.Fatal("changed ACL reported as equal")
+	}
+	if err := p.proxyACL.update(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !aclAllows(t, addr) {
+		t.Fatal("allowed client rejected after reload")
+	}
+
+	// Ошибка в новой конфигурации оставляет прежний список
+	if err := p.proxyACL.update(&ClientACL{Deny: []string{"bad"}}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !aclAllows(t, addr) {
+		t.Error("previous list lost after a failed update")
+	}
+}
+
+func TestACLFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	write := func(content string, age time.Duration) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Время изменения задаётся явно: запись в ту же секунду
+		// может его не изменить
+		mtime := time.Now().Add(age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# local clients\n127.0.0.1\n", -time.Hour)
+
+	config := DefaultConfig()
+	config.ClientACL = &ClientACL{DenyFile: path}
+	p := newACLTestServer(t, config)
+	addr := startACLServer(t, p, p.proxyACL)
+	if aclAllows(t, addr) {
+		t.Fatal("client from deny_file accepted")
+	}
+
+	write("10.0.0.0/8\n", -time.Minute)
+	p.reloadACLFiles()
+	if !aclAllows(t, addr) {
+		t.Fatal("client rejected after deny_file changed")
+	}
+
+	// Неверный файл не применяется, прежний список остаётся
+	write("127.0.0.1\nnot an address\n", 0)
+	p.reloadACLFiles()
+	if !aclAllows(t, addr) {
+		t.Error("invalid deny_file applied")
+	}
+	if p.proxyACL.filesChanged() {
+		t.Error("invalid file will be re-read on every check")
+	}
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reconnect открывает новую SSH сессию и переводит на неё новые
+// соединения. Текущие соединения дорабатывают на старой сессии. Если
+// соединение потеряно, попытка superviseSSH начинается сразу, и Reconnect
+// ждёт её исхода.
+func (p *ProxyServer) Reconnect() error {
+	if p.SSHState().State != SSHStateConnected {
+		ctx, cancel := context.WithTimeout(context.Background(), reconnectWaitTimeout)
+		defer cancel()
+		return p.retrySSH(ctx)
+	}
+
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	client, err := p.createNewSSHClient()
+	if err != nil {
+		p.metrics.sshReconnects.inc(resultError)
+		p.recordSSHError(err)
+		return fmt.Errorf("failed to connect to SSH server: %v", err)
+	}
+	p.metrics.sshReconnects.inc(resultSuccess)
+	p.reconnects.Add(1)
+	p.switchSSHClient(client)
+	p.logMessage("SSH session re-established on request")
+	return nil
+}
+
+func (p *ProxyServer) recordSSHError(err error) {
+	p.sshErrLock.Lock()
+	p.lastSSHError = err.Error()
+	p.lastSSHErrorAt = time.Now()
+	p.sshErrLock.Unlock()
+}
+
+// requireAdminToken проверяет заголовок Authorization, если задан admin_token.
+// Без токена admin сервер слушает только loopback, и единственный, кто может
+// прийти на него извне, - браузер пользователя по запросу чужой страницы,
+// поэтому такие запросы отклоняются.
+func (p *ProxyServer) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := p.currentConfig().AdminToken
+		if token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ssh2socks5"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		} else if err := checkBrowserRequest(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkBrowserRequest отклоняет запросы чужих сайтов (Origin,
+// Sec-Fetch-Site) и DNS rebinding (имя в Host не loopback).
+func checkBrowserRequest(r *http.Request) error {
+	switch site := r.Header.Get("Sec-Fetch-Site"); site {
+	case "", "same-origin", "none":
+	default:
+		return fmt.Errorf("%s request rejected", site)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return fmt.Errorf("cross-origin request from %q rejected", origin)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("host %q rejected, set admin_token to use other names", r.Host)
+	}
+	return nil
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return isLoopbackHost(host)
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *ProxyServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.Connections())
+}
+
+func (p *ProxyServer) handleClosedConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.ClosedConnections())
+}
+
+func (p *ProxyServer) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	switch err := p.CloseConnection(id); {
+	case err == errConnectionNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (p *ProxyServer) handleReconnect(w http.ResponseWriter, r *http.Request) {
+	if err := p.Reconnect(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleConfig отдаёт действующую конфигурацию без паролей и токенов.
+func (p *ProxyServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	config := *p.currentConfig()
+	if config.SSHPassword != "" {
+		config.SSHPassword = "REDACTED"
+	}
+	if config.AdminToken != "" {
+		config.AdminToken = "REDACTED"
+	}
+	config.SSHTransport = config.SSHTransport.redacted()
+	if len(config.ProxyUsers) > 0 {
+		users := make([]ProxyUser, len(config.ProxyUsers))
+		for i, u := range config.ProxyUsers {
+			users[i] = ProxyUser{Name: u.Name, Password: "REDACTED"}
+		}
+		config.ProxyUsers = users
+	}
+	writeJSON(w, config)
+}
+
+// Типы пробросов в admin API
+const (
+	forwardLocal  = "local"
+	forwardRemote = "remote"
+)
+
+// Forwards - пробросы для GET /forwards.
+type Forwards struct {
+	Local  []ForwardConfig `json:"local"`
+	Remote []ForwardStatus `json:"remote"`
+}
+
+// forwardRequest - тело POST /forwards.
+type forwardRequest struct {
+	Type     string     `json:"type"`
+	Listen   string     `json:"listen"`
+	Target   string     `json:"target"`
+	ACL      *ClientACL `json:"acl,omitempty"`
+	Timeouts *Timeouts  `json:"timeouts,omitempty"`
+}
+
+func (p *ProxyServer) handleForwards(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Forwards{Local: p.LocalForwards(), Remote: p.RemoteForwards()})
+}
+
+// handleAddForward открывает проброс без записи в конфигурацию: reload
+// закрывает локальные пробросы, которых нет в файле.
+func (p *ProxyServer) handleAddForward(w http.ResponseWriter, r *http.Request) {
+	var req forwardRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Type != forwardLocal && req.Type != forwardRemote {
+		http.Error(w, fmt.Sprintf("type must be %q or %q", forwardLocal, forwardRemote), http.StatusBadRequest)
+		return
+	}
+
+	config := ForwardConfig{ListenAddr: req.Listen, TargetAddr: req.Target, ACL: req.ACL, Timeouts: req.Timeouts}
+	var errs []error
+	validateForward("forward", config, req.Type == forwardRemote, func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	})
+	if err := errors.Join(errs...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if req.Type == forwardLocal {
+		err = p.addLocalForward(config)
+	} else {
+		err = p.addRemoteForward(config)
+	}
+	switch {
+	case errors.Is(err, errForwardExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (p *ProxyServer) handleRemoveForward(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.PathValue("type") {
+	case forwardLocal:
+		err = p.RemoveLocalForward(r.PathValue("listen"))
+	case forwardRemote:
+		err = p.RemoveRemoteForward(r.PathValue("listen"))
+	default:
+		http.Error(w, "unknown forward type", http.StatusNotFound)
+		return
+	}
+	switch {
+	case errors.Is(err, errForwardNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// startAdmin запускает только admin сервер, без SSH и слушателей прокси.
+func startAdmin(t *testing.T, config *ProxyConfig) (*ProxyServer, string) {
+	t.Helper()
+	config.LogLevel = "error"
+	config.LogPath = ""
+	p, err := NewProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.setupAdminServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.logServer.Close()
+		p.closeLocalForwards()
+		p.closeRemoteForwards()
+		p.wg.Wait()
+	})
+	return p, "http://" + p.logListener.Addr().String()
+}
+
+func adminRequest(t *testing.T, method, url, body string, header map[string]string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestAdminForwards(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "secret"
+	_, base := startAdmin(t, config)
+	auth := map[string]string{"Authorization": "Bearer secret"}
+
+	if code, _ := adminRequest(t, "GET", base+"/forwards", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("without token: %d", code)
+	}
+
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{`{"type":"local","listen":"127.0.0.1:0","target":"db.internal:5432"}`, http.StatusCreated},
+		{`{"type":"local","listen":"127.0.0.1:0","target":"db.internal:5432"}`, http.StatusConflict},
+		// Порт открывается на SSH сервере после подключения
+		{`{"type":"remote","listen":"127.0.0.1:8080","target":"127.0.0.1:80"}`, http.StatusCreated},
+		{`{"type":"remote","listen":"127.0.0.1:8081","target":"127.0.0.1:80","acl":{"allow":["10.0.0.0/8"]}}`, http.StatusBadRequest},
+		{`{"type":"dynamic","listen":"127.0.0.1:1081","target":"127.0.0.1:80"}`, http.StatusBadRequest},
+		{`{"type":"local","listen":"127.0.0.1","target":"db.internal:5432"}`, http.StatusBadRequest},
+		{`{"type":"local","listen":"127.0.0.1:1082","target":"db.internal:5432","timeouts":{"handshake":"1s"}}`, http.StatusBadRequest},
+		{`{"type":"local","listen":"127.0.0.1:1082","target":"db.internal:5432","timeouts":{"idle":"-1s"}}`, http.StatusBadRequest},
+	} {
+		if code, body := adminRequest(t, "POST", base+"/forwards", tt.body, auth); code != tt.code {
+			t.Errorf("POST %s: %d %s, want %d", tt.body, code, body, tt.code)
+		}
+	}
+
+	code, body := adminRequest(t, "GET", base+"/forwards", "", auth)
+	if code != http.StatusOK {
+		t.Fatalf("GET /forwards: %d %s", code, body)
+	}
+	var forwards Forwards
+	if err := json.Unmarshal([]byte(body), &forwards); err != nil {
+		t.Fatal(err)
+	}
+	if len(forwards.Local) != 1 || forwards.Local[0].TargetAddr != "db.internal:5432" {
+		t.Errorf("local forwards: %+v", forwards.Local)
+	}
+	if len(forwards.Remote) != 1 || forwards.Remote[0].State != ForwardStateReconnecting {
+		t.Errorf("remote forwards: %+v", forwards.Remote)
+	}
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{"/forwards/local/127.0.0.1:0", http.StatusNoContent},
+		{"/forwards/local/127.0.0.1:0", http.StatusNotFound},
+		{"/forwards/remote/127.0.0.1:8080", http.StatusNoContent},
+		{"/forwards/dynamic/127.0.0.1:8080", http.StatusNotFound},
+	} {
+		if code, body := adminRequest(t, "DELETE", base+tt.path, "", auth); code != tt.code {
+			t.Errorf("DELETE %s: %d %s, want %d", tt.path, code, body, tt.code)
+		}
+	}
+	if _, body := adminRequest(t, "GET", base+"/forwards", "", auth); body != "{\"local\":[],\"remote\":[]}\n" {
+		t.Errorf("forwards after delete: %s", body)
+	}
+}
+
+func TestAdminBrowserRequests(t *testing.T) {
+	_, base := startAdmin(t, DefaultConfig())
+	host := strings.TrimPrefix(base, "http://")
+	_, port, _ := net.SplitHostPort(host)
+
+	for _, tt := range []struct {
+		name   string
+		header map[string]string
+		code   int
+	}{
+		{"curl", nil, http.StatusOK},
+		{"same origin", map[string]string{"Origin": base, "Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{"address bar", map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK},
+		{"localhost", map[string]string{"Host": "localhost:" + port}, http.StatusOK},
+		{"cross site", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		// Другой порт localhost - тот же сайт, но другой источник
+		{"same site", map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"foreign origin", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"other port", map[string]string{"Origin": "http://127.0.0.1:3000"}, http.StatusForbidden},
+		{"null origin", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"dns rebinding", map[string]string{"Host": "evil.example:" + port, "Origin": "http://evil.example:" + port, "Sec-Fetch-Site": "same-origin"}, http.StatusForbidden},
+	} {
+		req, err := http.NewRequest("GET", base+"/connections", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if h, ok := tt.header["Host"]; ok {
+			req.Host = h
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.code)
+		}
+	}
+
+	// С токеном решает только токен
+	config := DefaultConfig()
+	config.AdminToken = "secret"
+	_, base = startAdmin(t, config)
+	code, _ := adminRequest(t, "GET", base+"/connections", "", map[string]string{
+		"Authorization":  "Bearer secret",
+		"Sec-Fetch-Site": "cross-site",
+	})
+	if code != http.StatusOK {
+		t.Errorf("with token: %d", code)
+	}
+}
+
+func TestAdminLogsNoCORS(t *testing.T) {
+	_, base := startAdmin(t, DefaultConfig())
+	req, err := http.NewRequest("GET", base+"/logs?replay=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin: %q", got)
+	}
+}
+
+func TestValidateAdminAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr, token string
+		ok          bool
+	}{
+		{"127.0.0.1:1792", "", true},
+		{"[::1]:1792", "", true},
+		{"localhost:1792", "", true},
+		{"", "", true},
+		{"0.0.0.0:1792", "", false},
+		{":1792", "", false},
+		{"192.168.1.10:1792", "", false},
+		{"0.0.0.0:1792", "secret", true},
+	} {
+		config := DefaultConfig()
+		config.SSHHost, config.SSHUser, config.SSHPassword = "example.com", "u", "pw"
+		config.AdminAddr, config.AdminToken = tt.addr, tt.token
+		if err := config.Validate(); (err == nil) != tt.ok {
+			t.Errorf("admin_addr %q token %q: %v", tt.addr, tt.token, err)
+		}
+	}
+}
+
+// Start без Validate (mobile, библиотека) тоже не открывает API по сети без токена
+func TestStartAdminAddr(t *testing.T) {
+	config := DefaultConfig()
+	config.LogLevel = "error"
+	config.LogPath = ""
+	config.AdminAddr = "0.0.0.0:0"
+	p, err := NewProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Start()
+	if err == nil || !strings.Contains(err.Error(), "admin_token is required") {
+		t.Fatalf("Start: %v", err)
+	}
+	if p.logListener != nil {
+		t.Error("admin server listening")
+	}
+
+	config = DefaultConfig()
+	config.LogLevel = "error"
+	config.LogPath = ""
+	config.AdminToken = "secret"
+	p, err = NewProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.setupAdminServer("0.0.0.0:0"); err != nil {
+		t.Fatalf("with a token: %v", err)
+	}
+	p.logServer.Close()
+	p.wg.Wait()
+}
+
+type closeErrConn struct {
+	net.Conn
+}
+
+func (c closeErrConn) Close() error {
+	c.Conn.Close()
+	return errors.New("close failed")
+}
+
+func TestAdminCloseConnection(t *testing.T) {
+	p, base := startAdmin(t, DefaultConfig())
+	tc, err := p.openConn(context.Background(), protoSOCKS5, "127.0.0.1:5000", "", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	if err := tc.attach(closeErrConn{server}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		id   string
+		code int
+	}{
+		{"x", http.StatusBadRequest},
+		{fmt.Sprint(tc.info.ID + 1), http.StatusNotFound},
+		{fmt.Sprint(tc.info.ID), http.StatusInternalServerError},
+		{fmt.Sprint(tc.info.ID), http.StatusNotFound},
+	} {
+		if code, body := adminRequest(t, "DELETE", base+"/connections/"+tt.id, "", nil); code != tt.code {
+			t.Errorf("DELETE /connections/%s: %d %s, want %d", tt.id, code, body, tt.code)
+		}
+	}
+}
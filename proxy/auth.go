@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// ProxyUser - пользователь прокси. Если в конфигурации есть хотя бы один,
+// SOCKS5 и HTTP прокси требуют логин и пароль.
+type ProxyUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+func validateProxyUsers(users []ProxyUser) []error {
+	var errs []error
+	seen := make(map[string]bool, len(users))
+	for i, u := range users {
+		if u.Name == "" || u.Password == "" {
+			errs = append(errs, fmt.Errorf("proxy_users[%d]: name and password are required", i))
+		}
+		if seen[u.Name] {
+			errs = append(errs, fmt.Errorf("proxy_users[%d]: duplicate user %q", i, u.Name))
+		}
+		seen[u.Name] = true
+	}
+	return errs
+}
+
+// proxyCredentials проверяет пароли по действующей конфигурации,
+// так что изменения после Reload применяются сразу.
+type proxyCredentials struct {
+	config func() *ProxyConfig
+}
+
+func (c proxyCredentials) Valid(user, password string) bool {
+	for _, u := range c.config().ProxyUsers {
+		if u.Name == user {
+			return subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+		}
+	}
+	return false
+}
+
+// socksAuthMethods возвращает методы авторизации SOCKS5 для конфигурации.
+func (p *ProxyServer) socksAuthMethods(config *ProxyConfig) []socks5.Authenticator {
+	if len(config.ProxyUsers) == 0 {
+		return nil
+	}
+	return []socks5.Authenticator{socks5.UserPassAuthenticator{Credentials: proxyCredentials{p.currentConfig}}}
+}
+
+// requireProxyAuth проверяет заголовок Proxy-Authorization, если заданы
+// пользователи, и передаёт имя пользователя обработчику через контекст.
+func (p *ProxyServer) requireProxyAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(p.currentConfig().ProxyUsers) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+		if !ok || !(proxyCredentials{p.currentConfig}).Valid(user.Name, user.Password) {
+			p.Logger().Debug("Proxy authentication failed", "client", r.RemoteAddr)
+			w.Header().Set("Proxy-Authenticate", `Basic realm="ssh2socks5"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		r.Header.Del("Proxy-Authorization")
+		next.ServeHTTP(w, r.WithContext(withClientUser(r.Context(), user.Name)))
+	})
+}
+
+func parseProxyAuthorization(header string) (ProxyUser, bool) {
+	encoded, ok := strings.CutPrefix(header, "Basic ")
+	if !ok {
+		return ProxyUser{}, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return ProxyUser{}, false
+	}
+	name, password, ok := strings.Cut(string(decoded), ":")
+	return ProxyUser{Name: name, Password: password}, ok
+}
+
+type clientUserKey struct{}
+
+// withClientUser сохраняет имя пользователя прокси для диалера.
+func withClientUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, clientUserKey{}, user)
+}
+
+func clientUserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(clientUserKey{}).(string)
+	return user
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateProxyUsers(t *testing.T) {
+	for _, tt := range []struct {
+		users []ProxyUser
+		errs  int
+	}{
+		{nil, 0},
+		{[]ProxyUser{{"phone", "pw"}, {"laptop", "pw"}}, 0},
+		{[]ProxyUser{{"phone", ""}}, 1},
+		{[]ProxyUser{{"", "pw"}}, 1},
+		{[]ProxyUser{{"phone", "a"}, {"phone", "b"}}, 1},
+	} {
+		if errs := validateProxyUsers(tt.users); len(errs) != tt.errs {
+			t.Errorf("%v: %v", tt.users, errs)
+		}
+	}
+}
+
+func TestParseProxyAuthorization(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		user   ProxyUser
+		ok     bool
+	}{
+		{"Basic cGhvbmU6c2VjcmV0", ProxyUser{"phone", "secret"}, true},
+		// Пароль может содержать двоеточие
+		{"Basic cGhvbmU6YTpi", ProxyUser{"phone", "a:b"}, true},
+		{"Basic cGhvbmU=", ProxyUser{}, false},
+		{"Basic !!!", ProxyUser{}, false},
+		{"Bearer cGhvbmU6c2VjcmV0", ProxyUser{}, false},
+		{"", ProxyUser{}, false},
+	} {
+		user, ok := parseProxyAuthorization(tt.header)
+		if ok != tt.ok || (ok && user != tt.user) {
+			t.Errorf("%q: %+v %v", tt.header, user, ok)
+		}
+	}
+}
+
+func TestRequireProxyAuth(t *testing.T) {
+	p := newBenchServer()
+	config := *p.config
+	config.ProxyUsers = []ProxyUser{{"phone", "secret"}}
+	p.config = &config
+
+	var gotUser string
+	handler := p.requireProxyAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser = clientUserFromContext(r.Context())
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization passed to the handler")
+		}
+	}))
+	request := func(auth string) int {
+		gotUser = ""
+		r := httptest.NewRequest("CONNECT", "http://example.com:443", nil)
+		if auth != "" {
+			r.Header.Set("Proxy-Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := request(""); code != http.StatusProxyAuthRequired {
+		t.Errorf("without credentials: %d", code)
+	}
+	if code := request("Basic cGhvbmU6d3Jvbmc="); code != http.StatusProxyAuthRequired {
+		t.Errorf("wrong password: %d", code)
+	}
+	if code := request("Basic cGhvbmU6c2VjcmV0"); code != http.StatusOK || gotUser != "phone" {
+		t.Errorf("valid credentials: %d, user %q", code, gotUser)
+	}
+
+	// Пароли проверяются по действующей конфигурации
+	reloaded := config
+	reloaded.ProxyUsers = []ProxyUser{{"phone", "changed"}}
+	p.config = &reloaded
+	if code := request("Basic cGhvbmU6c2VjcmV0"); code != http.StatusProxyAuthRequired {
+		t.Errorf("old password after reload: %d", code)
+	}
+	if !(proxyCredentials{p.currentConfig}).Valid("phone", "changed") {
+		t.Error("SOCKS5 credentials not updated")
+	}
+
+	// Без пользователей авторизация не нужна
+	reloaded.ProxyUsers = nil
+	if code := request(""); code != http.StatusOK || gotUser != "" {
+		t.Errorf("without users: %d, user %q", code, gotUser)
+	}
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfigFile читает конфигурацию из YAML, TOML или JSON файла (формат
+// определяется по расширению). Переменные окружения вида $VAR и ${VAR}
+// раскрываются в строковых значениях. Незаданные поля получают значения
+// по умолчанию; проверка полноты выполняется отдельно через Validate.
+func LoadConfigFile(path string) (*ProxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, expected .yaml, .toml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	// Все форматы приводятся к JSON, чтобы описывать поля одним набором тегов
+	normalized, err := json.Marshal(expandEnv(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	config := DefaultConfig()
+	decoder := json.NewDecoder(bytes.NewReader(normalized))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// DefaultConfig возвращает конфигурацию со значениями по умолчанию.
+func DefaultConfig() *ProxyConfig {
+	return &ProxyConfig{
+		SSHPort:   "22",
+		LocalPort: "1080",
+		LogPath:   filepath.Join("logs", "proxy.log"),
+		ProxyType: "socks5",
+		AdminAddr: "127.0.0.1:1792",
+		LogLevel:  "info",
+		LogFormat: "text",
+		// 10 МБ на файл, 5 старых файлов не старше недели
+		LogMaxSize:    10,
+		LogMaxBackups: 5,
+		LogMaxAge:     Duration(7 * 24 * time.Hour),
+		// Время на завершение активных соединений при остановке
+		DrainTimeout:     Duration(30 * time.Second),
+		ConnectionLimits: ConnectionLimits{Max: 100},
+	}
+}
+
+// Duration - time.Duration, который в файле конфигурации записывается
+// строкой ("30s", "2m") или числом секунд.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %v", v)
+	}
+	return nil
+}
+
+func expandEnv(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return os.ExpandEnv(v)
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = expandEnv(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = expandEnv(item)
+		}
+	}
+	return v
+}
+
+// Validate проверяет конфигурацию и возвращает все найденные проблемы разом.
+func (c *ProxyConfig) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.SSHHost == "" {
+		add("ssh_host is required")
+	}
+	if c.SSHUser == "" {
+		add("ssh_user is required")
+	}
+	if c.SSHPassword == "" && c.SSHPasswordFrom == "" && c.PasswordCallback == nil && c.KeyPath == "" {
+		add("either ssh_password, ssh_password_from or key_path is required")
+	}
+	if c.SSHPassword != "" && c.SSHPasswordFrom != "" {
+		add("ssh_password and ssh_password_from are mutually exclusive")
+	}
+	if c.SSHPasswordFrom != "" {
+		if err := validateSecretSource(c.SSHPasswordFrom); err != nil {
+			add("ssh_password_from: %v", err)
+		}
+	}
+	if c.KeyPassphraseFrom != "" {
+		if err := validateSecretSource(c.KeyPassphraseFrom); err != nil {
+			add("key_passphrase_from: %v", err)
+		}
+		if c.KeyPath == "" {
+			add("key_passphrase_from requires key_path")
+		}
+	}
+	if err := c.SSHTransport.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.SSHAlgorithms.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if !validPort(c.SSHPort) {
+		add("ssh_port: invalid port %q", c.SSHPort)
+	}
+	if !validPort(c.LocalPort) {
+		add("local_port: invalid port %q", c.LocalPort)
+	}
+	if c.ProxyType != "socks5" && c.ProxyType != "http" {
+		add("proxy_type: must be socks5 or http, got %q", c.ProxyType)
+	}
+	if c.AdminAddr != "" {
+		if err := validateHostPort(c.AdminAddr); err != nil {
+			add("admin_addr: %v", err)
+		} else if c.AdminToken == "" && !isLoopback(c.AdminAddr) {
+			add("admin_addr: %s is not a loopback address, admin_token is required", c.AdminAddr)
+		}
+	}
+	if c.DrainTimeout < 0 {
+		add("drain_timeout: must not be negative")
+	}
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			add("log_level: must be debug, info, warn or error, got %q", c.LogLevel)
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		add("log_format: must be text or json, got %q", c.LogFormat)
+	}
+	if c.LogMaxSize < 0 || c.LogMaxBackups < 0 || c.LogRotateEvery < 0 || c.LogMaxAge < 0 {
+		add("log rotation settings must not be negative")
+	}
+
+	listens := make(map[string]string)
+	checkListen := func(field, addr string) {
+		if prev, dup := listens[addr]; dup {
+			add("%s: %s already used by %s", field, addr, prev)
+		}
+		listens[addr] = field
+	}
+	for i, f := range c.LocalForwards {
+		field := fmt.Sprintf("local_forwards[%d]", i)
+		validateForward(field, f, false, add)
+		checkListen(field, "local "+f.ListenAddr)
+	}
+	for i, f := range c.RemoteForwards {
+		field := fmt.Sprintf("remote_forwards[%d]", i)
+		validateForward(field, f, true, add)
+		checkListen(field, "remote "+f.ListenAddr)
+	}
+	for i, rd := range c.ReverseDynamic {
+		field := fmt.Sprintf("reverse_dynamic[%d]", i)
+		if err := validateHostPort(rd.ListenAddr); err != nil {
+			add("%s.listen: %v", field, err)
+		}
+		if acl, err := newDestMatcherFromList(rd.AllowDestinations); err != nil {
+			add("%s.allow: %v", field, err)
+		} else if acl.empty() {
+			add("%s.allow: at least one destination is required", field)
+		}
+		checkListen(field, "remote "+rd.ListenAddr)
+	}
+	ruleNames := make(map[string]bool, len(c.Rules))
+	for i, rule := range c.Rules {
+		if _, err := compileRule(i, rule, nil); err != nil {
+			errs = append(errs, err)
+		}
+		ruleNames[ruleName(i, rule)] = true
+		if err := rule.Timeouts.validate(); err != nil {
+			add("rule %s: %v", ruleName(i, rule), err)
+		} else if rule.Timeouts != nil && rule.Timeouts.Handshake != nil {
+			add("rule %s: handshake timeout is not supported in rules", ruleName(i, rule))
+		}
+		countries, sites := ruleGeoEntries(rule)
+		for _, country := range countries {
+			if country != geoIPPrivate && c.GeoIPPath == "" {
+				add("rule %s: %s%s requires geoip_path", ruleName(i, rule), geoIPPrefix, country)
+			}
+		}
+		if len(sites) > 0 && c.GeoSitePath == "" {
+			add("rule %s: %s requires geosite_path", ruleName(i, rule), geoSitePrefix+sites[0])
+		}
+	}
+
+	errs = append(errs, validateProxyUsers(c.ProxyUsers)...)
+	if err := c.ClientACL.validate(); err != nil {
+		add("client_acl: %v", err)
+	}
+	if err := c.AdminACL.validate(); err != nil {
+		add("admin_acl: %v", err)
+	}
+	if err := c.Timeouts.validate(); err != nil {
+		add("timeouts: %v", err)
+	}
+	if err := c.Reconnect.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.DestinationFilter.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.ConnectionLimits.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.RateLimits.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	users := make(map[string]bool, len(c.ProxyUsers))
+	for _, u := range c.ProxyUsers {
+		users[u.Name] = true
+	}
+	for name := range c.RateLimits.Users {
+		if !users[name] {
+			add("rate_limits.users: unknown user %q", name)
+		}
+	}
+	for name := range c.RateLimits.Rules {
+		if !ruleNames[name] {
+			add("rate_limits.rules: unknown rule %q", name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateForward проверяет проброс из конфигурации или из admin API.
+func validateForward(field string, f ForwardConfig, remote bool, add func(string, ...interface{})) {
+	if err := validateHostPort(f.ListenAddr); err != nil {
+		add("%s.listen: %v", field, err)
+	}
+	if err := validateHostPort(f.TargetAddr); err != nil {
+		add("%s.target: %v", field, err)
+	}
+	if remote && f.ACL != nil {
+		add("%s.acl: not supported for remote forwards", field)
+	} else if err := f.ACL.validate(); err != nil {
+		add("%s.acl: %v", field, err)
+	}
+	validateForwardTimeouts(field, f.Timeouts, add)
+}
+
+// validateForwardTimeouts проверяет таймауты проброса: рукопожатия
+// у проброса нет.
+func validateForwardTimeouts(field string, t *Timeouts, add func(string, ...interface{})) {
+	if err := t.validate(); err != nil {
+		add("%s.timeouts: %v", field, err)
+	} else if t != nil && t.Handshake != nil {
+		add("%s.timeouts: handshake timeout is not supported for forwards", field)
+	}
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+func validateHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !validPort(port) && port != "0" {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Одна и та же конфигурация в трёх форматах
+var testConfigFiles = map[string]string{
+	"proxy.yaml": `
+ssh_host: ${TEST_SSH_HOST}
+ssh_port: "2222"
+ssh_user: $TEST_SSH_USER
+ssh_password_from: env:TEST_SSH_PASSWORD
+local_port: "1081"
+drain_timeout: 10s
+timeouts:
+  dial: 5s
+  idle: 90
+rules:
+  - name: local
+    cidrs: [10.0.0.0/8]
+    ports: [22, 443]
+    action: direct
+local_forwards:
+  - listen: 127.0.0.1:5432
+    target: db.internal:5432
+`,
+	"proxy.toml": `
+ssh_host = "${TEST_SSH_HOST}"
+ssh_port = "2222"
+ssh_user = "$TEST_SSH_USER"
+ssh_password_from = "env:TEST_SSH_PASSWORD"
+local_port = "1081"
+drain_timeout = "10s"
+
+[timeouts]
+dial = "5s"
+idle = 90
+
+[[rules]]
+name = "local"
+cidrs = ["10.0.0.0/8"]
+ports = [22, 443]
+action = "direct"
+
+[[local_forwards]]
+listen = "127.0.0.1:5432"
+target = "db.internal:5432"
+`,
+	"proxy.json": `{
+  "ssh_host": "${TEST_SSH_HOST}",
+  "ssh_port": "2222",
+  "ssh_user": "$TEST_SSH_USER",
+  "ssh_password_from": "env:TEST_SSH_PASSWORD",
+  "local_port": "1081",
+  "drain_timeout": 10,
+  "timeouts": {"dial": "5s", "idle": 90},
+  "rules": [{"name": "local", "cidrs": ["10.0.0.0/8"], "ports": [22, 443], "action": "direct"}],
+  "local_forwards": [{"listen": "127.0.0.1:5432", "target": "db.internal:5432"}]
+}`,
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	t.Setenv("TEST_SSH_HOST", "ssh.example.com")
+	t.Setenv("TEST_SSH_USER", "tunnel")
+
+	dial, idle := Duration(5*time.Second), Duration(90*time.Second)
+	want := DefaultConfig()
+	want.SSHHost = "ssh.example.com"
+	want.SSHPort = "2222"
+	want.SSHUser = "tunnel"
+	want.SSHPasswordFrom = "env:TEST_SSH_PASSWORD"
+	want.LocalPort = "1081"
+	want.DrainTimeout = Duration(10 * time.Second)
+	want.Timeouts = Timeouts{Dial: &dial, Idle: &idle}
+	want.Rules = []RouteRule{{Name: "local", CIDRs: []string{"10.0.0.0/8"}, Ports: []int{22, 443}, Action: "direct"}}
+	want.LocalForwards = []ForwardConfig{{ListenAddr: "127.0.0.1:5432", TargetAddr: "db.internal:5432"}}
+
+	for name, content := range testConfigFiles {
+		t.Run(name, func(t *testing.T) {
+			config, err := LoadConfigFile(writeConfigFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, want) {
+				t.Errorf("got  %+v\nwant %+v", config, want)
+			}
+			if err := config.Validate(); err != nil {
+				t.Errorf("validate: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, content, err string
+	}{
+		{"proxy.ini", "ssh_host = x", "unknown config format"},
+		{"proxy.yaml", "ssh_host: [", "proxy.yaml"},
+		{"proxy.toml", "ssh_host = ", "proxy.toml"},
+		{"proxy.json", `{"ssh_host": }`, "proxy.json"},
+		{"proxy.yaml", "ssh_hots: x", `unknown field "ssh_hots"`},
+		{"proxy.yaml", "local_port: 1080", "cannot unmarshal number"},
+		{"proxy.yaml", "drain_timeout: soon", "invalid duration"},
+		{"proxy.json", `{"timeouts": {"idle": true}}`, "invalid duration"},
+	} {
+		_, err := LoadConfigFile(writeConfigFile(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: %v, want %q", tt.name, tt.content, err, tt.err)
+		}
+	}
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("TEST_A", "a")
+	t.Setenv("TEST_EMPTY", "")
+	got := expandEnv(map[string]interface{}{
+		"plain":  "$TEST_A-${TEST_A}",
+		"unset":  "x${TEST_UNSET_VARIABLE}y",
+		"empty":  "$TEST_EMPTY",
+		"number": 42.0,
+		"list":   []interface{}{"$TEST_A", true, map[string]interface{}{"deep": "${TEST_A}"}},
+	})
+	want := map[string]interface{}{
+		"plain":  "a-a",
+		"unset":  "xy",
+		"empty":  "",
+		"number": 42.0,
+		"list":   []interface{}{"a", true, map[string]interface{}{"deep": "a"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *ProxyConfig {
+		c := DefaultConfig()
+		c.SSHHost, c.SSHUser, c.SSHPassword = "ssh.example.com", "u", "pw"
+		return c
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		modify func(c *ProxyConfig)
+		errs   []string
+	}{
+		{"required", func(c *ProxyConfig) {
+			c.SSHHost, c.SSHUser, c.SSHPassword = "", "", ""
+		}, []string{"ssh_host is required", "ssh_user is required", "either ssh_password"}},
+		{"password twice", func(c *ProxyConfig) {
+			c.SSHPasswordFrom = "env:X"
+		}, []string{"mutually exclusive"}},
+		{"secret source", func(c *ProxyConfig) {
+			c.SSHPassword, c.SSHPasswordFrom = "", "vault:x"
+		}, []string{"ssh_password_from: unknown secret source"}},
+		{"passphrase without key", func(c *ProxyConfig) {
+			c.KeyPassphraseFrom = "env:X"
+		}, []string{"key_passphrase_from requires key_path"}},
+		{"ports", func(c *ProxyConfig) {
+			c.SSHPort, c.LocalPort = "0", "http"
+		}, []string{`ssh_port: invalid port "0"`, `local_port: invalid port "http"`}},
+		{"proxy type", func(c *ProxyConfig) {
+			c.ProxyType = "socks4"
+		}, []string{"proxy_type: must be socks5 or http"}},
+		{"forwards", func(c *ProxyConfig) {
+			c.LocalForwards = []ForwardConfig{
+				{ListenAddr: "127.0.0.1:5432", TargetAddr: "db"},
+				{ListenAddr: "127.0.0.1:5432", TargetAddr: "db:5432"},
+			}
+		}, []string{"local_forwards[0].target", "local_forwards[1]: local 127.0.0.1:5432 already used by local_forwards[0]"}},
+		{"rate limit names", func(c *ProxyConfig) {
+			c.RateLimits.Users = map[string]Bandwidth{"ghost": {Download: 1}}
+		}, []string{`rate_limits.users: unknown user "ghost"`}},
+		{"negative limits", func(c *ProxyConfig) {
+			c.ConnectionLimits.Max = -1
+			c.DrainTimeout = -1
+		}, []string{"connection_limits", "drain_timeout: must not be negative"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			// Все ошибки собираются разом
+			if n := len(strings.Split(err.Error(), "\n")); n != len(tt.errs) {
+				t.Errorf("%d errors, want %d: %v", n, len(tt.errs), err)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Фильтр назначений: запрещённые и разрешённые адреса из конфигурации и
+// файлов списков. Проверяется до маршрутизации, так что запрещённое
+// назначение не уходит ни в туннель, ни напрямую.
+
+// Форматы файлов списков
+const (
+	listFormatHosts   = "hosts"   // "0.0.0.0 ads.example.com tracker.example.com"
+	listFormatDomains = "domains" // домен в строке, "*.example.com" или "example.com"
+	listFormatCIDRs   = "cidrs"   // адрес или подсеть в строке
+)
+
+// Решения фильтра для журнала и /connections
+const (
+	filterBlocklist = "blocklist"
+	filterAllowlist = "allowlist"
+	// Имя не разрешилось, и подсети фильтра проверить нельзя
+	filterUnresolved = "unresolved"
+)
+
+// DestinationFilter - запрещённые (Block) и разрешённые (Allow) назначения.
+// Запрет проверяется первым; если задан хоть один разрешающий список,
+// назначения вне него запрещены. Записи - домены (с поддоменами),
+// адреса и подсети.
+type DestinationFilter struct {
+	Block      []string   `json:"block,omitempty"`
+	Allow      []string   `json:"allow,omitempty"`
+	BlockLists []ListFile `json:"block_lists,omitempty"`
+	AllowLists []ListFile `json:"allow_lists,omitempty"`
+}
+
+// ListFile - файл списка. Пустой Format определяет вид каждой строки по
+// содержимому. "#" начинает комментарий.
+type ListFile struct {
+	Path   string `json:"path"`
+	Format string `json:"format,omitempty"`
+}
+
+func (f DestinationFilter) empty() bool {
+	return len(f.Block) == 0 && len(f.Allow) == 0 && len(f.BlockLists) == 0 && len(f.AllowLists) == 0
+}
+
+func (f DestinationFilter) validate() error {
+	var errs []error
+	for _, list := range append(append([]ListFile(nil), f.BlockLists...), f.AllowLists...) {
+		switch list.Format {
+		case "", listFormatHosts, listFormatDomains, listFormatCIDRs:
+		default:
+			errs = append(errs, fmt.Errorf("destination_filter: %s: unknown format %q", list.Path, list.Format))
+		}
+		if list.Path == "" {
+			errs = append(errs, errors.New("destination_filter: list path is required"))
+		}
+	}
+	if _, err := newDestMatcherFromList(append(append([]string(nil), f.Block...), f.Allow...)); err != nil {
+		errs = append(errs, fmt.Errorf("destination_filter: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+type destFilter struct {
+	block    *destMatcher
+	allow    *destMatcher
+	hasAllow bool
+	// В списках есть подсети: имя назначения нужно разрешить до проверки
+	hasCIDRs bool
+}
+
+// newDestFilter загружает списки. Для пустой конфигурации возвращает nil.
+func newDestFilter(config DestinationFilter) (*destFilter, error) {
+	if config.empty() {
+		return nil, nil
+	}
+	block, err := loadDestLists(config.Block, config.BlockLists)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := loadDestLists(config.Allow, config.AllowLists)
+	if err != nil {
+		return nil, err
+	}
+	hasAllow := len(config.Allow) > 0 || len(config.AllowLists) > 0
+	return &destFilter{
+		block:    block,
+		allow:    allow,
+		hasAllow: hasAllow,
+		hasCIDRs: !block.ips.empty() || hasAllow && !allow.ips.empty(),
+	}, nil
+}
+
+// needsIP сообщает, что для проверки имени нужен его адрес.
+func (f *destFilter) needsIP() bool {
+	return f != nil && f.hasCIDRs
+}
+
+// check возвращает filterBlocklist или filterAllowlist, если назначение
+// запрещено, и пустую строку, если разрешено.
+func (f *destFilter) check(host string, ip net.IP) string {
+	if f == nil {
+		return ""
+	}
+	if f.block.match(host, ip) {
+		return filterBlocklist
+	}
+	if f.hasAllow && !f.allow.match(host, ip) {
+		return filterAllowlist
+	}
+	return ""
+}
+
+func loadDestLists(entries []string, lists []ListFile) (*destMatcher, error) {
+	domains, cidrs := splitDestEntries(entries)
+	for _, list := range lists {
+		if err := loadListFile(list, &domains, &cidrs); err != nil {
+			return nil, err
+		}
+	}
+	return newDestMatcher(domains, cidrs)
+}
+
+func loadListFile(list ListFile, domains, cidrs *[]string) error {
+	f, err := os.Open(list.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		format := list.Format
+		if format == "" {
+			format = detectListFormat(fields)
+		}
+		switch format {
+		case listFormatHosts:
+			if net.ParseIP(fields[0]) == nil {
+				return fmt.Errorf("%s:%d: expected an address followed by host names", list.Path, line)
+			}
+			for _, host := range fields[1:] {
+				if !isLocalHostName(host) {
+					*domains = append(*domains, host)
+				}
+			}
+		case listFormatCIDRs:
+			if _, err := parseCIDR(fields[0]); err != nil {
+				return fmt.Errorf("%s:%d: %v", list.Path, line, err)
+			}
+			*cidrs = append(*cidrs, fields[0])
+		default:
+			*domains = append(*domains, fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+func detectListFormat(fields []string) string {
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return listFormatHosts
+	}
+	if strings.Contains(fields[0], "/") || net.ParseIP(fields[0]) != nil {
+		return listFormatCIDRs
+	}
+	return listFormatDomains
+}
+
+// isLocalHostName отсеивает служебные записи hosts файлов, чтобы
+// список блокировки не запрещал localhost.
+func isLocalHostName(host string) bool {
+	switch strings.ToLower(host) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost",
+		"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix",
+		"ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0":
+		return true
+	}
+	return false
+}
+
+// ipSet - множество адресов в виде отсортированных непересекающихся
+// диапазонов.
+type ipSet struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	from, to netip.Addr
+}
+
+func newIPSet(nets []*net.IPNet) *ipSet {
+	ranges := make([]ipRange, 0, len(nets))
+	for _, n := range nets {
+		addr, ok := netip.AddrFromSlice(n.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		ones, _ := n.Mask.Size()
+		if addr.Is4() && len(n.Mask) == net.IPv6len {
+			ones -= 96
+		}
+		prefix := netip.PrefixFrom(addr, ones).Masked()
+		ranges = append(ranges, ipRange{from: prefix.Addr(), to: lastAddr(prefix)})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].from.Less(ranges[j].from)
+	})
+
+	// Сливаем пересекающиеся и соседние диапазоны одного семейства: IPv4
+	// идут перед IPv6, и диапазон до 255.255.255.255 не должен захватить
+	// следующий за ним IPv6
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.to.BitLen() == r.from.BitLen() && (!last.to.Less(r.from) || last.to.Next() == r.from) {
+				if last.to.Less(r.to) {
+					last.to = r.to
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &ipSet{ranges: merged}
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func (s *ipSet) empty() bool {
+	return len(s.ranges) == 0
+}
+
+func (s *ipSet) contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return !s.ranges[i].to.Less(addr)
+	})
+	return i < len(s.ranges) && !addr.Less(s.ranges[i].from)
+}
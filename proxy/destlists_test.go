@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testIPSet(t *testing.T, cidrs ...string) *ipSet {
+	t.Helper()
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		n, err := parseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return newIPSet(nets)
+}
+
+func TestIPSetContains(t *testing.T) {
+	for _, tt := range []struct {
+		cidrs []string
+		ip    string
+		want  bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.255.255.255", true},
+		{[]string{"10.0.0.0/8"}, "11.0.0.0", false},
+		{[]string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{[]string{"192.168.1.1"}, "192.168.1.1", true},
+		{[]string{"192.168.1.1"}, "192.168.1.2", false},
+		// Соседние и вложенные диапазоны сливаются
+		{[]string{"10.0.0.0/25", "10.0.0.128/25", "10.0.0.7"}, "10.0.0.200", true},
+		{[]string{"10.0.0.0/25", "10.0.0.130/31"}, "10.0.0.128", false},
+		// Диапазоны разных семейств не сливаются
+		{[]string{"255.255.255.255", "fe80::/10"}, "255.255.255.255", true},
+		{[]string{"255.255.255.255", "fe80::/10"}, "fe80::1", true},
+		{[]string{"255.255.255.255", "fe80::/10"}, "2001:4860:4860::8888", false},
+		{[]string{"255.255.255.255", "fe80::/10"}, "::1", false},
+		{[]string{"0.0.0.0/0", "2001:db8::/32"}, "::1", false},
+		{[]string{"0.0.0.0/0", "2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"0.0.0.0/0", "2001:db8::/32"}, "8.8.8.8", true},
+		{[]string{"::/0"}, "8.8.8.8", false},
+		{[]string{"::/0"}, "::1", true},
+		{[]string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff0/124", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}, "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff1", true},
+		{nil, "127.0.0.1", false},
+	} {
+		if got := testIPSet(t, tt.cidrs...).contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%v contains %s = %v, want %v", tt.cidrs, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func writeListFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadListFile(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		format  string
+		content string
+		domains []string
+		cidrs   []string
+		wantErr bool
+	}{
+		{
+			name:    "hosts",
+			format:  listFormatHosts,
+			content: "# adblock\n127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com # two\n::1 ip6-localhost\n\n",
+			domains: []string{"ads.example.com", "tracker.example.com"},
+		},
+		{
+			name:    "hosts without address",
+			format:  listFormatHosts,
+			content: "ads.example.com\n",
+			wantErr: true,
+		},
+		{
+			name:    "domains",
+			format:  listFormatDomains,
+			content: "*.example.com\nexample.org   # comment\n",
+			domains: []string{"*.example.com", "example.org"},
+		},
+		{
+			name:    "cidrs",
+			format:  listFormatCIDRs,
+			content: "10.0.0.0/8\n2001:db8::/32\n192.168.1.1\n",
+			cidrs:   []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"},
+		},
+		{
+			name:    "bad cidr",
+			format:  listFormatCIDRs,
+			content: "10.0.0.0/33\n",
+			wantErr: true,
+		},
+		{
+			name:    "detected",
+			content: "0.0.0.0 ads.example.com\nexample.org\n10.0.0.0/8\n::1\n",
+			domains: []string{"ads.example.com", "example.org"},
+			cidrs:   []string{"10.0.0.0/8", "::1"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var domains, cidrs []string
+			err := loadListFile(ListFile{Path: writeListFile(t, tt.content), Format: tt.format}, &domains, &cidrs)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(domains, tt.domains) || !reflect.DeepEqual(cidrs, tt.cidrs) {
+				t.Errorf("got domains %q cidrs %q, want %q %q", domains, cidrs, tt.domains, tt.cidrs)
+			}
+		})
+	}
+}
+
+func TestDestFilterOrder(t *testing.T) {
+	allowFile := writeListFile(t, "example.com\n10.0.0.0/8\n")
+	for _, tt := range []struct {
+		name   string
+		config DestinationFilter
+		checks map[string]string
+	}{
+		{
+			name:   "block only",
+			config: DestinationFilter{Block: []string{"ads.example.com", "10.1.0.0/16"}},
+			checks: map[string]string{
+				"ads.example.com":   filterBlocklist,
+				"x.ads.example.com": filterBlocklist,
+				"example.com":       "",
+				"10.1.2.3":          filterBlocklist,
+				"10.2.0.1":          "",
+			},
+		},
+		{
+			// Запрет проверяется до разрешения: назначение из обоих
+			// списков запрещено
+			name: "block before allow",
+			config: DestinationFilter{
+				Block:      []string{"ads.example.com", "10.1.0.0/16"},
+				AllowLists: []ListFile{{Path: allowFile}},
+			},
+			checks: map[string]string{
+				"ads.example.com": filterBlocklist,
+				"www.example.com": "",
+				"10.1.2.3":        filterBlocklist,
+				"10.2.0.1":        "",
+				"example.org":     filterAllowlist,
+				"8.8.8.8":         filterAllowlist,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newDestFilter(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for host, want := range tt.checks {
+				if got := f.check(host, nil); got != want {
+					t.Errorf("check(%q) = %q, want %q", host, got, want)
+				}
+			}
+		})
+	}
+
+	f, err := newDestFilter(DestinationFilter{})
+	if err != nil || f != nil {
+		t.Fatalf("empty filter: %v %v", f, err)
+	}
+	if got := f.check("example.com", nil); got != "" {
+		t.Errorf("nil filter blocks: %q", got)
+	}
+}
+
+func TestDestFilterResolve(t *testing.T) {
+	route := func(config DestinationFilter, addr string) routeDecision {
+		t.Helper()
+		c := DefaultConfig()
+		c.DestinationFilter = config
+		r, err := newRouter(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.routeAddr(addr)
+	}
+
+	// Имя, указывающее на запрещённую подсеть, запрещено так же, как адрес
+	d := route(DestinationFilter{Block: []string{"127.0.0.0/8"}}, "localhost:80")
+	if d.Action != RouteBlock || d.Rule != filterBlocklist {
+		t.Errorf("localhost with 127.0.0.0/8 blocked: %+v", d)
+	}
+
+	// Разрешённое имя: подключение идёт к проверенному адресу
+	d = route(DestinationFilter{Allow: []string{"127.0.0.0/8"}}, "localhost:80")
+	if d.Action == RouteBlock || !d.ip.IsLoopback() {
+		t.Fatalf("localhost with 127.0.0.0/8 allowed: %+v", d)
+	}
+	if addr := d.dialAddr("localhost:80"); addr != net.JoinHostPort(d.ip.String(), "80") {
+		t.Errorf("dial address %q", addr)
+	}
+
+	// Списки только из доменов имя не разрешают
+	d = route(DestinationFilter{Block: []string{"ads.example.com"}}, "localhost:80")
+	if d.Action == RouteBlock || d.ip != nil {
+		t.Errorf("domain-only filter: %+v", d)
+	}
+	if addr := d.dialAddr("localhost:80"); addr != "localhost:80" {
+		t.Errorf("dial address %q", addr)
+	}
+}
+
+func TestDestFilterResolveDial(t *testing.T) {
+	target := listen(t)
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	config := DefaultConfig()
+	config.DestinationFilter = DestinationFilter{Block: []string{"127.0.0.0/8"}}
+	p := newACLTestServer(t, config)
+	// Путь HTTP и CONNECT: блокировка срабатывает до подключения
+	if _, decision, err := p.dialRoute(context.Background(), addr); err != errBlockedByRule || decision.Rule != filterBlocklist {
+		t.Errorf("dial %s: %v, %+v", addr, err, decision)
+	}
+
+	config = DefaultConfig()
+	config.DestinationFilter = DestinationFilter{Allow: []string{"127.0.0.0/8"}}
+	config.Rules = []RouteRule{{Action: RouteDirect}}
+	p = newACLTestServer(t, config)
+	conn, decision, err := p.dialRoute(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != decision.dialAddr(addr) {
+		t.Errorf("connected to %s, want checked %s", got, decision.dialAddr(addr))
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// drainConns ждёт завершения соединений, пока не истечёт ctx, после чего
+// закрывает оставшиеся. Возвращает число принудительно закрытых.
+func (p *ProxyServer) drainConns(ctx context.Context) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for p.conns.activeCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return p.closeTrackedConns()
+		case <-ticker.C:
+		}
+	}
+	return 0
+}
+
+func (p *ProxyServer) closeTrackedConns() int {
+	conns := p.conns.list()
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// Shutdown останавливает прокси в два этапа: сначала перестаёт принимать
+// новые соединения и ждёт завершения активных туннелей, а когда ctx
+// истекает - закрывает оставшиеся. Возвращает число оборванных соединений.
+func (p *ProxyServer) Shutdown(ctx context.Context) (int, error) {
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.httpListener != nil {
+		p.httpListener.Close()
+	}
+	p.closeLocalForwards()
+	p.closeRemoteForwards()
+
+	if active := p.conns.activeCount(); active > 0 {
+		p.logMessage(fmt.Sprintf("Draining %d active connections...", active))
+	}
+
+	if p.httpServer != nil {
+		// Ждёт обычные HTTP запросы; CONNECT туннели отслеживаются отдельно
+		if err := p.httpServer.Shutdown(ctx); err != nil {
+			p.httpServer.Close()
+		}
+	}
+
+	cut := p.drainConns(ctx)
+	if cut > 0 {
+		p.logMessage(fmt.Sprintf("Drain deadline reached, closed %d connections", cut))
+	}
+
+	return cut, p.Stop()
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startDrainProxy запускает SOCKS5 прокси без SSH с прямым маршрутом.
+func startDrainProxy(t *testing.T) *ProxyServer {
+	config := DefaultConfig()
+	config.Rules = []RouteRule{{Action: RouteDirect}}
+	p := newACLTestServer(t, config)
+	if err := p.startSocksProxy("127.0.0.1:0", config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.listener.Close()
+		p.closeTrackedConns()
+		p.wg.Wait()
+	})
+	return p
+}
+
+// openTunnel открывает через прокси туннель до эхо-сервера.
+func openTunnel(t *testing.T, proxyAddr, target string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if reply := socksConnect(t, conn, target); reply != 0 {
+		t.Fatalf("SOCKS5 reply %d", reply)
+	}
+	echoThrough(t, conn)
+	return conn
+}
+
+func echoThrough(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo %q, %v", reply, err)
+	}
+}
+
+type shutdownResult struct {
+	cut      int
+	err      error
+	duration time.Duration
+}
+
+func startShutdown(p *ProxyServer, timeout time.Duration) <-chan shutdownResult {
+	done := make(chan shutdownResult, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		start := time.Now()
+		cut, err := p.Shutdown(ctx)
+		done <- shutdownResult{cut, err, time.Since(start)}
+	}()
+	return done
+}
+
+// waitRefused ждёт, пока прокси перестанет принимать соединения.
+func waitRefused(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("new connections still accepted during drain")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	p := startDrainProxy(t)
+	addr := p.listener.Addr().String()
+	target := startEchoServer(t)
+	first := openTunnel(t, addr, target)
+	second := openTunnel(t, addr, target)
+
+	done := startShutdown(p, 5*time.Second)
+	waitRefused(t, addr)
+
+	// Открытые туннели работают, пока идёт ожидание
+	echoThrough(t, first)
+	echoThrough(t, second)
+	first.Close()
+	second.Close()
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.cut != 0 {
+			t.Errorf("Shutdown: cut %d, %v", r.cut, r.err)
+		}
+		if r.duration > 2*time.Second {
+			t.Errorf("Shutdown waited %v after the connections finished", r.duration)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestShutdownDrainDeadline(t *testing.T) {
+	p := startDrainProxy(t)
+	addr := p.listener.Addr().String()
+	target := startEchoServer(t)
+	finished := openTunnel(t, addr, target)
+	remaining := []net.Conn{openTunnel(t, addr, target), openTunnel(t, addr, target)}
+
+	const drain = 300 * time.Millisecond
+	done := startShutdown(p, drain)
+	waitRefused(t, addr)
+	finished.Close()
+
+	// Оставшиеся после дедлайна соединения обрываются и учитываются
+	var r shutdownResult
+	select {
+	case r = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	if r.err != nil || r.cut != 2 {
+		t.Errorf("Shutdown: cut %d, want 2, %v", r.cut, r.err)
+	}
+	if r.duration < drain {
+		t.Errorf("Shutdown returned after %v, before the drain deadline", r.duration)
+	}
+	for _, conn := range remaining {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection not closed after the deadline: %v", err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ForwardConfig описывает статический проброс порта:
+// ListenAddr принимает соединения, TargetAddr - куда они уходят.
+type ForwardConfig struct {
+	ListenAddr string `json:"listen"`
+	TargetAddr string `json:"target"`
+	// Кому разрешено подключаться, только для локальных пробросов
+	ACL *ClientACL `json:"acl,omitempty"`
+	// Таймауты соединений проброса (кроме handshake)
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+}
+
+func (f ForwardConfig) String() string {
+	return f.ListenAddr + " -> " + f.TargetAddr
+}
+
+var (
+	errForwardExists   = errors.New("already exists")
+	errForwardNotFound = errors.New("not found")
+)
+
+type localForward struct {
+	config   ForwardConfig
+	listener net.Listener
+	acl      *listenerACL
+}
+
+// ParseForwardSpec разбирает спецификацию в формате OpenSSH:
+// [bind_address:]port:host:hostport. IPv6 адреса указываются в [].
+func ParseForwardSpec(spec string) (ForwardConfig, error) {
+	parts := splitForwardSpec(spec)
+	switch len(parts) {
+	case 3:
+		return ForwardConfig{
+			ListenAddr: net.JoinHostPort("127.0.0.1", parts[0]),
+			TargetAddr: net.JoinHostPort(parts[1], parts[2]),
+		}, nil
+	case 4:
+		bind := parts[0]
+		if bind == "*" {
+			bind = "0.0.0.0"
+		}
+		return ForwardConfig{
+			ListenAddr: net.JoinHostPort(bind, parts[1]),
+			TargetAddr: net.JoinHostPort(parts[2], parts[3]),
+		}, nil
+	}
+	return ForwardConfig{}, fmt.Errorf("invalid forward spec %q, expected [bind_address:]port:host:hostport", spec)
+}
+
+func splitForwardSpec(spec string) []string {
+	var parts []string
+	var cur strings.Builder
+	inBrackets := false
+	for _, r := range spec {
+		switch {
+		case r == '[':
+			inBrackets = true
+		case r == ']':
+			inBrackets = false
+		case r == ':' && !inBrackets:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	return append(parts, cur.String())
+}
+
+// AddLocalForward открывает локальный порт, соединения с которого
+// пробрасываются через SSH на targetAddr.
+func (p *ProxyServer) AddLocalForward(listenAddr, targetAddr string) error {
+	return p.addLocalForward(ForwardConfig{ListenAddr: listenAddr, TargetAddr: targetAddr})
+}
+
+func (p *ProxyServer) addLocalForward(config ForwardConfig) error {
+	p.forwardsLock.Lock()
+	defer p.forwardsLock.Unlock()
+
+	if _, exists := p.localForwards[config.ListenAddr]; exists {
+		return fmt.Errorf("local forward on %s %w", config.ListenAddr, errForwardExists)
+	}
+
+	acl, err := newListenerACL("local_forward:"+config.ListenAddr, config.ACL)
+	if err != nil {
+		return fmt.Errorf("acl: %v", err)
+	}
+	listener, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	f := &localForward{
+		config:   config,
+		listener: p.withACL(listener, acl),
+		acl:      acl,
+	}
+	if p.localForwards == nil {
+		p.localForwards = make(map[string]*localForward)
+	}
+	p.localForwards[config.ListenAddr] = f
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.serveLocalForward(f)
+	}()
+
+	p.logMessage(fmt.Sprintf("Local forward listening: %s", f.config))
+	return nil
+}
+
+// setLocalForwardTimeouts меняет таймауты открытого проброса для новых
+// соединений.
+func (p *ProxyServer) setLocalForwardTimeouts(config ForwardConfig) bool {
+	p.forwardsLock.Lock()
+	defer p.forwardsLock.Unlock()
+
+	f := p.localForwards[config.ListenAddr]
+	if f == nil || reflect.DeepEqual(f.config.Timeouts, config.Timeouts) {
+		return false
+	}
+	f.config.Timeouts = config.Timeouts
+	return true
+}
+
+// localForwardTimeouts возвращает таймауты проброса, в том числе
+// открытого через API и потому отсутствующего в конфигурации.
+func (p *ProxyServer) localForwardTimeouts(f *localForward) *Timeouts {
+	p.forwardsLock.Lock()
+	defer p.forwardsLock.Unlock()
+	return f.config.Timeouts
+}
+
+// setLocalForwardACL меняет список доступа открытого проброса.
+func (p *ProxyServer) setLocalForwardACL(config ForwardConfig) (bool, error) {
+	p.forwardsLock.Lock()
+	defer p.forwardsLock.Unlock()
+
+	f := p.localForwards[config.ListenAddr]
+	if f == nil || clientACLEqual(f.config.ACL, config.ACL) {
+		return false, nil
+	}
+	if err := f.acl.update(config.ACL); err != nil {
+		return false, err
+	}
+	f.config.ACL = config.ACL
+	return true, nil
+}
+
+// RemoveLocalForward закрывает локальный порт. Уже установленные
+// соединения продолжают работать до закрытия.
+func (p *ProxyServer) RemoveLocalForward(listenAddr string) error {
+	p.forwardsLock.Lock()
+	f, exists := p.localForwards[listenAddr]
+	delete(p.localForwards, listenAddr)
+	p.forwardsLock.Unlock()
+
+	if !exists {
+		return fmt.Errorf("local forward on %s %w", listenAddr, errForwardNotFound)
+	}
+
+	p.logMessage(fmt.Sprintf("Local forward removed: %s", f.config))
+	return f.listener.Close()
+}
+
+// LocalForwards возвращает список активных локальных пробросов.
+func (p *ProxyServer) LocalForwards() []ForwardConfig {
+	p.forwardsLock.Lock()
+	defer p.forwardsLock.Unlock()
+
+	forwards := make([]ForwardConfig, 0, len(p.localForwards))
+	for _, f := range p.localForwards {
+		forwards = append(forwards, f.config)
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].ListenAddr < forwards[j].ListenAddr
+	})
+	return forwards
+}
+
+func (p *ProxyServer) startLocalForwards() error {
+	for _, f := range p.config.LocalForwards {
+		if err := p.addLocalForward(f); err != nil {
+			return fmt.Errorf("local forward %s: %v", f, err)
+		}
+	}
+	return nil
+}
+
+func (p *ProxyServer) closeLocalForwards() {
+	p.forwardsLock.Lock()
+	defer p.forwardsLock.Unlock()
+
+	for addr, f := range p.localForwards {
+		f.listener.Close()
+		delete(p.localForwards, addr)
+	}
+}
+
+func (p *ProxyServer) serveLocalForward(f *localForward) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if !isClosedError(err) {
+				p.logWarn(fmt.Sprintf("Local forward %s accept error: %v", f.config.ListenAddr, err))
+			}
+			return
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.handleLocalForward(f, conn)
+		}()
+	}
+}
+
+func (p *ProxyServer) handleLocalForward(f *localForward, conn net.Conn) {
+	defer conn.Close()
+
+	tc, err := p.openConn(p.ctx, protoLocalForward, conn.RemoteAddr().String(), "", f.config.TargetAddr)
+	if err != nil {
+		return
+	}
+	tc.setRoute(routeDecision{Action: RouteTunnel})
+	tc.listenerTimeouts = p.localForwardTimeouts(f)
+	logger := tc.logger().With("listen", f.config.ListenAddr)
+
+	dialCtx, cancel := withDialTimeout(p.ctx, tc.timeouts().dial)
+	targetConn, err := p.dialTunnel(dialCtx, "tcp", f.config.TargetAddr)
+	cancel()
+	if err != nil {
+		tc.fail(err)
+		if !isNetworkError(err) {
+			logger.Warn("Dial failed", "err", err)
+		}
+		return
+	}
+	if err := tc.attach(targetConn); err != nil {
+		return
+	}
+	if err := splice(conn, tc); err != nil && !isNetworkError(err) {
+		logger.Warn("Tunnel error", "err", err)
+	}
+}
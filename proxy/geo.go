@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Правила по странам и спискам сайтов: в Domains/CIDRs правила можно
+// указать "geoip:ru" (страна адреса назначения по базе MaxMind) и
+// "geosite:google" (список доменов из geosite.dat v2ray).
+
+const (
+	geoIPPrefix   = "geoip:"
+	geoSitePrefix = "geosite:"
+	// geoip:private - частные и локальные адреса, база для них не нужна
+	geoIPPrivate = "private"
+)
+
+// Сколько ждать DNS, чтобы проверить geoip для имени хоста
+const geoResolveTimeout = 5 * time.Second
+
+// splitGeoEntries отделяет записи geoip:/geosite: от доменов и подсетей.
+func splitGeoEntries(entries []string) (rest, countries, sites []string) {
+	for _, e := range entries {
+		trimmed := strings.TrimSpace(e)
+		lower := strings.ToLower(trimmed)
+		switch {
+		case strings.HasPrefix(lower, geoIPPrefix):
+			countries = append(countries, strings.TrimPrefix(lower, geoIPPrefix))
+		case strings.HasPrefix(lower, geoSitePrefix):
+			sites = append(sites, strings.TrimPrefix(lower, geoSitePrefix))
+		default:
+			rest = append(rest, e)
+		}
+	}
+	return rest, countries, sites
+}
+
+// ruleGeoEntries возвращает записи geoip и geosite правила.
+func ruleGeoEntries(rule RouteRule) (countries, sites []string) {
+	entries := append(append([]string(nil), rule.Domains...), rule.CIDRs...)
+	_, countries, sites = splitGeoEntries(entries)
+	return countries, sites
+}
+
+// geoDatabases - загруженные базы. Из geosite.dat берутся только
+// списки, упомянутые в правилах.
+type geoDatabases struct {
+	ip    *mmdbReader
+	sites map[string]*siteMatcher
+}
+
+func loadGeoDatabases(config *ProxyConfig) (*geoDatabases, error) {
+	geo := &geoDatabases{}
+	var names []string
+	seen := make(map[string]bool)
+	for _, rule := range config.Rules {
+		_, sites := ruleGeoEntries(rule)
+		for _, name := range sites {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	var err error
+	if config.GeoIPPath != "" {
+		if geo.ip, err = openMMDB(config.GeoIPPath); err != nil {
+			return nil, fmt.Errorf("geoip_path: %v", err)
+		}
+	}
+	if len(names) > 0 {
+		if geo.sites, err = loadGeoSite(config.GeoSitePath, names); err != nil {
+			return nil, fmt.Errorf("geosite_path: %v", err)
+		}
+	}
+	return geo, nil
+}
+
+// geoMatcher проверяет назначение по странам и спискам сайтов правила.
+type geoMatcher struct {
+	countries map[string]struct{}
+	db        *mmdbReader
+	sites     []*siteMatcher
+}
+
+// newGeoMatcher собирает условия правила. Без баз (geo == nil) только
+// проверяет записи - так делает Validate.
+func newGeoMatcher(countries, sites []string, geo *geoDatabases) (*geoMatcher, error) {
+	if len(countries) == 0 && len(sites) == 0 {
+		return nil, nil
+	}
+	m := &geoMatcher{countries: make(map[string]struct{}, len(countries))}
+	for _, c := range countries {
+		if c == "" {
+			return nil, fmt.Errorf("empty %s code", geoIPPrefix)
+		}
+		m.countries[c] = struct{}{}
+	}
+	for _, s := range sites {
+		if code, _, _ := strings.Cut(s, "@"); code == "" {
+			return nil, fmt.Errorf("empty %s list name", geoSitePrefix)
+		}
+	}
+	if geo == nil {
+		return m, nil
+	}
+	m.db = geo.ip
+	for c := range m.countries {
+		if c != geoIPPrivate && m.db == nil {
+			return nil, fmt.Errorf("%s%s requires geoip_path", geoIPPrefix, c)
+		}
+	}
+	for _, s := range sites {
+		site := geo.sites[s]
+		if site == nil {
+			return nil, fmt.Errorf("%s%s requires geosite_path", geoSitePrefix, s)
+		}
+		m.sites = append(m.sites, site)
+	}
+	return m, nil
+}
+
+func (m *geoMatcher) empty() bool {
+	return m == nil
+}
+
+// needsIP сообщает, нужен ли адрес, чтобы проверить правило.
+func (m *geoMatcher) needsIP() bool {
+	return m != nil && len(m.countries) > 0
+}
+
+func (m *geoMatcher) match(host string, ip net.IP) bool {
+	if m == nil {
+		return false
+	}
+	if ip != nil && len(m.countries) > 0 {
+		if _, ok := m.countries[geoIPPrivate]; ok && isPrivateIP(ip) {
+			return true
+		}
+		if m.db != nil {
+			if _, ok := m.countries[m.db.country(ip)]; ok {
+				return true
+			}
+		}
+	}
+	if len(m.sites) > 0 && host != "" && net.ParseIP(host) == nil {
+		for _, site := range m.sites {
+			if site.match(host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// resolveHost возвращает адрес хоста для проверки geoip: SOCKS5 клиенты
+// обычно присылают уже разрешённый адрес, HTTP - только имя.
+func resolveHost(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), geoResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			return a.IP
+		}
+	}
+	return addrs[0].IP
+}
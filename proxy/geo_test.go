@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Базы в testdata созданы testdata/gen_geo.go.
+//go:generate go run testdata/gen_geo.go
+
+func TestMMDBLookup(t *testing.T) {
+	for _, tt := range []struct {
+		file       string
+		recordSize uint
+		ipVersion  uint
+	}{
+		{"country-v6-24.mmdb", 24, 6},
+		{"country-v6-28.mmdb", 28, 6},
+		{"country-v6-32.mmdb", 32, 6},
+		{"country-v4.mmdb", 24, 4},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			r, err := openMMDB(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.recordSize != tt.recordSize || r.ipVersion != tt.ipVersion {
+				t.Fatalf("record size %d, ip version %d", r.recordSize, r.ipVersion)
+			}
+			if tt.ipVersion == 6 && r.ipv4Start == 0 {
+				t.Fatal("IPv4 subtree not found")
+			}
+			v6 := "us"
+			if tt.ipVersion == 4 {
+				v6 = ""
+			}
+			for ip, want := range map[string]string{
+				"1.2.3.4":         "ru",
+				"1.2.3.255":       "ru",
+				"1.2.4.1":         "",
+				"::ffff:1.2.3.4":  "ru",
+				"2.200.1.1":       "de", // registered_country через указатель
+				"8.8.8.8":         "us",
+				"8.8.8.9":         "",
+				"2001:db8::1":     v6,
+				"2001:db9::1":     "",
+				"255.255.255.255": "",
+			} {
+				if got := r.country(net.ParseIP(ip)); got != want {
+					t.Errorf("country(%s) = %q, want %q", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMMDBRecord28(t *testing.T) {
+	// Старшие 4 бита записей лежат в среднем байте узла
+	r := &mmdbReader{recordSize: 28, tree: []byte{0x12, 0x34, 0x56, 0xab, 0x78, 0x9a, 0xbc}}
+	if left, right := r.record(0, 0), r.record(0, 1); left != 0xa123456 || right != 0xb789abc {
+		t.Errorf("records %#x %#x", left, right)
+	}
+}
+
+// Значения секции данных для испорченных файлов
+
+func mmdbTestString(s string) []byte {
+	return append([]byte{mmdbString<<5 | byte(len(s))}, s...)
+}
+
+func mmdbTestUint(v byte) []byte {
+	return []byte{mmdbUint16<<5 | 1, v}
+}
+
+func mmdbTestMap(pairs ...[]byte) []byte {
+	out := []byte{mmdbMap<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBMalformed(t *testing.T) {
+	good, err := os.ReadFile("testdata/country-v4.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openMMDB("testdata/country-v4.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := func(nodeCount, recordSize byte) []byte {
+		return append(append([]byte(nil), mmdbMetadataMarker...), mmdbTestMap(
+			mmdbTestString("node_count"), mmdbTestUint(nodeCount),
+			mmdbTestString("record_size"), mmdbTestUint(recordSize),
+			mmdbTestString("ip_version"), mmdbTestUint(4),
+		)...)
+	}
+	tree := good[:len(r.tree)]
+
+	for name, data := range map[string][]byte{
+		"truncated":          good[:len(good)/2],
+		"empty":              nil,
+		"record size":        append(append([]byte(nil), tree...), metadata(byte(r.nodeCount), 16)...),
+		"tree larger":        append(append([]byte(nil), tree...), metadata(200, 24)...),
+		"no nodes":           append(make([]byte, 16), metadata(0, 24)...),
+		"truncated metadata": append(append([]byte(nil), tree...), metadata(byte(r.nodeCount), 24)[:len(mmdbMetadataMarker)+5]...),
+	} {
+		if _, err := openMMDB(writeTestFile(t, "bad.mmdb", data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Дерево цело, а данные обрезаны: адрес просто не находится
+	data := append(append(append([]byte(nil), tree...), make([]byte, 16+3)...), metadata(byte(r.nodeCount), 24)...)
+	cut, err := openMMDB(writeTestFile(t, "cut.mmdb", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cut.country(net.ParseIP("1.2.3.4")); got != "" {
+		t.Errorf("country from truncated data: %q", got)
+	}
+}
+
+func TestMMDBDecoderMalformed(t *testing.T) {
+	for name, buf := range map[string][]byte{
+		// Указатель на указатель
+		"pointer to pointer": {mmdbPointer << 5, 2, mmdbPointer << 5, 0},
+		// Карта, значение которой указывает на саму карту
+		"cycle": append(append([]byte{mmdbMap<<5 | 1}, mmdbTestString("a")...), mmdbPointer<<5, 0),
+		// Размер карты больше файла
+		"huge map":     {mmdbMap<<5 | 29, 0xff},
+		"short string": {mmdbString<<5 | 5, 'a'},
+		"bad double":   {mmdbDouble<<5 | 2, 0, 0},
+		"pointer out":  {mmdbPointer << 5, 0xff},
+		"bad type":     {mmdbExtended << 5, 20},
+	} {
+		d := mmdbDecoder{buf: buf}
+		if _, _, err := d.decode(0); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadGeoSite(t *testing.T) {
+	sites, err := loadGeoSite("testdata/geosite.dat", []string{"test", "test@ads", "OTHER"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		site  string
+		hosts map[string]bool
+	}{
+		{"test", map[string]bool{
+			"example.com":           true,
+			"WWW.Example.com.":      true,
+			"notexample.com":        false,
+			"exact.example.org":     true,
+			"sub.exact.example.org": false,
+			"my-keyword.net":        true,
+			"ads12.example.net":     true,
+			"ads.example.net":       false,
+			"a.tracker.example.io":  true,
+			"other.com":             false,
+		}},
+		// Только домены с атрибутом ads
+		{"test@ads", map[string]bool{
+			"ads12.example.net":  true,
+			"tracker.example.io": true,
+			"example.com":        false,
+			"my-keyword.net":     false,
+		}},
+		{"other", map[string]bool{
+			"other.com":   true,
+			"example.com": false,
+		}},
+	} {
+		m := sites[tt.site]
+		if m == nil {
+			t.Fatalf("%s not loaded", tt.site)
+		}
+		for host, want := range tt.hosts {
+			if got := m.match(host); got != want {
+				t.Errorf("%s match %q = %v, want %v", tt.site, host, got, want)
+			}
+		}
+	}
+}
+
+func TestLoadGeoSiteErrors(t *testing.T) {
+	if _, err := loadGeoSite("testdata/geosite.dat", []string{"missing"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("missing list: %v", err)
+	}
+	good, err := os.ReadFile("testdata/geosite.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"truncated": good[:len(good)-3],
+		"bad wire":  {0x0f},
+		"long size": {0x0a, 0xff, 0xff, 0x03},
+		"varint":    bytes.Repeat([]byte{0x80}, 11),
+	} {
+		if _, err := loadGeoSite(writeTestFile(t, "geosite.dat", data), []string{"test"}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Чтение geosite.dat в формате v2ray/xray (protobuf GeoSiteList):
+//
+//	GeoSiteList { repeated GeoSite entry = 1; }
+//	GeoSite     { string country_code = 1; repeated Domain domain = 2; }
+//	Domain      { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+//	Attribute   { string key = 1; ... }
+//
+// Разбираются только списки, которые используются в правилах.
+
+// Типы доменов geosite
+const (
+	geoSitePlain  = 0 // подстрока
+	geoSiteRegex  = 1 // регулярное выражение
+	geoSiteDomain = 2 // домен с поддоменами
+	geoSiteFull   = 3 // точное совпадение
+)
+
+var errInvalidGeoSite = errors.New("invalid geosite file")
+
+// siteMatcher проверяет домен по одному списку geosite.
+type siteMatcher struct {
+	domains  map[string]struct{}
+	full     map[string]struct{}
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+func (m *siteMatcher) match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := m.full[host]; ok {
+		return true
+	}
+	for name := host; ; {
+		if _, ok := m.domains[name]; ok {
+			return true
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+	}
+	for _, k := range m.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadGeoSite загружает списки из geosite.dat. Имена - "google" или
+// "google@ads" (только домены с атрибутом ads), регистр не важен.
+func loadGeoSite(path string, names []string) (map[string]*siteMatcher, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string][]string) // код -> имена с атрибутами
+	for _, name := range names {
+		code, _, _ := strings.Cut(strings.ToLower(name), "@")
+		wanted[code] = append(wanted[code], strings.ToLower(name))
+	}
+
+	sites := make(map[string]*siteMatcher, len(names))
+	err = protoFields(buf, func(field int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var code string
+		var domains [][]byte
+		err := protoFields(value, func(field int, value []byte) error {
+			switch field {
+			case 1:
+				code = strings.ToLower(string(value))
+			case 2:
+				domains = append(domains, value)
+			}
+			return nil
+		})
+		if err != nil || wanted[code] == nil {
+			return err
+		}
+		for _, name := range wanted[code] {
+			_, attr, _ := strings.Cut(name, "@")
+			m, err := newSiteMatcher(domains, attr)
+			if err != nil {
+				return fmt.Errorf("%s: %v", code, err)
+			}
+			sites[name] = m
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, name := range names {
+		if sites[strings.ToLower(name)] == nil {
+			return nil, fmt.Errorf("%s: geosite:%s not found", path, name)
+		}
+	}
+	return sites, nil
+}
+
+func newSiteMatcher(domains [][]byte, attr string) (*siteMatcher, error) {
+	m := &siteMatcher{domains: make(map[string]struct{}), full: make(map[string]struct{})}
+	for _, raw := range domains {
+		var typ int
+		var value string
+		var attrs []string
+		err := protoFields(raw, func(field int, v []byte) error {
+			switch field {
+			case 1:
+				typ = int(protoVarint(v))
+			case 2:
+				value = string(v)
+			case 3:
+				return protoFields(v, func(field int, v []byte) error {
+					if field == 1 {
+						attrs = append(attrs, strings.ToLower(string(v)))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if attr != "" && !containsString(attrs, attr) {
+			continue
+		}
+		if typ != geoSiteRegex {
+			value = strings.ToLower(value)
+		}
+		switch typ {
+		case geoSitePlain:
+			m.keywords = append(m.keywords, value)
+		case geoSiteRegex:
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+			m.regexps = append(m.regexps, re)
+		case geoSiteDomain:
+			m.domains[value] = struct{}{}
+		case geoSiteFull:
+			m.full[value] = struct{}{}
+		}
+	}
+	return m, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// protoFields перебирает поля сообщения protobuf. Для varint полей
+// value содержит закодированное число (см. protoVarint).
+func protoFields(buf []byte, fn func(field int, value []byte) error) error {
+	for len(buf) > 0 {
+		key, n := readVarint(buf)
+		if n == 0 {
+			return errInvalidGeoSite
+		}
+		buf = buf[n:]
+		var value []byte
+		switch key & 7 {
+		case 0: // varint
+			_, n := readVarint(buf)
+			if n == 0 {
+				return errInvalidGeoSite
+			}
+			value, buf = buf[:n], buf[n:]
+		case 1: // 64 бита
+			if len(buf) < 8 {
+				return errInvalidGeoSite
+			}
+			value, buf = buf[:8], buf[8:]
+		case 2: // длина и данные
+			size, n := readVarint(buf)
+			if n == 0 || uint64(len(buf)-n) < size {
+				return errInvalidGeoSite
+			}
+			value, buf = buf[n:n+int(size)], buf[n+int(size):]
+		case 5: // 32 бита
+			if len(buf) < 4 {
+				return errInvalidGeoSite
+			}
+			value, buf = buf[:4], buf[4:]
+		default:
+			return errInvalidGeoSite
+		}
+		if err := fn(int(key>>3), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readVarint возвращает число и его длину; 0 - если буфер испорчен.
+func readVarint(buf []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(buf) && i < 10; i++ {
+		v |= uint64(buf[i]&0x7f) << (7 * i)
+		if buf[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func protoVarint(buf []byte) uint64 {
+	v, _ := readVarint(buf)
+	return v
+}
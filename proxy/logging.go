@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Журнал строится на log/slog. Записи уходят в stderr и LogPath
+// (текстом или JSON, с уровнем из конфигурации) и, независимо от
+// уровня, подписчикам /logs.
+
+// newLogger создаёт логгер по конфигурации. Возвращённый файл нужно
+// закрыть, когда логгер больше не используется.
+func newLogger(config *ProxyConfig, logs *logBroadcaster) (*slog.Logger, *rotatingFile, error) {
+	var level slog.Level
+	if config.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			return nil, nil, fmt.Errorf("log_level: invalid level %q", config.LogLevel)
+		}
+	}
+
+	var out io.Writer = os.Stderr
+	var file *rotatingFile
+	if config.LogPath != "" {
+		var err error
+		if file, err = openRotatingFile(config); err != nil {
+			return nil, nil, fmt.Errorf("log_path: %v", err)
+		}
+		out = io.MultiWriter(os.Stderr, file)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if config.LogFormat == "json" {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+
+	if logs != nil {
+		handler = &fanoutHandler{handlers: []slog.Handler{handler, &broadcastHandler{logs: logs}}}
+	}
+	return slog.New(handler), file, nil
+}
+
+func logSettingsChanged(old, config *ProxyConfig) bool {
+	return old.LogPath != config.LogPath ||
+		old.LogLevel != config.LogLevel ||
+		old.LogFormat != config.LogFormat ||
+		old.LogMaxSize != config.LogMaxSize ||
+		old.LogRotateEvery != config.LogRotateEvery ||
+		old.LogMaxBackups != config.LogMaxBackups ||
+		old.LogMaxAge != config.LogMaxAge
+}
+
+// setLogger заменяет логгер прокси, закрывая файл прежнего.
+func (p *ProxyServer) setLogger(logger *slog.Logger, file *rotatingFile) {
+	p.logLock.Lock()
+	oldFile := p.logFile
+	p.logger = logger
+	p.logFile = file
+	p.logLock.Unlock()
+
+	if oldFile != nil {
+		oldFile.Close()
+	}
+}
+
+// Logger возвращает логгер прокси, чтобы сообщения приложения попадали
+// в тот же журнал.
+func (p *ProxyServer) Logger() *slog.Logger {
+	p.logLock.RLock()
+	defer p.logLock.RUnlock()
+	if p.logger == nil {
+		return slog.Default()
+	}
+	return p.logger
+}
+
+func (p *ProxyServer) logMessage(msg string) {
+	p.Logger().Info(msg)
+}
+
+// logDebug - для подробностей, нужных только при отладке.
+func (p *ProxyServer) logDebug(msg string) {
+	p.Logger().Debug(msg)
+}
+
+func (p *ProxyServer) logWarn(msg string) {
+	p.Logger().Warn(msg)
+}
+
+func (p *ProxyServer) logError(msg string) {
+	p.Logger().Error(msg)
+}
+
+// upstreamName возвращает значение поля upstream для решения маршрутизации.
+func (p *ProxyServer) upstreamName(action string) string {
+	if action == RouteDirect {
+		return RouteDirect
+	}
+	config := p.currentConfig()
+	return "ssh://" + config.SSHUser + "@" + config.SSHHost + ":" + config.SSHPort
+}
+
+type clientAddrKey struct{}
+
+// withClientAddr сохраняет адрес клиента SOCKS5 для диалера.
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+func clientAddrFromContext(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addr
+}
+
+// fanoutHandler передаёт запись во все обработчики, которым она нужна.
+type fanoutHandler struct {
+	handlers []slog.Handler
+}
+
+func (h *fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, handler := range h.handlers {
+		if !handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h *fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return &fanoutHandler{handlers: handlers}
+}
+
+func (h *fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return &fanoutHandler{handlers: handlers}
+}
+
+// broadcastHandler отдаёт записи подписчикам /logs. Атрибуты
+// передаются плоским списком, группы - через точку.
+type broadcastHandler struct {
+	logs   *logBroadcaster
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *broadcastHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || h.logs.wants(level)
+}
+
+func (h *broadcastHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make(map[string]any, len(h.attrs)+r.NumAttrs())
+	for _, a := range h.attrs {
+		addAttr(attrs, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(attrs, h.prefix, a)
+		return true
+	})
+	if len(attrs) == 0 {
+		attrs = nil
+	}
+	h.logs.publish(LogEntry{Time: r.Time, Level: r.Level, Message: r.Message, Attrs: attrs})
+	return nil
+}
+
+func addAttr(attrs map[string]any, prefix string, a slog.Attr) {
+	value := a.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, ga := range value.Group() {
+			addAttr(attrs, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	switch v := value.Any().(type) {
+	case time.Duration:
+		attrs[prefix+a.Key] = v.String()
+	case error:
+		attrs[prefix+a.Key] = v.Error()
+	default:
+		attrs[prefix+a.Key] = v
+	}
+}
+
+func (h *broadcastHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	prefixed = append(prefixed, h.attrs...)
+	for _, a := range attrs {
+		prefixed = append(prefixed, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &broadcastHandler{logs: h.logs, attrs: prefixed, prefix: h.prefix}
+}
+
+func (h *broadcastHandler) WithGroup(name string) slog.Handler {
+	return &broadcastHandler{logs: h.logs, attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// String возвращает запись в виде "сообщение ключ=значение ...".
+func (e LogEntry) String() string {
+	if len(e.Attrs) == 0 {
+		return e.Message
+	}
+	var b strings.Builder
+	b.WriteString(e.Message)
+	for _, key := range sortedKeys(e.Attrs) {
+		fmt.Fprintf(&b, " %s=%v", key, e.Attrs[key])
+	}
+	return b.String()
+}
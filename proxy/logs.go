@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logHistorySize      = 500
+	logSubscriberBuffer = 256
+	defaultLogReplay    = 100
+)
+
+// LogEntry - строка лога для подписчиков (/logs, мобильное приложение).
+type LogEntry struct {
+	Time    time.Time      `json:"time"`
+	Level   slog.Level     `json:"level"`
+	Message string         `json:"msg"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// logBroadcaster раздаёт строки лога подписчикам и хранит последние
+// logHistorySize строк для показа при подключении.
+type logBroadcaster struct {
+	lock    sync.Mutex
+	history []LogEntry
+	next    int
+	full    bool
+	subs    map[*LogSubscription]struct{}
+	closed  bool
+	// Минимальный уровень среди подписчиков, чтобы не формировать
+	// отладочные записи, которые никто не читает
+	minLevel atomic.Int64
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	b := &logBroadcaster{
+		history: make([]LogEntry, logHistorySize),
+		subs:    make(map[*LogSubscription]struct{}),
+	}
+	b.minLevel.Store(int64(slog.LevelInfo))
+	return b
+}
+
+// wants сообщает, нужна ли подписчикам запись уровня level.
+func (b *logBroadcaster) wants(level slog.Level) bool {
+	return int64(level) >= b.minLevel.Load()
+}
+
+// updateMinLevel пересчитывает minLevel. Вызывается под lock.
+func (b *logBroadcaster) updateMinLevel() {
+	min := slog.LevelInfo
+	for s := range b.subs {
+		if s.level < min {
+			min = s.level
+		}
+	}
+	b.minLevel.Store(int64(min))
+}
+
+// LogSubscription - подписка на лог. Медленный подписчик не тормозит
+// прокси: строки, не поместившиеся в буфер, отбрасываются и считаются.
+type LogSubscription struct {
+	ch      chan LogEntry
+	level   slog.Level
+	filter  string
+	dropped atomic.Uint64
+	b       *logBroadcaster
+}
+
+// C возвращает канал строк лога. Канал закрывается при Close или остановке прокси.
+func (s *LogSubscription) C() <-chan LogEntry {
+	return s.ch
+}
+
+// Dropped возвращает число строк, отброшенных из-за переполнения буфера,
+// и обнуляет счётчик.
+func (s *LogSubscription) Dropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *LogSubscription) Close() {
+	s.b.unsubscribe(s)
+}
+
+func (s *LogSubscription) matches(e LogEntry) bool {
+	if e.Level < s.level {
+		return false
+	}
+	return s.filter == "" || strings.Contains(strings.ToLower(e.String()), s.filter)
+}
+
+func (b *logBroadcaster) publish(e LogEntry) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.history[b.next] = e
+	b.next = (b.next + 1) % len(b.history)
+	if b.next == 0 {
+		b.full = true
+	}
+
+	for s := range b.subs {
+		if !s.matches(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// subscribe регистрирует подписчика и сразу кладёт в его буфер до replay
+// последних подходящих строк.
+func (b *logBroadcaster) subscribe(level slog.Level, filter string, replay int) *LogSubscription {
+	s := &LogSubscription{
+		ch:     make(chan LogEntry, logSubscriberBuffer),
+		level:  level,
+		filter: strings.ToLower(filter),
+		b:      b,
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		close(s.ch)
+		return s
+	}
+
+	var recent []LogEntry
+	for _, e := range b.recent() {
+		if s.matches(e) {
+			recent = append(recent, e)
+		}
+	}
+	if replay > logSubscriberBuffer {
+		replay = logSubscriberBuffer
+	}
+	if len(recent) > replay {
+		recent = recent[len(recent)-replay:]
+	}
+	for _, e := range recent {
+		s.ch <- e
+	}
+
+	b.subs[s] = struct{}{}
+	b.updateMinLevel()
+	return s
+}
+
+func (b *logBroadcaster) unsubscribe(s *LogSubscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+		b.updateMinLevel()
+	}
+}
+
+// close отключает всех подписчиков, чтобы сервер администрирования
+// мог завершиться, не дожидаясь их.
+func (b *logBroadcaster) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+	b.updateMinLevel()
+}
+
+// recent возвращает историю в хронологическом порядке. Вызывается под lock.
+func (b *logBroadcaster) recent() []LogEntry {
+	if !b.full {
+		return append([]LogEntry(nil), b.history[:b.next]...)
+	}
+	return append(append([]LogEntry(nil), b.history[b.next:]...), b.history[:b.next]...)
+}
+
+// SubscribeLogs подписывается на лог прокси. level - минимальный уровень
+// (debug, info, warn, error), filter - подстрока без учёта регистра,
+// replay - сколько последних строк выдать сразу.
+func (p *ProxyServer) SubscribeLogs(level, filter string, replay int) (*LogSubscription, error) {
+	var minLevel slog.Level
+	if level != "" {
+		if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	return p.logs.subscribe(minLevel, filter, replay), nil
+}
+
+// handleLogs отдаёт лог как Server-Sent Events. Параметры:
+// ?level=warn, ?filter=substring, ?replay=N (по умолчанию 100).
+func (p *ProxyServer) handleLogs(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	replay := defaultLogReplay
+	if v := query.Get("replay"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid replay", http.StatusBadRequest)
+			return
+		}
+		replay = n
+	}
+	sub, err := p.SubscribeLogs(query.Get("level"), query.Get("filter"), replay)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if dropped := sub.Dropped(); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped)
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
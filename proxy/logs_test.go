@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+)
+
+func logEntry(level slog.Level, msg string, attrs map[string]any) LogEntry {
+	return LogEntry{Level: level, Message: msg, Attrs: attrs}
+}
+
+// receiveEntries забирает всё, что уже лежит в буфере подписчика.
+func receiveEntries(s *LogSubscription) []LogEntry {
+	var entries []LogEntry
+	for {
+		select {
+		case e, ok := <-s.C():
+			if !ok {
+				return entries
+			}
+			entries = append(entries, e)
+		default:
+			return entries
+		}
+	}
+}
+
+func messages(entries []LogEntry) []string {
+	msgs := make([]string, len(entries))
+	for i, e := range entries {
+		msgs[i] = e.Message
+	}
+	return msgs
+}
+
+func TestLogBroadcasterFilters(t *testing.T) {
+	b := newLogBroadcaster()
+	warn := b.subscribe(slog.LevelWarn, "", 0)
+	// Подстрока ищется без учёта регистра и в атрибутах
+	host := b.subscribe(slog.LevelDebug, "Example.COM", 0)
+	if !b.wants(slog.LevelDebug) {
+		t.Error("debug entries not wanted by a debug subscriber")
+	}
+
+	b.publish(logEntry(slog.LevelDebug, "Dialing", map[string]any{"target": "example.com:443"}))
+	b.publish(logEntry(slog.LevelInfo, "Connected", map[string]any{"target": "other.org:443"}))
+	b.publish(logEntry(slog.LevelWarn, "Dial failed", map[string]any{"target": "example.com:443"}))
+	b.publish(logEntry(slog.LevelError, "SSH lost", nil))
+
+	if got := messages(receiveEntries(warn)); fmt.Sprint(got) != "[Dial failed SSH lost]" {
+		t.Errorf("level filter: %v", got)
+	}
+	if got := messages(receiveEntries(host)); fmt.Sprint(got) != "[Dialing Dial failed]" {
+		t.Errorf("substring filter: %v", got)
+	}
+
+	// Без отладочных подписчиков отладочные записи не нужны
+	host.Close()
+	if b.wants(slog.LevelDebug) || !b.wants(slog.LevelInfo) {
+		t.Error("min level not updated after unsubscribe")
+	}
+}
+
+func TestLogBroadcasterReplay(t *testing.T) {
+	b := newLogBroadcaster()
+	for i := 0; i < logHistorySize+10; i++ {
+		level := slog.LevelInfo
+		if i%2 == 1 {
+			level = slog.LevelWarn
+		}
+		b.publish(logEntry(level, fmt.Sprint(i), nil))
+	}
+
+	// Последние подходящие строки в хронологическом порядке
+	got := messages(receiveEntries(b.subscribe(slog.LevelWarn, "", 3)))
+	if fmt.Sprint(got) != "[505 507 509]" {
+		t.Errorf("replay: %v", got)
+	}
+	if got := receiveEntries(b.subscribe(slog.LevelInfo, "", 0)); len(got) != 0 {
+		t.Errorf("replay 0: %d entries", len(got))
+	}
+
+	// Повтор не больше буфера подписчика и истории
+	got = messages(receiveEntries(b.subscribe(slog.LevelInfo, "", logHistorySize*2)))
+	if len(got) != logSubscriberBuffer || got[len(got)-1] != fmt.Sprint(logHistorySize+9) {
+		t.Errorf("replay capped at %d, last %v", len(got), got[len(got)-1:])
+	}
+}
+
+func TestLogBroadcasterDropped(t *testing.T) {
+	b := newLogBroadcaster()
+	slow := b.subscribe(slog.LevelInfo, "", 0)
+	for i := 0; i < logSubscriberBuffer+5; i++ {
+		b.publish(logEntry(slog.LevelInfo, fmt.Sprint(i), nil))
+	}
+
+	// Медленный подписчик получает начало, остальное считается
+	if dropped := slow.Dropped(); dropped != 5 {
+		t.Errorf("dropped %d, want 5", dropped)
+	}
+	if dropped := slow.Dropped(); dropped != 0 {
+		t.Errorf("counter not reset: %d", dropped)
+	}
+	got := receiveEntries(slow)
+	if len(got) != logSubscriberBuffer || got[0].Message != "0" {
+		t.Errorf("buffered %d entries starting with %v", len(got), messages(got[:1]))
+	}
+	b.publish(logEntry(slog.LevelInfo, "after", nil))
+	if got := messages(receiveEntries(slow)); fmt.Sprint(got) != "[after]" || slow.Dropped() != 0 {
+		t.Errorf("after draining: %v", got)
+	}
+}
+
+func TestLogBroadcasterClose(t *testing.T) {
+	b := newLogBroadcaster()
+	first := b.subscribe(slog.LevelInfo, "", 0)
+	second := b.subscribe(slog.LevelDebug, "", 0)
+	b.publish(logEntry(slog.LevelInfo, "last", nil))
+	b.close()
+
+	// Подписчики дочитывают буфер и видят закрытый канал
+	for _, s := range []*LogSubscription{first, second} {
+		if e, ok := <-s.C(); !ok || e.Message != "last" {
+			t.Errorf("buffered entry %v, %v", e, ok)
+		}
+		if _, ok := <-s.C(); ok {
+			t.Error("channel not closed")
+		}
+		// Повторное закрытие подписчиком не паникует
+		s.Close()
+	}
+	if b.wants(slog.LevelDebug) {
+		t.Error("min level not reset")
+	}
+
+	// Подписка после остановки сразу закрыта
+	if _, ok := <-b.subscribe(slog.LevelInfo, "", 10).C(); ok {
+		t.Error("subscription after close is open")
+	}
+	b.publish(logEntry(slog.LevelInfo, "ignored", nil))
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/crypto/ssh"
+)
+
+// Метрики отдаются на /metrics сервера администрирования в текстовом
+// формате Prometheus. Своя реализация вместо client_golang: метрик немного,
+// а библиотека заметно увеличила бы размер мобильной сборки.
+
+// Протоколы для ssh2socks5_connections_total
+const (
+	protoSOCKS5        = "socks5"
+	protoHTTP          = "http"
+	protoHTTPS         = "https"
+	protoLocalForward  = "local_forward"
+	protoRemoteForward = "remote_forward"
+	protoReverseSOCKS5 = "reverse_socks5"
+)
+
+// Результаты для ssh2socks5_connections_total
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+	resultTimeout = "timeout"
+	resultBlocked = "blocked"
+	resultLimit   = "limit"
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15}
+
+type metrics struct {
+	connections         *counterVec
+	dialDuration        *histogramVec
+	sshReconnects       *counterVec
+	keepaliveRTT        *histogramVec
+	channelOpenFailures *counterVec
+	dnsQueries          *counterVec
+	aclDenied           *counterVec
+
+	// Байты считаются на каждом Read/Write, поэтому без мьютекса
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		connections: newCounterVec("ssh2socks5_connections_total",
+			"Proxied connections by protocol and result.", "protocol", "result"),
+		dialDuration: newHistogramVec("ssh2socks5_dial_duration_seconds",
+			"Time to connect to the destination.", latencyBuckets, "route"),
+		sshReconnects: newCounterVec("ssh2socks5_ssh_reconnects_total",
+			"SSH reconnection attempts.", "result"),
+		keepaliveRTT: newHistogramVec("ssh2socks5_ssh_keepalive_rtt_seconds",
+			"Round trip time of SSH keepalive requests.", latencyBuckets),
+		channelOpenFailures: newCounterVec("ssh2socks5_ssh_channel_open_failures_total",
+			"Failed SSH channel opens by reason.", "reason"),
+		dnsQueries: newCounterVec("ssh2socks5_dns_queries_total",
+			"Local DNS lookups made by the SOCKS5 servers.", "result"),
+		aclDenied: newCounterVec("ssh2socks5_acl_denied_total",
+			"Client connections rejected by listener ACLs.", "listener"),
+	}
+}
+
+func (m *metrics) connection(protocol, result string) {
+	m.connections.inc(protocol, result)
+}
+
+func (m *metrics) observeDial(route string, start time.Time) {
+	m.dialDuration.observe(time.Since(start).Seconds(), route)
+}
+
+// channelOpenFailure учитывает ошибку client.Dial по причине отказа сервера.
+func (m *metrics) channelOpenFailure(err error) {
+	reason := "other"
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		switch openErr.Reason {
+		case ssh.Prohibited:
+			reason = "prohibited"
+		case ssh.ConnectionFailed:
+			reason = "connect_failed"
+		case ssh.UnknownChannelType:
+			reason = "unknown_channel_type"
+		case ssh.ResourceShortage:
+			reason = "resource_shortage"
+		}
+	} else if err == io.EOF || isClosedError(err) {
+		reason = "connection_lost"
+	}
+	m.channelOpenFailures.inc(reason)
+}
+
+func (p *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := p.metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	writeGauge(out, "ssh2socks5_active_connections", "Connections currently proxied.",
+		float64(p.conns.activeCount()))
+	m.connections.write(out)
+
+	fmt.Fprintf(out, "# HELP ssh2socks5_bytes_total Bytes transferred to and from destinations.\n")
+	fmt.Fprintf(out, "# TYPE ssh2socks5_bytes_total counter\n")
+	fmt.Fprintf(out, "ssh2socks5_bytes_total{direction=\"in\"} %d\n", m.bytesIn.Load())
+	fmt.Fprintf(out, "ssh2socks5_bytes_total{direction=\"out\"} %d\n", m.bytesOut.Load())
+
+	m.dialDuration.write(out)
+
+	p.clientLock.Lock()
+	connected := p.sshClient != nil
+	p.clientLock.Unlock()
+	writeGauge(out, "ssh2socks5_ssh_connected", "Whether the SSH connection is up.", boolValue(connected))
+	writeGauge(out, "ssh2socks5_ssh_clients", "Open SSH connections: the current one and retired ones still draining.",
+		float64(p.sshClientCount()))
+
+	m.sshReconnects.write(out)
+	m.keepaliveRTT.write(out)
+	m.channelOpenFailures.write(out)
+	m.dnsQueries.write(out)
+	m.aclDenied.write(out)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sendKeepalive проверяет SSH соединение и учитывает время ответа.
+func (p *ProxyServer) sendKeepalive(client *ssh.Client) error {
+	start := time.Now()
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	if err == nil {
+		p.metrics.keepaliveRTT.observe(time.Since(start).Seconds())
+	}
+	return err
+}
+
+// countingResolver - резолвер SOCKS5 сервера с подсчётом запросов.
+type countingResolver struct {
+	socks5.DNSResolver
+	metrics *metrics
+	// Запрещённые фильтром домены не резолвим: запрос отклонит socksRules,
+	// а имя не уйдёт в DNS
+	router func() *router
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if r.router != nil && r.router().filter.check(name, nil) != "" {
+		return ctx, nil, nil
+	}
+	ctx, ip, err := r.DNSResolver.Resolve(ctx, name)
+	if err != nil {
+		r.metrics.dnsQueries.inc(resultError)
+	} else {
+		r.metrics.dnsQueries.inc(resultSuccess)
+	}
+	return ctx, ip, err
+}
+
+// counterVec - счётчик с метками. Значения меток склеиваются в ключ.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.lock.Lock()
+	c.values[key]++
+	c.lock.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, key, ""), c.values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec - гистограмма с метками и фиксированными границами корзин.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf("le=\"%g\"", bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, le), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le=\"+Inf\""), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key, ""), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels собирает {name="value",...} из имён меток и ключа значений.
+func formatLabels(names []string, key, extra string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMetricsSSHClients(t *testing.T) {
+	p := newBenchServer()
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		p.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	if out := scrape(); !strings.Contains(out, "\nssh2socks5_ssh_clients 0\n") {
+		t.Fatalf("without SSH:\n%s", out)
+	}
+
+	// Текущий клиент и старый, который ещё обслуживает соединения
+	p.sshClient = &ssh.Client{}
+	p.retiredClients = map[*ssh.Client]bool{{}: true}
+	out := scrape()
+	if !strings.Contains(out, "\nssh2socks5_ssh_clients 2\n") || !strings.Contains(out, "\nssh2socks5_ssh_connected 1\n") {
+		t.Errorf("with clients:\n%s", out)
+	}
+}
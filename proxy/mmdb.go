@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Чтение баз MaxMind DB (GeoLite2-Country, GeoIP2-Country и совместимых).
+// Формат: https://maxmind.github.io/MaxMind-DB/. Файл целиком читается в
+// память; из записей нужен только код страны, он кэшируется по смещению.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errInvalidMMDB = errors.New("invalid MaxMind DB file")
+
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+
+	lock      sync.Mutex
+	countries map[uint]string
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: %v: metadata not found", path, errInvalidMMDB)
+	}
+	meta := mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}
+	value, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	metadata, _ := value.(map[string]interface{})
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+
+	switch recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: %v: unsupported record size %d", path, errInvalidMMDB, recordSize)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if nodeCount == 0 || treeSize+16 > uint64(i) {
+		return nil, fmt.Errorf("%s: %v: bad search tree size", path, errInvalidMMDB)
+	}
+
+	r := &mmdbReader{
+		tree:       buf[:treeSize],
+		data:       mmdbDecoder{buf: buf[treeSize+16 : i]},
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+		countries:  make(map[uint]string),
+	}
+	// IPv4 адреса в IPv6 дереве лежат под ::/96
+	if r.ipVersion == 6 {
+		for bit := 0; bit < 96 && r.ipv4Start < r.nodeCount; bit++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record возвращает левую (bit 0) или правую (bit 1) запись узла.
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b := r.tree[node*8+bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// lookup возвращает смещение записи в секции данных.
+func (r *mmdbReader) lookup(ip net.IP) (uint, bool) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return 0, false
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return 0, false
+	}
+	return node - r.nodeCount - 16, true
+}
+
+// country возвращает код страны адреса в нижнем регистре ("ru") или
+// пустую строку, если адреса нет в базе.
+func (r *mmdbReader) country(ip net.IP) string {
+	offset, ok := r.lookup(ip)
+	if !ok {
+		return ""
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if code, ok := r.countries[offset]; ok {
+		return code
+	}
+	var code string
+	if value, _, err := r.data.decode(int(offset)); err == nil {
+		record, _ := value.(map[string]interface{})
+		for _, key := range []string{"country", "registered_country"} {
+			c, _ := record[key].(map[string]interface{})
+			if iso, ok := c["iso_code"].(string); ok && iso != "" {
+				code = strings.ToLower(iso)
+				break
+			}
+		}
+	}
+	r.countries[offset] = code
+	return code
+}
+
+// mmdbDecoder разбирает значения секции данных. Смещения - от начала buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// Типы значений MaxMind DB
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+func (d *mmdbDecoder) bytes(offset, n int) ([]byte, error) {
+	if offset < 0 || n < 0 || offset+n > len(d.buf) {
+		return nil, errInvalidMMDB
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// Предельная вложенность значений: в испорченном файле карта может через
+// указатель ссылаться сама на себя
+const mmdbMaxDepth = 32
+
+func (d *mmdbDecoder) decode(offset int) (interface{}, int, error) {
+	return d.decodeValue(offset, 0)
+}
+
+func (d *mmdbDecoder) decodeValue(offset, depth int) (interface{}, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("%v: data nested too deep", errInvalidMMDB)
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := int(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		n := int(ctrl>>3&3) + 1
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr int
+		if n < 4 {
+			ptr = int(ctrl & 7)
+		}
+		for _, c := range b {
+			ptr = ptr<<8 | int(c)
+		}
+		ptr += [...]int{0, 2048, 526336, 0}[n-1]
+		// Указатель на указатель формат запрещает
+		target, err := d.bytes(ptr, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if int(target[0]>>5) == mmdbPointer {
+			return nil, 0, fmt.Errorf("%v: pointer to a pointer", errInvalidMMDB)
+		}
+		value, _, err := d.decodeValue(ptr, depth+1)
+		return value, offset + n, err
+	}
+
+	if typ == mmdbExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(b[0])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		extra := 0
+		for _, c := range b {
+			extra = extra<<8 | int(c)
+		}
+		size = [...]int{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	// Каждый элемент занимает хотя бы байт, так что размер больше остатка
+	// файла - ошибка, а не повод выделять память
+	if (typ == mmdbMap || typ == mmdbArray) && size > len(d.buf)-offset {
+		return nil, 0, errInvalidMMDB
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decodeValue(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errInvalidMMDB
+			}
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return b, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errInvalidMMDB
+		}
+		return math.Float64frombits(beUint(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errInvalidMMDB
+		}
+		return float64(math.Float32frombits(uint32(beUint(b)))), offset, nil
+	case mmdbInt32:
+		v := int32(beUint(b))
+		if size < 4 && size > 0 && b[0]&0x80 != 0 {
+			v -= 1 << (8 * size)
+		}
+		return int64(v), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		return beUint(b), offset, nil
+	case mmdbUint128:
+		// Старшие байты отбрасываем: в нужных нам полях их нет
+		if len(b) > 8 {
+			b = b[len(b)-8:]
+		}
+		return beUint(b), offset, nil
+	}
+	return nil, 0, fmt.Errorf("%v: unknown data type %d", errInvalidMMDB, typ)
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
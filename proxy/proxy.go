@@ -3,9 +3,10 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -21,70 +22,113 @@ import (
 type ProxyServer struct {
 	sshClient         *ssh.Client
 	sshConfig         *ssh.ClientConfig
+	sshDialer         sshDialer
 	socksServer       *socks5.Server
 	httpServer        *http.Server
 	listener          net.Listener
 	httpListener      net.Listener
 	config            *ProxyConfig
-	activeConnections int32
 	ctx               context.Context
 	cancel            context.CancelFunc
 	clientLock        sync.Mutex
 	proxyType         string
 	wg                sync.WaitGroup
 	shutdownComplete  chan struct{}
-	// logChan           chan string
 	logListener       net.Listener
 	logServer         *http.Server
 	connectionPool    chan *ssh.Client
-	maxConnections    int32
   sshPool        *sync.Pool
   maxSSHClients  int32
   currentClients int32
+	forwardsLock      sync.Mutex
+	localForwards     map[string]*localForward
+	remoteForwards    map[string]*remoteForward
+	router            *router
+	configLock        sync.RWMutex
+	reloadLock        sync.Mutex
+	configLoader      func() (*ProxyConfig, error)
+	usersLock         sync.Mutex
+	clientUsers       map[*ssh.Client]int
+	retiredClients    map[*ssh.Client]bool
+	conns             *connRegistry
+	limiter           *rateLimiter
+	proxyACL          *listenerACL
+	adminACL          *listenerACL
+	handshakes        sync.Map // адрес клиента -> *handshakeConn
+	metrics           *metrics
+	logs              *logBroadcaster
+	logLock           sync.RWMutex
+	logger            *slog.Logger
+	logFile           *rotatingFile
+	startedAt         time.Time
+	sshErrLock        sync.Mutex
+	lastSSHError      string
+	lastSSHErrorAt    time.Time
+	reconnects        atomic.Int64
+	supervisor        *sshSupervisor
 }
 
 type ProxyConfig struct {
-	SSHHost     string
-	SSHPort     string
-	SSHUser     string
-	SSHPassword string
-	KeyPath     string
-	LocalPort   string
-	LogPath     string
-	ProxyType   string
-}
-
-type trackedConn struct {
-	net.Conn
-	onClose func()
-}
-
-func (c *trackedConn) Close() error {
-	err := c.Conn.Close()
-	if c.onClose != nil {
-		c.onClose()
-	}
-	return err
-}
-
-type timeoutConn struct {
-	net.Conn
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-}
-
-func (c *timeoutConn) Read(b []byte) (n int, err error) {
-	if c.readTimeout > 0 {
-		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
-	}
-	return c.Conn.Read(b)
-}
-
-func (c *timeoutConn) Write(b []byte) (n int, err error) {
-	if c.writeTimeout > 0 {
-		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
-	}
-	return c.Conn.Write(b)
+	SSHHost     string `json:"ssh_host"`
+	SSHPort     string `json:"ssh_port"`
+	SSHUser     string `json:"ssh_user"`
+	SSHPassword string `json:"ssh_password,omitempty"`
+	KeyPath     string `json:"key_path,omitempty"`
+	// Источники секретов (env:, file:, cmd:, stdin) - см. secrets.go
+	SSHPasswordFrom   string `json:"ssh_password_from,omitempty"`
+	KeyPassphraseFrom string `json:"key_passphrase_from,omitempty"`
+	// Транспорт до SSH сервера: TLS, WebSocket, прокси
+	SSHTransport SSHTransport `json:"ssh_transport"`
+	// Предпочтения шифров, обмена ключами, MAC и ключей хоста
+	SSHAlgorithms SSHAlgorithms `json:"ssh_algorithms"`
+	// Колбэки для секретов из приложения (например, Android Keystore)
+	PasswordCallback   func() (string, error) `json:"-"`
+	PassphraseCallback func() (string, error) `json:"-"`
+	LocalPort   string `json:"local_port"`
+	LogPath     string `json:"log_path,omitempty"`
+	// debug, info, warn или error
+	LogLevel string `json:"log_level,omitempty"`
+	// text или json
+	LogFormat string `json:"log_format,omitempty"`
+	// Ротация LogPath: по размеру (МБ) и/или по времени; хранение старых файлов
+	LogMaxSize     int      `json:"log_max_size,omitempty"`
+	LogRotateEvery Duration `json:"log_rotate_every,omitempty"`
+	LogMaxBackups  int      `json:"log_max_backups,omitempty"`
+	LogMaxAge      Duration `json:"log_max_age,omitempty"`
+	ProxyType   string `json:"proxy_type"`
+	// Статические пробросы портов (-L), работают поверх того же SSH клиента
+	LocalForwards []ForwardConfig `json:"local_forwards,omitempty"`
+	// Удалённые пробросы (-R), переоткрываются после переподключения SSH
+	RemoteForwards []ForwardConfig `json:"remote_forwards,omitempty"`
+	// SOCKS5 серверы на стороне SSH сервера (-R без назначения)
+	ReverseDynamic []ReverseDynamicConfig `json:"reverse_dynamic,omitempty"`
+	// Правила маршрутизации, применяются по порядку
+	Rules []RouteRule `json:"rules,omitempty"`
+	// Базы для правил geoip: (MaxMind MMDB) и geosite: (geosite.dat v2ray)
+	GeoIPPath   string `json:"geoip_path,omitempty"`
+	GeoSitePath string `json:"geosite_path,omitempty"`
+	// Запрещённые и разрешённые назначения, проверяются до правил
+	DestinationFilter DestinationFilter `json:"destination_filter"`
+	// Таймауты соединений; пробросы и правила могут их переопределить
+	Timeouts Timeouts `json:"timeouts"`
+	// Сколько ждать завершения активных соединений при Shutdown
+	DrainTimeout Duration `json:"drain_timeout,omitempty"`
+	// Пользователи прокси; если заданы, SOCKS5 и HTTP требуют авторизацию
+	ProxyUsers []ProxyUser `json:"proxy_users,omitempty"`
+	// Переподключение к SSH серверу после обрыва
+	Reconnect ReconnectConfig `json:"reconnect"`
+	// Ограничения числа одновременных соединений
+	ConnectionLimits ConnectionLimits `json:"connection_limits"`
+	// Ограничения скорости, меняются на лету через PUT /limits
+	RateLimits RateLimits `json:"rate_limits"`
+	// Списки доступа клиентов основного прокси и сервера администрирования
+	ClientACL *ClientACL `json:"client_acl,omitempty"`
+	AdminACL  *ClientACL `json:"admin_acl,omitempty"`
+	// Сервер администрирования (/status, /metrics, /logs...), пусто - выключен
+	AdminAddr string `json:"admin_addr,omitempty"`
+	// Если задан, запросы к серверу администрирования требуют
+	// заголовок "Authorization: Bearer <admin_token>"
+	AdminToken string `json:"admin_token,omitempty"`
 }
 
 // Фильтрованный логгер для socks5
@@ -96,17 +140,46 @@ func (l *filteredLogger) Printf(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
 	// Не логируем обычные сетевые ошибки
 	if !isNormalNetworkError(msg) {
-		l.proxy.logMessage("SOCKS5: " + msg)
+		l.proxy.logWarn("SOCKS5: " + msg)
 	}
 }
 
 func NewProxyServer(config *ProxyConfig) (*ProxyServer, error) {
+    router, err := newRouter(config)
+    if err != nil {
+        return nil, err
+    }
+
+    proxyACL, err := newListenerACL("proxy", config.ClientACL)
+    if err != nil {
+        return nil, fmt.Errorf("client_acl: %v", err)
+    }
+    adminACL, err := newListenerACL("admin", config.AdminACL)
+    if err != nil {
+        return nil, fmt.Errorf("admin_acl: %v", err)
+    }
+
+    logs := newLogBroadcaster()
+    logger, logFile, err := newLogger(config, logs)
+    if err != nil {
+        return nil, err
+    }
+
     p := &ProxyServer{
+        router:           router,
         config:           config,
         proxyType:        config.ProxyType,
         shutdownComplete: make(chan struct{}),
         maxSSHClients:    5, // Ограничение
-        maxConnections:   100,
+        metrics:          newMetrics(),
+        conns:            newConnRegistry(),
+        limiter:          newRateLimiter(config.RateLimits),
+        proxyACL:         proxyACL,
+        adminACL:         adminACL,
+        logs:             logs,
+        logger:           logger,
+        logFile:          logFile,
+        supervisor:       newSSHSupervisor(),
     }
 
     // Используем sync.Pool для переиспользования соединений
@@ -125,37 +198,27 @@ func NewProxyServer(config *ProxyConfig) (*ProxyServer, error) {
 }
 
 func (p *ProxyServer) Start() error {
-	if err := p.setupLogging("0.0.0.0:1792"); err != nil {
-		return err
-	}
-
-	var authMethods []ssh.AuthMethod
-	if p.config.SSHPassword != "" {
-		authMethods = append(authMethods, ssh.Password(p.config.SSHPassword))
-	}
-	if p.config.KeyPath != "" {
-		key, err := os.ReadFile(p.config.KeyPath)
-		if err != nil {
-			return err
-		}
-		signer, err := ssh.ParsePrivateKey(key)
-		if err != nil {
+	p.startedAt = time.Now()
+	if p.config.AdminAddr != "" {
+		if err := p.setupAdminServer(p.config.AdminAddr); err != nil {
 			return err
 		}
-		authMethods = append(authMethods, ssh.PublicKeys(signer))
 	}
 
-	sshConfig := &ssh.ClientConfig{
-		User:            p.config.SSHUser,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
+	sshConfig, err := newSSHClientConfig(p.config)
+	if err != nil {
+		return err
+	}
+
+	dialer, err := newSSHDialer(p.config)
+	if err != nil {
+		return err
 	}
 
 	p.sshConfig = sshConfig
-	sshAddress := p.config.SSHHost + ":" + p.config.SSHPort
+	p.sshDialer = dialer
 
-	client, err := ssh.Dial("tcp", sshAddress, sshConfig)
+	client, err := p.dialSSH()
 	if err != nil {
 		return err
 	}
@@ -171,14 +234,144 @@ func (p *ProxyServer) Start() error {
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
-		p.monitorSSHConnection()
+		p.watchACLFiles()
 	}()
 
-	listenAddr := "0.0.0.0:" + p.config.LocalPort
-	if p.proxyType == "http" {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.superviseSSH()
+	}()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.watchNetwork()
+	}()
+
+	if err := p.startLocalForwards(); err != nil {
+		return err
+	}
+
+	if err := p.startRemoteForwards(); err != nil {
+		return err
+	}
+
+	if err := p.startReverseDynamic(); err != nil {
+		return err
+	}
+
+	return p.startMainListener(p.config)
+}
+
+func (p *ProxyServer) startMainListener(config *ProxyConfig) error {
+	listenAddr := "0.0.0.0:" + config.LocalPort
+	if config.ProxyType == "http" {
 		return p.startHTTPProxy(listenAddr)
 	}
-	return p.startSocksProxy(listenAddr)
+	return p.startSocksProxy(listenAddr, config)
+}
+
+// stopMainListener закрывает основной слушатель, не трогая
+// уже установленные соединения.
+func (p *ProxyServer) stopMainListener() {
+	if p.listener != nil {
+		p.listener.Close()
+		p.listener = nil
+	}
+	if p.httpListener != nil {
+		p.httpListener.Close()
+		p.httpListener = nil
+	}
+	if p.httpServer != nil {
+		server := p.httpServer
+		p.httpServer = nil
+		go server.Shutdown(context.Background())
+	}
+}
+
+// newSSHClientConfig собирает параметры SSH клиента (аутентификация,
+// проверка ключа хоста) из ProxyConfig.
+func newSSHClientConfig(config *ProxyConfig) (*ssh.ClientConfig, error) {
+	var authMethods []ssh.AuthMethod
+	if config.KeyPath != "" {
+		// Ключ и пароль к нему читаются при каждом подключении
+		authMethods = append(authMethods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			signer, err := loadPrivateKey(config)
+			if err != nil {
+				return nil, err
+			}
+			return []ssh.Signer{signer}, nil
+		}))
+	}
+	if password := passwordSource(config); password != nil {
+		authMethods = append(authMethods, ssh.PasswordCallback(password))
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            config.SSHUser,
+		Auth:            authMethods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
+	}
+	config.SSHAlgorithms.apply(sshConfig)
+	return sshConfig, nil
+}
+
+func passwordSource(config *ProxyConfig) func() (string, error) {
+	switch {
+	case config.PasswordCallback != nil:
+		return config.PasswordCallback
+	case config.SSHPasswordFrom != "":
+		return func() (string, error) {
+			return resolveSecret(config.SSHPasswordFrom)
+		}
+	case config.SSHPassword != "":
+		return func() (string, error) {
+			return config.SSHPassword, nil
+		}
+	}
+	return nil
+}
+
+func loadPrivateKey(config *ProxyConfig) (ssh.Signer, error) {
+	key, err := os.ReadFile(config.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+
+	var passphrase string
+	switch {
+	case config.PassphraseCallback != nil:
+		passphrase, err = config.PassphraseCallback()
+	case config.KeyPassphraseFrom != "":
+		passphrase, err = resolveSecret(config.KeyPassphraseFrom)
+	default:
+		return nil, fmt.Errorf("%s is encrypted, key_passphrase_from is required", config.KeyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+}
+
+// DialSSH устанавливает SSH соединение с теми же параметрами, что и Start,
+// но без запуска прокси. Используется режимом stdio.
+func DialSSH(config *ProxyConfig) (*ssh.Client, error) {
+	sshConfig, err := newSSHClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := newSSHDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return dialSSHWith(dialer, config.SSHHost+":"+config.SSHPort, sshConfig)
 }
 
 func (p *ProxyServer) maintainConnectionPool() {
@@ -193,7 +386,7 @@ func (p *ProxyServer) maintainConnectionPool() {
 			for len(p.connectionPool) < 2 {
 				client, err := p.createNewSSHClient()
 				if err != nil {
-					p.logMessage(fmt.Sprintf("Failed to maintain connection pool: %v", err))
+					p.logWarn(fmt.Sprintf("Failed to maintain connection pool: %v", err))
 					break
 				}
 				select {
@@ -208,91 +401,78 @@ func (p *ProxyServer) maintainConnectionPool() {
 }
 
 func (p *ProxyServer) createNewSSHClient() (*ssh.Client, error) {
-	sshAddress := p.config.SSHHost + ":" + p.config.SSHPort
-	return ssh.Dial("tcp", sshAddress, p.sshConfig)
+	return p.dialSSH()
 }
 
-func (p *ProxyServer) startSocksProxy(listenAddr string) error {
+func (p *ProxyServer) startSocksProxy(listenAddr string, config *ProxyConfig) error {
 	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		if atomic.LoadInt32(&p.activeConnections) >= p.maxConnections {
-			p.logMessage(fmt.Sprintf("Connection limit reached (%d/%d)", atomic.LoadInt32(&p.activeConnections), p.maxConnections))
-			return nil, fmt.Errorf("connection limit reached")
-		}
-
-		p.logMessage(fmt.Sprintf("SOCKS5: New connection request to %s://%s", network, addr))
-
-		atomic.AddInt32(&p.activeConnections, 1)
-		client, err := p.getConnectedSSHClient(ctx)
+		tc, err := p.socksConn(ctx, protoSOCKS5, addr)
 		if err != nil {
-			atomic.AddInt32(&p.activeConnections, -1)
-			p.logMessage(fmt.Sprintf("SOCKS5: Failed to get SSH client: %v", err))
 			return nil, err
 		}
 
-		p.logMessage(fmt.Sprintf("SOCKS5: Got SSH client, dialing %s://%s", network, addr))
+		decision, ok := routeFromContext(ctx)
+		if !ok {
+			decision = p.currentRouter().routeAddr(addr)
+		}
+		tc.setRoute(decision)
+		// Рукопожатие закончено: дальше действуют таймауты туннеля,
+		// которые закрывают и соединение клиента
+		if client := p.takeHandshakeConn(clientAddrFromContext(ctx)); client != nil {
+			tc.setPeer(client)
+		}
+		logger := tc.logger()
+		logger.Debug("Dialing")
 
-		dialCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		dialCtx, cancel := withDialTimeout(ctx, tc.timeouts().dial)
 		defer cancel()
 
-		type dialResult struct {
-			conn net.Conn
-			err  error
+		var conn net.Conn
+		if decision.Action == RouteDirect {
+			conn, err = p.dialDirect(dialCtx, network, addr)
+		} else {
+			conn, err = p.dialTunnel(dialCtx, network, addr)
 		}
-		dialChan := make(chan dialResult, 1)
-
-		go func() {
-			conn, err := client.Dial(network, addr)
-			dialChan <- dialResult{conn, err}
-		}()
-
-		select {
-		case <-dialCtx.Done():
-			atomic.AddInt32(&p.activeConnections, -1)
-			p.logMessage(fmt.Sprintf("SOCKS5: Dial timeout to %s://%s", network, addr))
-			return nil, fmt.Errorf("dial timeout to %s:%s", network, addr)
-		case result := <-dialChan:
-			if result.err != nil {
-				atomic.AddInt32(&p.activeConnections, -1)
-				p.logMessage(fmt.Sprintf("SOCKS5: Failed to dial target %s://%s: %v", network, addr, result.err))
-				return nil, result.err
-			}
-
-			p.logMessage(fmt.Sprintf("SOCKS5: Successfully established connection to %s://%s", network, addr))
-
-			wrappedConn := &timeoutConn{
-				Conn:         result.conn,
-				readTimeout:  60 * time.Second,
-				writeTimeout: 30 * time.Second,
+		if err != nil {
+			if dialCtx.Err() != nil {
+				logger.Warn("Dial timeout")
+			} else {
+				logger.Warn("Dial failed", "err", err)
 			}
+			tc.fail(err)
+			return nil, err
+		}
 
-			return &trackedConn{
-				Conn: wrappedConn,
-				onClose: func() {
-					atomic.AddInt32(&p.activeConnections, -1)
-					p.logMessage(fmt.Sprintf("SOCKS5: Closed connection to %s://%s (active: %d)", network, addr, atomic.LoadInt32(&p.activeConnections)))
-				},
-			}, nil
+		// Копирует и закрывает соединения сам SOCKS5 сервер; половинное
+		// закрытие он передаёт через tc.CloseWrite
+		if err := tc.attach(conn); err != nil {
+			return nil, err
 		}
+		return tc, nil
 	}
 
 	// Создаём конфигурацию SOCKS5 с диалером
 	socksConfig := &socks5.Config{
-		Dial: dialer,
+		Dial:        dialer,
+		AuthMethods: p.socksAuthMethods(config),
+		Rules:       &socksRules{router: p.currentRouter, open: p.openConn, metrics: p.metrics, protocol: protoSOCKS5},
+		Resolver:    &countingResolver{metrics: p.metrics, router: p.currentRouter},
 		// Убираем Logger чтобы избежать дублирования логов
 	}
 
 	socksServer, err := socks5.New(socksConfig)
 	if err != nil {
-		p.logMessage(fmt.Sprintf("Failed to create SOCKS5 server: %v", err))
+		p.logError(fmt.Sprintf("Failed to create SOCKS5 server: %v", err))
 		return err
 	}
 
 	p.socksServer = socksServer
 	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		p.logMessage(fmt.Sprintf("Failed to start listener on %s: %v", listenAddr, err))
+		p.logError(fmt.Sprintf("Failed to start listener on %s: %v", listenAddr, err))
 		return err
 	}
+	listener = &handshakeListener{Listener: p.withACL(listener, p.proxyACL), p: p}
 
 	p.listener = listener
 	p.wg.Add(1)
@@ -300,7 +480,7 @@ func (p *ProxyServer) startSocksProxy(listenAddr string) error {
 		defer p.wg.Done()
 		p.logMessage(fmt.Sprintf("SOCKS5 proxy listening on %s", listenAddr))
 		if err := p.socksServer.Serve(listener); err != nil && !isClosedError(err) {
-			p.logMessage(fmt.Sprintf("SOCKS5 server error: %v", err))
+			p.logError(fmt.Sprintf("SOCKS5 server error: %v", err))
 		}
 	}()
 
@@ -315,7 +495,7 @@ type filteredLogWriter struct {
 func (w *filteredLogWriter) Write(p []byte) (n int, err error) {
 	msg := strings.TrimSpace(string(p))
 	if !isNormalNetworkError(msg) {
-		w.proxy.logMessage("SOCKS5: " + msg)
+		w.proxy.logWarn("SOCKS5: " + msg)
 	}
 	return len(p), nil
 }
@@ -325,19 +505,23 @@ func (p *ProxyServer) startHTTPProxy(listenAddr string) error {
 	if err != nil {
 		return err
 	}
+	listener = p.withACL(listener, p.proxyACL)
 	p.httpListener = listener
+	timeouts := resolveTimeouts(&p.currentConfig().Timeouts)
 
 	server := &http.Server{
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Handler: p.requireProxyAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.Method == http.MethodConnect {
 				p.handleHTTPSConnection(w, r)
 			} else {
 				p.handleHTTPConnection(w, r)
 			}
-		}),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		})),
+		// Только заголовки и простой между запросами: ReadTimeout и
+		// WriteTimeout оборвали бы долгие ответы, а для туннелей CONNECT
+		// после Hijack действуют таймауты соединения
+		ReadHeaderTimeout: timeouts.handshake,
+		IdleTimeout:       timeouts.idle,
 	}
 	p.httpServer = server
 
@@ -345,7 +529,7 @@ func (p *ProxyServer) startHTTPProxy(listenAddr string) error {
 	go func() {
 		defer p.wg.Done()
 		if err := server.Serve(listener); err != nil && !isClosedError(err) {
-			p.logMessage(fmt.Sprintf("HTTP proxy server error: %v", err))
+			p.logError(fmt.Sprintf("HTTP proxy server error: %v", err))
 		}
 	}()
 
@@ -354,60 +538,54 @@ func (p *ProxyServer) startHTTPProxy(listenAddr string) error {
 }
 
 func (p *ProxyServer) handleHTTPConnection(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt32(&p.activeConnections) >= p.maxConnections {
-		http.Error(w, "Connection limit reached", http.StatusServiceUnavailable)
-		return
-	}
-
-	p.logMessage(fmt.Sprintf("Handling HTTP connection to: %s", r.Host))
-
-	client, err := p.getConnectedSSHClient(r.Context())
-	if err != nil {
-		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to get SSH client for HTTP connection: %v", err))
-		}
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-
 	targetHost := r.Host
 	if r.URL.Port() == "" {
 		targetHost = targetHost + ":80"
 	}
 
-	atomic.AddInt32(&p.activeConnections, 1)
-	defer atomic.AddInt32(&p.activeConnections, -1)
+	tc, err := p.openConn(r.Context(), protoHTTP, r.RemoteAddr, clientUserFromContext(r.Context()), targetHost)
+	if err != nil {
+		httpLimitError(w, err)
+		return
+	}
+	logger := tc.logger()
+	logger.Debug("Handling HTTP request", "method", r.Method, "url", r.URL.String())
 
-	conn, err := client.Dial("tcp", targetHost)
+	conn, decision, err := p.dialRoute(r.Context(), targetHost)
+	tc.setRoute(decision)
 	if err != nil {
+		tc.fail(err)
+		if err == errBlockedByRule {
+			logger.Info("Blocked by rule", "rule", decision.Rule)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to dial target host %s: %v", targetHost, err))
+			logger.Warn("Dial failed", "err", err)
 		}
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-	defer conn.Close()
-
-	// Добавляем таймауты
-	timeoutConn := &timeoutConn{
-		Conn:         conn,
-		readTimeout:  30 * time.Second,
-		writeTimeout: 30 * time.Second,
+	if err := tc.attach(conn); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
+	defer tc.Close()
+	logger = tc.logger()
 
 	r.RequestURI = ""
-	if err := r.Write(timeoutConn); err != nil {
+	if err := r.Write(tc); err != nil {
 		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to write request to target: %v", err))
+			logger.Warn("Failed to write request to target", "err", err)
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(timeoutConn), r)
+	resp, err := http.ReadResponse(bufio.NewReader(tc), r)
 	if err != nil {
 		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to read response from target: %v", err))
+			logger.Warn("Failed to read response from target", "err", err)
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -421,146 +599,161 @@ func (p *ProxyServer) handleHTTPConnection(w http.ResponseWriter, r *http.Reques
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	copied, err := io.Copy(w, resp.Body)
-	if err != nil && !isNetworkError(err) {
-		p.logMessage(fmt.Sprintf("Error copying response body: %v", err))
-	} else {
-		p.logMessage(fmt.Sprintf("Successfully proxied HTTP connection to %s, copied %d bytes", targetHost, copied))
+	if _, err := io.Copy(w, resp.Body); err != nil && !isNetworkError(err) {
+		logger.Warn("Error copying response body", "err", err)
 	}
 }
 
 func (p *ProxyServer) handleHTTPSConnection(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt32(&p.activeConnections) >= p.maxConnections {
-		http.Error(w, "Connection limit reached", http.StatusServiceUnavailable)
-		return
-	}
-
-	p.logMessage(fmt.Sprintf("Handling HTTPS connection to: %s", r.Host))
-
-	client, err := p.getConnectedSSHClient(r.Context())
-	if err != nil {
-		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to get SSH client for HTTPS connection: %v", err))
-		}
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
-
 	targetHost := r.Host
 	if r.URL.Port() == "" {
 		targetHost = targetHost + ":443"
 	}
 
-	atomic.AddInt32(&p.activeConnections, 1)
+	tc, err := p.openConn(r.Context(), protoHTTPS, r.RemoteAddr, clientUserFromContext(r.Context()), targetHost)
+	if err != nil {
+		httpLimitError(w, err)
+		return
+	}
+	logger := tc.logger()
+	logger.Debug("Handling CONNECT")
 
-	targetConn, err := client.Dial("tcp", targetHost)
+	targetConn, decision, err := p.dialRoute(r.Context(), targetHost)
+	tc.setRoute(decision)
 	if err != nil {
-		atomic.AddInt32(&p.activeConnections, -1)
+		tc.fail(err)
+		if err == errBlockedByRule {
+			logger.Info("Blocked by rule", "rule", decision.Rule)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to dial target host %s: %v", targetHost, err))
+			logger.Warn("Dial failed", "err", err)
 		}
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	if err := tc.attach(targetConn); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	logger = tc.logger()
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		atomic.AddInt32(&p.activeConnections, -1)
-		targetConn.Close()
-		p.logMessage("Failed to hijack connection: hijacking not supported")
+		tc.Close()
+		logger.Warn("Failed to hijack connection: hijacking not supported")
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
 
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, buffered, err := hijacker.Hijack()
 	if err != nil {
-		atomic.AddInt32(&p.activeConnections, -1)
-		targetConn.Close()
+		tc.Close()
 		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to hijack connection: %v", err))
+			logger.Warn("Failed to hijack connection", "err", err)
 		}
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	if buffered.Reader.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: clientConn, r: buffered.Reader}
+	}
 
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-	p.logMessage(fmt.Sprintf("HTTPS tunnel established to %s", targetHost))
-
-	// Добавляем таймауты для туннеля
-	clientTimeout := &timeoutConn{
-		Conn:         clientConn,
-		readTimeout:  60 * time.Second,
-		writeTimeout: 30 * time.Second,
-	}
-	targetTimeout := &timeoutConn{
-		Conn:         targetConn,
-		readTimeout:  60 * time.Second,
-		writeTimeout: 30 * time.Second,
-	}
+	logger.Debug("Tunnel established")
 
-	p.wg.Add(2)
-	go func() {
-		defer p.wg.Done()
-		defer atomic.AddInt32(&p.activeConnections, -1)
-		defer clientTimeout.Close()
-		defer targetTimeout.Close()
-		copied, err := io.Copy(targetTimeout, clientTimeout)
-		if err != nil && !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Error in client->target tunnel: %v", err))
-		} else {
-			p.logMessage(fmt.Sprintf("Client->target tunnel closed, copied %d bytes", copied))
-		}
-	}()
+	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
-		defer clientTimeout.Close()
-		defer targetTimeout.Close()
-		copied, err := io.Copy(clientTimeout, targetTimeout)
-		if err != nil && !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Error in target->client tunnel: %v", err))
-		} else {
-			p.logMessage(fmt.Sprintf("Target->client tunnel closed, copied %d bytes", copied))
+		if err := splice(clientConn, tc); err != nil && !isNetworkError(err) {
+			logger.Warn("Tunnel error", "err", err)
 		}
 	}()
 }
 
+var errBlockedByRule = errors.New("not allowed by ruleset")
+
+// httpLimitError отвечает на превышение лимита соединений: 429, если
+// превышен лимит клиента или пользователя, иначе 503.
+func httpLimitError(w http.ResponseWriter, err error) {
+	status := http.StatusServiceUnavailable
+	if le, ok := err.(*limitError); ok && (le.scope == "client" || le.scope == "user") {
+		status = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// dialRoute устанавливает соединение с addr согласно правилам маршрутизации.
+func (p *ProxyServer) dialRoute(ctx context.Context, addr string) (net.Conn, routeDecision, error) {
+	decision := p.currentRouter().routeAddr(addr)
+	ctx, cancel := withDialTimeout(ctx, resolveTimeouts(&p.currentConfig().Timeouts, decision.timeouts).dial)
+	defer cancel()
+	addr = decision.dialAddr(addr)
+	var conn net.Conn
+	var err error
+	switch decision.Action {
+	case RouteBlock:
+		err = errBlockedByRule
+	case RouteDirect:
+		conn, err = p.dialDirect(ctx, "tcp", addr)
+	default:
+		conn, err = p.dialTunnel(ctx, "tcp", addr)
+	}
+	return conn, decision, err
+}
+
+// dialDirect подключается к addr с этой машины, минуя SSH.
+func (p *ProxyServer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	defer p.metrics.observeDial(RouteDirect, time.Now())
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// dialResult - результат неудачного подключения для метрик.
+func dialResult(err error) string {
+	switch {
+	case err == errBlockedByRule:
+		return resultBlocked
+	case errors.Is(err, context.DeadlineExceeded), strings.Contains(err.Error(), "timeout"):
+		return resultTimeout
+	}
+	return resultError
+}
+
 func (p *ProxyServer) getConnectedSSHClient(ctx context.Context) (*ssh.Client, error) {
-	p.logMessage("Getting SSH client...")
+	p.logDebug("Getting SSH client...")
 
 	// Проверяем пул соединений
 	select {
 	case client := <-p.connectionPool:
 		if client != nil {
-			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			err := p.sendKeepalive(client)
 			if err == nil {
-				p.logMessage("Using pooled SSH client")
+				p.logDebug("Using pooled SSH client")
 				return client, nil
 			}
-			p.logMessage(fmt.Sprintf("Pooled SSH client is dead: %v", err))
+			p.logWarn(fmt.Sprintf("Pooled SSH client is dead: %v", err))
 			client.Close()
 		}
 	default:
-		p.logMessage("No pooled SSH clients available")
+		p.logDebug("No pooled SSH clients available")
 	}
 
-	p.clientLock.Lock()
-	defer p.clientLock.Unlock()
-
-	if p.sshClient == nil {
-		p.logMessage("Creating new SSH connection...")
-		return p.reconnectSSH(ctx)
-	}
+	for {
+		// Переподключается только superviseSSH, здесь ждём его
+		client, err := p.waitSSHClient(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	_, _, err := p.sshClient.SendRequest("keepalive@openssh.com", true, nil)
-	if err != nil {
-		p.logMessage(fmt.Sprintf("Main SSH connection appears dead: %v. Reconnecting...", err))
-		p.sshClient.Close()
-		p.sshClient = nil
-		return p.reconnectSSH(ctx)
+		err = p.sendKeepalive(client)
+		if err == nil {
+			p.logDebug("Using main SSH client")
+			return client, nil
+		}
+		p.sshConnectionLost(client, err)
 	}
-
-	p.logMessage("Using main SSH client")
-	return p.sshClient, nil
 }
 
 func (p *ProxyServer) returnSSHClient(client *ssh.Client) {
@@ -584,8 +777,7 @@ func (p *ProxyServer) createNewSSHClientWithLimit() (*ssh.Client, error) {
         return nil, fmt.Errorf("SSH connection limit reached")
     }
 
-    sshAddress := p.config.SSHHost + ":" + p.config.SSHPort
-    client, err := ssh.Dial("tcp", sshAddress, p.sshConfig)
+    client, err := p.dialSSH()
     if err != nil {
         return nil, err
     }
@@ -594,76 +786,11 @@ func (p *ProxyServer) createNewSSHClientWithLimit() (*ssh.Client, error) {
     return client, nil
 }
 
-func (p *ProxyServer) reconnectSSH(ctx context.Context) (*ssh.Client, error) {
-  sshAddress := p.config.SSHHost + ":" + p.config.SSHPort
-  var newClient *ssh.Client
-  var err error
-
-  maxRetries := 3
-  for retry := 0; retry < maxRetries; retry++ {
-    select {
-    case <-ctx.Done():
-      return nil, ctx.Err()
-    default:
-  }
-
-    if retry > 0 {
-      backoff := time.Duration(2<<uint(retry)) * time.Second // Увеличить backoff
-      p.logMessage(fmt.Sprintf("Waiting %v before retry %d", backoff, retry+1))
-      select {
-      case <-ctx.Done():
-        return nil, ctx.Err()
-      case <-time.After(backoff):
-    }
-    }
-
-		newClient, err = ssh.Dial("tcp", sshAddress, p.sshConfig)
-		if err == nil {
-			p.logMessage(fmt.Sprintf("Successfully reconnected to SSH at %s", sshAddress))
-			p.sshClient = newClient
-			return p.sshClient, nil
-		}
-
-		if !isNetworkError(err) {
-			p.logMessage(fmt.Sprintf("Failed to reconnect SSH (attempt %d/%d): %v", retry+1, maxRetries, err))
-		}
-	}
-
-	return nil, fmt.Errorf("failed to reconnect after %d attempts: %v", maxRetries, err)
-}
-
-func (p *ProxyServer) monitorSSHConnection() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-p.ctx.Done():
-			return
-		case <-ticker.C:
-			p.clientLock.Lock()
-			if p.sshClient != nil {
-				_, _, err := p.sshClient.SendRequest("keepalive@openssh.com", true, nil)
-				if err != nil {
-					if !isNetworkError(err) {
-						p.logMessage(fmt.Sprintf("SSH keepalive failed: %v. Attempting to reconnect...", err))
-					}
-					p.sshClient.Close()
-					p.sshClient = nil
-					p.clientLock.Unlock()
-					_, err := p.reconnectSSH(p.ctx)
-					if err != nil && !isNetworkError(err) {
-						p.logMessage(fmt.Sprintf("Reconnection attempt failed: %v", err))
-					}
-					continue
-				}
-			}
-			p.clientLock.Unlock()
-		}
-	}
-}
-
+// Stop останавливает прокси немедленно, обрывая активные соединения.
+// Для остановки с ожиданием их завершения см. Shutdown.
 func (p *ProxyServer) Stop() error {
+	p.closeTrackedConns()
+
 	if p.cancel != nil {
 		p.cancel()
 	}
@@ -690,10 +817,16 @@ func (p *ProxyServer) Stop() error {
 		p.logListener.Close()
 	}
 
+	p.closeLocalForwards()
+	p.closeRemoteForwards()
+
 	if p.httpServer != nil {
-		p.httpServer.Shutdown(context.Background())
+		p.httpServer.Close()
 	}
 
+	if p.logs != nil {
+		p.logs.close()
+	}
 	if p.logServer != nil {
 		p.logServer.Shutdown(context.Background())
 	}
@@ -704,8 +837,10 @@ func (p *ProxyServer) Stop() error {
 		p.sshClient = nil
 	}
 	p.clientLock.Unlock()
+	p.closeRetiredSSHClients()
 
 	p.wg.Wait()
+	p.setLogger(p.Logger(), nil)
 
 	// Проверяем что канал не nil перед закрытием
 	if p.shutdownComplete != nil {
@@ -715,70 +850,51 @@ func (p *ProxyServer) Stop() error {
 	return nil
 }
 
-func (p *ProxyServer) setupLogging(listenAddr string) error {
+// setupAdminServer запускает HTTP сервер администрирования: состояние,
+// метрики, журнал и управление (см. admin.go).
+func (p *ProxyServer) setupAdminServer(listenAddr string) error {
+	// То же проверяет Validate, но Start вызывают и без неё (mobile,
+	// библиотека): без токена API не должен быть доступен по сети
+	if p.currentConfig().AdminToken == "" && !isLoopback(listenAddr) {
+		return fmt.Errorf("admin server: %s is not a loopback address, admin_token is required", listenAddr)
+	}
 	logListener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
-	p.logListener = logListener
-	// p.logChan = make(chan string, 100)
+	p.logListener = p.withACL(logListener, p.adminACL)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-
-		// flusher, ok := w.(http.Flusher)
-		// if !ok {
-		// 	http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
-		// 	return
-		// }
-
-		for {
-			select {
-			case <-r.Context().Done():
-				return
-			// case msg := <-p.logChan:
-				// _, err := fmt.Fprintf(w, "data: %s\n\n", msg)
-				// if err != nil {
-				// 	return
-				// }
-				// flusher.Flush()
-			}
-		}
-	})
+	mux.HandleFunc("GET /status", p.handleStatus)
+	mux.HandleFunc("POST /reload", p.handleReload)
+	mux.HandleFunc("POST /reconnect", p.handleReconnect)
+	mux.HandleFunc("GET /connections", p.handleConnections)
+	mux.HandleFunc("GET /connections/closed", p.handleClosedConnections)
+	mux.HandleFunc("DELETE /connections/{id}", p.handleCloseConnection)
+	mux.HandleFunc("GET /forwards", p.handleForwards)
+	mux.HandleFunc("POST /forwards", p.handleAddForward)
+	mux.HandleFunc("DELETE /forwards/{type}/{listen}", p.handleRemoveForward)
+	mux.HandleFunc("GET /config", p.handleConfig)
+	mux.HandleFunc("GET /limits", p.handleGetLimits)
+	mux.HandleFunc("PUT /limits", p.handleSetLimits)
+	mux.HandleFunc("GET /metrics", p.handleMetrics)
+	mux.HandleFunc("GET /logs", p.handleLogs)
 
 	p.logServer = &http.Server{
-		Handler: mux,
+		Handler: p.requireAdminToken(mux),
 	}
 
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
-		if err := p.logServer.Serve(logListener); err != nil && !isClosedError(err) {
-			p.logMessage(fmt.Sprintf("Log server error: %v", err))
+		if err := p.logServer.Serve(p.logListener); err != nil && !isClosedError(err) {
+			p.logError(fmt.Sprintf("Admin server error: %v", err))
 		}
 	}()
 
 	return nil
 }
 
-func (p *ProxyServer) logMessage(msg string) {
-	// Консольный вывод для отладки
-	log.Printf("[PROXY] %s", msg)
-
-	// // HTTP логирование (если канал доступен)
-	// if p.logChan != nil {
-	// 	select {
-	// 	case p.logChan <- msg:
-	// 	default:
-	// 		// Channel is full, drop the message
-	// 	}
-	// }
-}
-
 // Вспомогательные функции
 func isNetworkError(err error) bool {
 	if err == nil {
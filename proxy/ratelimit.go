@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ограничение скорости. Каждое соединение списывает переданные байты из
+// нескольких корзин (token bucket): общей, клиента, пользователя,
+// назначения и правила маршрутизации - и ждёт, пока не уложится во все.
+// Отдача (upload) - от клиента к назначению, загрузка (download) - обратно.
+
+// Чтение и запись при ограничении идут порциями, чтобы скорость
+// была ровной, а не рывками по 32 КБ
+const throttleChunk = 16 << 10
+
+// ByteRate - скорость в байтах в секунду. В конфигурации записывается
+// числом или строкой с единицами: "512K", "2MB", "10mbit".
+type ByteRate int64
+
+func (r *ByteRate) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*r = ByteRate(v)
+	case string:
+		parsed, err := parseByteRate(v)
+		if err != nil {
+			return err
+		}
+		*r = parsed
+	default:
+		return fmt.Errorf("invalid rate %v", v)
+	}
+	return nil
+}
+
+func parseByteRate(s string) (ByteRate, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8},
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1},
+	}
+	mult := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return ByteRate(n * mult), nil
+}
+
+// Bandwidth - ограничение скорости в обе стороны, 0 - без ограничения.
+type Bandwidth struct {
+	Upload   ByteRate `json:"upload,omitempty"`
+	Download ByteRate `json:"download,omitempty"`
+}
+
+// RateLimits - ограничения скорости. Per* применяются к каждому клиенту
+// (IP адресу), пользователю и хосту назначения по отдельности.
+type RateLimits struct {
+	Global         Bandwidth `json:"global"`
+	PerClient      Bandwidth `json:"per_client"`
+	PerUser        Bandwidth `json:"per_user"`
+	PerDestination Bandwidth `json:"per_destination"`
+	// Лимиты отдельных пользователей (вместо per_user) и правил маршрутизации
+	Users map[string]Bandwidth `json:"users,omitempty"`
+	Rules map[string]Bandwidth `json:"rules,omitempty"`
+}
+
+func (l RateLimits) validate() error {
+	check := func(b Bandwidth) bool {
+		return b.Upload >= 0 && b.Download >= 0
+	}
+	ok := check(l.Global) && check(l.PerClient) && check(l.PerUser) && check(l.PerDestination)
+	for _, b := range l.Users {
+		ok = ok && check(b)
+	}
+	for _, b := range l.Rules {
+		ok = ok && check(b)
+	}
+	if !ok {
+		return fmt.Errorf("rate_limits: rates must not be negative")
+	}
+	return nil
+}
+
+// active сообщает, задано ли хоть одно ограничение.
+func (l RateLimits) active() bool {
+	set := func(b Bandwidth) bool {
+		return b.Upload > 0 || b.Download > 0
+	}
+	if set(l.Global) || set(l.PerClient) || set(l.PerUser) || set(l.PerDestination) {
+		return true
+	}
+	for _, b := range l.Users {
+		if set(b) {
+			return true
+		}
+	}
+	for _, b := range l.Rules {
+		if set(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func rateLimitsEqual(a, b RateLimits) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// tokenBucket допускает долг: порция списывается сразу, а следующий
+// вызов ждёт дольше. Запас не больше секунды трафика.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate ByteRate) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// take списывает n байт и возвращает, сколько нужно подождать.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	if b.rate <= 0 {
+		b.last = now
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type limitKey struct {
+	scope string // global, client, user, destination, rule
+	name  string
+}
+
+type limitBuckets struct {
+	key      limitKey
+	up, down tokenBucket
+	refs     int
+}
+
+// rateLimiter хранит корзины, пока ими пользуется хотя бы одно соединение.
+type rateLimiter struct {
+	lock    sync.Mutex
+	limits  RateLimits
+	buckets map[limitKey]*limitBuckets
+	// Задан ли хоть один лимит; без них соединения не тратят время на корзины
+	enabled atomic.Bool
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	l := &rateLimiter{limits: limits, buckets: make(map[limitKey]*limitBuckets)}
+	l.enabled.Store(limits.active())
+	return l
+}
+
+func (l *rateLimiter) active() bool {
+	return l.enabled.Load()
+}
+
+// bandwidth возвращает лимит для корзины. Вызывается под lock.
+func (l *rateLimiter) bandwidth(key limitKey) Bandwidth {
+	switch key.scope {
+	case "global":
+		return l.limits.Global
+	case "client":
+		return l.limits.PerClient
+	case "user":
+		if b, ok := l.limits.Users[key.name]; ok {
+			return b
+		}
+		return l.limits.PerUser
+	case "destination":
+		return l.limits.PerDestination
+	case "rule":
+		return l.limits.Rules[key.name]
+	}
+	return Bandwidth{}
+}
+
+// acquire возвращает корзины, из которых списывается трафик соединения.
+func (l *rateLimiter) acquire(info connInfo) []*limitBuckets {
+	keys := append([]limitKey{{scope: "global"}}, limitKeys(info)...)
+	if info.Rule != "" {
+		keys = append(keys, limitKey{"rule", info.Rule})
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	buckets := make([]*limitBuckets, len(keys))
+	for i, key := range keys {
+		b := l.buckets[key]
+		if b == nil {
+			b = &limitBuckets{key: key}
+			bw := l.bandwidth(key)
+			b.up.setRate(bw.Upload)
+			b.down.setRate(bw.Download)
+			// Новая корзина начинает с полным запасом
+			b.up.tokens, b.down.tokens = b.up.rate, b.down.rate
+			b.up.last, b.down.last = time.Now(), time.Now()
+			l.buckets[key] = b
+		}
+		b.refs++
+		buckets[i] = b
+	}
+	return buckets
+}
+
+func (l *rateLimiter) release(buckets []*limitBuckets) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, b := range buckets {
+		b.refs--
+		if b.refs == 0 {
+			delete(l.buckets, b.key)
+		}
+	}
+}
+
+func (l *rateLimiter) get() RateLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+// set меняет лимиты, в том числе для уже открытых соединений.
+func (l *rateLimiter) set(limits RateLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits
+	l.enabled.Store(limits.active())
+	for key, b := range l.buckets {
+		bw := l.bandwidth(key)
+		b.up.setRate(bw.Upload)
+		b.down.setRate(bw.Download)
+	}
+}
+
+// throttle ждёт, пока n байт уложатся во все корзины соединения.
+// Возвращает false, если соединение закрыли во время ожидания.
+func (c *trackedConn) throttle(n int, upload bool) bool {
+	var wait time.Duration
+	for _, b := range c.limits {
+		bucket := &b.down
+		if upload {
+			bucket = &b.up
+		}
+		if d := bucket.take(n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// RateLimits возвращает действующие ограничения скорости.
+func (p *ProxyServer) RateLimits() RateLimits {
+	return p.limiter.get()
+}
+
+// SetRateLimits меняет ограничения скорости без перезагрузки конфигурации.
+// Изменения действуют и на открытые соединения, но не сохраняются в файл.
+func (p *ProxyServer) SetRateLimits(limits RateLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	config := *p.currentConfig()
+	config.RateLimits = limits
+	p.configLock.Lock()
+	p.config = &config
+	p.configLock.Unlock()
+
+	p.limiter.set(limits)
+	p.logMessage("Rate limits updated")
+	return nil
+}
+
+func (p *ProxyServer) handleGetLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.RateLimits())
+}
+
+func (p *ProxyServer) handleSetLimits(w http.ResponseWriter, r *http.Request) {
+	var limits RateLimits
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.SetRateLimits(limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, p.RateLimits())
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want ByteRate
+		ok   bool
+	}{
+		{"1000", 1000, true},
+		{"512K", 512 << 10, true},
+		{"512 kb", 512 << 10, true},
+		{"2MB", 2 << 20, true},
+		{"1.5m", 3 << 19, true},
+		{"1G", 1 << 30, true},
+		{"10mbit", 1250000, true},
+		{"8Kbit", 1000, true},
+		{"100b", 100, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"-2MB", 0, false},
+		{"fast", 0, false},
+		{"10 mbps", 0, false},
+		{"", 0, false},
+	} {
+		got, err := parseByteRate(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseByteRate(%q) = %d, %v", tt.in, got, err)
+		}
+	}
+
+	var limits RateLimits
+	if err := json.Unmarshal([]byte(`{"global": {"upload": 2048, "download": "10mbit"}}`), &limits); err != nil {
+		t.Fatal(err)
+	}
+	if limits.Global != (Bandwidth{Upload: 2048, Download: 1250000}) {
+		t.Errorf("unmarshal: %+v", limits.Global)
+	}
+	if err := json.Unmarshal([]byte(`{"global": {"upload": true}}`), &limits); err == nil {
+		t.Error("expected an error for a bool rate")
+	}
+	if err := (RateLimits{PerClient: Bandwidth{Download: -1}}).validate(); err == nil {
+		t.Error("negative rate passed validation")
+	}
+}
+
+// near сравнивает ожидание с допуском на время выполнения теста.
+func near(got, want time.Duration) bool {
+	d := got - want
+	return d > -20*time.Millisecond && d < 20*time.Millisecond
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	b := &tokenBucket{}
+	b.setRate(1000)
+	b.tokens, b.last = b.rate, time.Now()
+
+	// Запас в секунду трафика расходуется без ожидания
+	if d := b.take(1000); d != 0 {
+		t.Fatalf("full bucket: wait %v", d)
+	}
+	// Порция сверх запаса списывается в долг, ждать - пока он не погасится
+	if d := b.take(500); !near(d, 500*time.Millisecond) {
+		t.Fatalf("debt: wait %v, want 500ms", d)
+	}
+	if d := b.take(500); !near(d, time.Second) {
+		t.Fatalf("growing debt: wait %v, want 1s", d)
+	}
+
+	// Через секунду долг погашен наполовину
+	b.last = b.last.Add(-time.Second)
+	if d := b.take(0); !near(d, 0) {
+		t.Fatalf("after refill: wait %v, want 0", d)
+	}
+
+	// Запас не копится дольше секунды
+	b.last = b.last.Add(-time.Minute)
+	if d := b.take(1000); d != 0 {
+		t.Fatalf("refilled bucket: wait %v", d)
+	}
+	if d := b.take(100); !near(d, 100*time.Millisecond) {
+		t.Fatalf("refill cap: wait %v, want 100ms", d)
+	}
+
+	// Без ограничения ожидания нет
+	b.setRate(0)
+	if d := b.take(1 << 20); d != 0 {
+		t.Fatalf("unlimited: wait %v", d)
+	}
+}
+
+func TestRateLimiterSet(t *testing.T) {
+	l := newRateLimiter(RateLimits{PerClient: Bandwidth{Download: 4000}})
+	info := connInfo{Client: "10.0.0.1:5000", User: "phone", Target: "example.com:443", Rule: "local"}
+	buckets := l.acquire(info)
+	rates := func() map[limitKey][2]float64 {
+		m := make(map[limitKey][2]float64)
+		for _, b := range buckets {
+			m[b.key] = [2]float64{b.up.rate, b.down.rate}
+		}
+		return m
+	}
+	client := rates()[limitKey{"client", "10.0.0.1"}]
+	if client != [2]float64{0, 4000} || len(buckets) != 5 {
+		t.Fatalf("client rates %v, %d buckets", client, len(buckets))
+	}
+
+	// Новые лимиты применяются к корзинам открытого соединения
+	l.set(RateLimits{
+		Global:    Bandwidth{Download: 1000},
+		PerClient: Bandwidth{Upload: 200, Download: 400},
+		PerUser:   Bandwidth{Download: 50},
+		Users:     map[string]Bandwidth{"phone": {Download: 300}},
+		Rules:     map[string]Bandwidth{"local": {Upload: 10}},
+	})
+	if !l.active() {
+		t.Fatal("not active with limits")
+	}
+	got := rates()
+	for key, want := range map[limitKey][2]float64{
+		{scope: "global"}:              {0, 1000},
+		{"client", "10.0.0.1"}:         {200, 400},
+		{"user", "phone"}:              {0, 300},
+		{"destination", "example.com"}: {0, 0},
+		{"rule", "local"}:              {10, 0},
+	} {
+		if got[key] != want {
+			t.Errorf("%v: rates %v, want %v", key, got[key], want)
+		}
+	}
+
+	// Снижение лимита урезает накопленный запас
+	for _, b := range buckets {
+		if b.key.scope == "client" && b.down.tokens != 400 {
+			t.Errorf("client tokens %v, want 400", b.down.tokens)
+		}
+	}
+
+	// Корзины удаляются вместе с последним соединением
+	l.release(buckets)
+	if len(l.buckets) != 0 {
+		t.Errorf("buckets left after release: %d", len(l.buckets))
+	}
+	l.set(RateLimits{})
+	if l.active() {
+		t.Error("active after limits were removed")
+	}
+}
@@ -0,0 +1,518 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Переподключение к SSH серверу. Соединением владеет одна горутина
+// (superviseSSH): она проверяет его keepalive запросами и после обрыва
+// переподключается с растущей паузой и случайным разбросом, пока не
+// получится. Соединения, которым нужен SSH, ждут её результата, а не
+// подключаются сами, поэтому попытка в каждый момент одна. Смена сети
+// прерывает паузу. Состояние видно в /status и через OnSSHStateChange.
+
+// Состояние failed - попытки прекращены: исчерпан max_attempts или сервер
+// отверг авторизацию при stop_on_auth_error. Попытки возобновляются после
+// NetworkChanged, Reconnect или Reload. Без stop_on_auth_error отказ в
+// авторизации повторяется с паузой max_interval: секреты перечитываются
+// при каждой попытке, а сервер мог отказать из-за временного сбоя (PAM, LDAP).
+
+// Значения по умолчанию
+const (
+	defaultReconnectInitial    = time.Second
+	defaultReconnectMax        = time.Minute
+	defaultReconnectMultiplier = 2
+	defaultReconnectJitter     = 0.2
+	defaultKeepaliveInterval   = 10 * time.Second
+	// Сколько ждать ответа на keepalive, прежде чем считать соединение мёртвым
+	keepaliveTimeout = 15 * time.Second
+	// Сколько Reconnect ждёт попытки superviseSSH
+	reconnectWaitTimeout = time.Minute
+	// Как часто сравнивать адреса сетевых интерфейсов
+	networkCheckInterval = 5 * time.Second
+)
+
+// ReconnectConfig - параметры переподключения к SSH серверу.
+type ReconnectConfig struct {
+	// Пауза после первой неудачи; каждая следующая больше в multiplier
+	// раз, но не больше max_interval
+	InitialInterval Duration `json:"initial_interval,omitempty"`
+	MaxInterval     Duration `json:"max_interval,omitempty"`
+	Multiplier      float64  `json:"multiplier,omitempty"`
+	// Доля паузы, на которую она случайно сокращается (от 0 до 1), чтобы
+	// клиенты не переподключались к серверу одновременно; 0 отключает
+	// разброс, незаданное значение - по умолчанию
+	Jitter *float64 `json:"jitter,omitempty"`
+	// После стольких неудач подряд попытки прекращаются; 0 - без ограничения
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Прекратить попытки после отказа в авторизации, чтобы повторы не
+	// привели к бану (например fail2ban)
+	StopOnAuthError bool `json:"stop_on_auth_error,omitempty"`
+	// Как часто проверять соединение keepalive запросом
+	KeepaliveInterval Duration `json:"keepalive_interval,omitempty"`
+}
+
+// Validate проверяет параметры переподключения.
+func (c ReconnectConfig) Validate() error {
+	var errs []string
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{{"initial_interval", c.InitialInterval}, {"max_interval", c.MaxInterval}, {"keepalive_interval", c.KeepaliveInterval}} {
+		if d.value < 0 {
+			errs = append(errs, d.name+" must not be negative")
+		}
+	}
+	if c.InitialInterval > 0 && c.MaxInterval > 0 && c.MaxInterval < c.InitialInterval {
+		errs = append(errs, "max_interval must not be less than initial_interval")
+	}
+	if c.Multiplier != 0 && c.Multiplier < 1 {
+		errs = append(errs, "multiplier must be at least 1")
+	}
+	if c.Jitter != nil && (*c.Jitter < 0 || *c.Jitter > 1) {
+		errs = append(errs, "jitter must be between 0 and 1")
+	}
+	if c.MaxAttempts < 0 {
+		errs = append(errs, "max_attempts must not be negative")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("reconnect: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// withDefaults подставляет значения по умолчанию вместо незаданных.
+func (c ReconnectConfig) withDefaults() ReconnectConfig {
+	if c.InitialInterval == 0 {
+		c.InitialInterval = Duration(defaultReconnectInitial)
+	}
+	if c.MaxInterval == 0 {
+		c.MaxInterval = Duration(defaultReconnectMax)
+		if c.MaxInterval < c.InitialInterval {
+			c.MaxInterval = c.InitialInterval
+		}
+	}
+	if c.Multiplier == 0 {
+		c.Multiplier = defaultReconnectMultiplier
+	}
+	if c.Jitter == nil {
+		jitter := defaultReconnectJitter
+		c.Jitter = &jitter
+	}
+	if c.KeepaliveInterval == 0 {
+		c.KeepaliveInterval = Duration(defaultKeepaliveInterval)
+	}
+	return c
+}
+
+// delay возвращает паузу после attempt неудач подряд. Разброс только
+// уменьшает паузу, поэтому max_interval не превышается.
+func (c ReconnectConfig) delay(attempt int) time.Duration {
+	d := float64(c.InitialInterval) * math.Pow(c.Multiplier, float64(attempt-1))
+	if d > float64(c.MaxInterval) {
+		d = float64(c.MaxInterval)
+	}
+	d *= 1 - *c.Jitter*rand.Float64()
+	return time.Duration(d)
+}
+
+func (c ReconnectConfig) String() string {
+	c = c.withDefaults()
+	return fmt.Sprintf("%v..%v x%g jitter=%g max_attempts=%d stop_on_auth_error=%v keepalive=%v",
+		time.Duration(c.InitialInterval), time.Duration(c.MaxInterval), c.Multiplier,
+		*c.Jitter, c.MaxAttempts, c.StopOnAuthError, time.Duration(c.KeepaliveInterval))
+}
+
+// SSHStateChange - состояние SSH соединения и ход переподключения.
+type SSHStateChange struct {
+	State string
+	// Неудачных попыток подряд
+	Attempt   int
+	LastError string
+	// Когда будет следующая попытка (нулевое время, если не запланирована)
+	NextRetry time.Time
+}
+
+// sshSupervisor хранит состояние и будит superviseSSH.
+type sshSupervisor struct {
+	lock    sync.Mutex
+	current SSHStateChange
+	// Закрывается и заменяется при каждой смене состояния
+	changed chan struct{}
+	// Запрос немедленной попытки или проверки соединения
+	wake      chan struct{}
+	listeners map[int]func(SSHStateChange)
+	nextID    int
+}
+
+func newSSHSupervisor() *sshSupervisor {
+	return &sshSupervisor{
+		current:   SSHStateChange{State: SSHStateConnected},
+		changed:   make(chan struct{}),
+		wake:      make(chan struct{}, 1),
+		listeners: make(map[int]func(SSHStateChange)),
+	}
+}
+
+// state возвращает текущее состояние и канал, который закроется при
+// следующей смене.
+func (s *sshSupervisor) state() (SSHStateChange, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current, s.changed
+}
+
+func (s *sshSupervisor) set(change SSHStateChange) {
+	s.setIf(change, nil)
+}
+
+// setIf меняет состояние, только если ok (вызывается под s.lock)
+// возвращает true. Возвращает false, если состояние не менялось из-за ok.
+func (s *sshSupervisor) setIf(change SSHStateChange, ok func() bool) bool {
+	s.lock.Lock()
+	if ok != nil && !ok() {
+		s.lock.Unlock()
+		return false
+	}
+	if s.current == change {
+		s.lock.Unlock()
+		return true
+	}
+	s.current = change
+	close(s.changed)
+	s.changed = make(chan struct{})
+	listeners := make([]func(SSHStateChange), 0, len(s.listeners))
+	for _, fn := range s.listeners {
+		listeners = append(listeners, fn)
+	}
+	s.lock.Unlock()
+
+	for _, fn := range listeners {
+		fn(change)
+	}
+	return true
+}
+
+// kick будит superviseSSH; повторные вызовы до пробуждения сливаются.
+func (s *sshSupervisor) kick() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// OnSSHStateChange вызывает fn при каждой смене состояния SSH соединения.
+// fn вызывается синхронно и не должна блокироваться надолго. Возвращает
+// функцию отмены подписки.
+func (p *ProxyServer) OnSSHStateChange(fn func(SSHStateChange)) (cancel func()) {
+	s := p.supervisor
+	s.lock.Lock()
+	id := s.nextID
+	s.nextID++
+	s.listeners[id] = fn
+	s.lock.Unlock()
+	return func() {
+		s.lock.Lock()
+		delete(s.listeners, id)
+		s.lock.Unlock()
+	}
+}
+
+// SSHState возвращает текущее состояние SSH соединения.
+func (p *ProxyServer) SSHState() SSHStateChange {
+	state, _ := p.supervisor.state()
+	return state
+}
+
+// NetworkChanged сообщает о смене сети (другая Wi-Fi сеть, переход на
+// мобильную связь). Живое соединение сразу проверяется, а переподключение
+// начинается без ожидания паузы, в том числе из состояния failed.
+func (p *ProxyServer) NetworkChanged() {
+	p.logMessage("Network change reported, checking SSH connection")
+	p.supervisor.kick()
+}
+
+// superviseSSH следит за соединением, пока не остановлен прокси.
+func (p *ProxyServer) superviseSSH() {
+	interval := time.Duration(p.currentConfig().Reconnect.withDefaults().KeepaliveInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		woken := false
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.supervisor.wake:
+			woken = true
+		}
+
+		p.clientLock.Lock()
+		client := p.sshClient
+		p.clientLock.Unlock()
+
+		if client != nil {
+			err := p.checkSSHClient(client)
+			if err == nil || !p.sshConnectionLost(client, err) {
+				continue
+			}
+		} else if state, _ := p.supervisor.state(); state.State == SSHStateFailed && !woken {
+			// После отказа ждём явного запроса
+			continue
+		}
+		// Пробуждение от самого обрыва не должно прервать первую паузу
+		select {
+		case <-p.supervisor.wake:
+		default:
+		}
+		p.reconnectSSH()
+
+		// Интервал проверки мог измениться при Reload
+		if next := time.Duration(p.currentConfig().Reconnect.withDefaults().KeepaliveInterval); next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// checkSSHClient отправляет keepalive и ждёт ответа не дольше
+// keepaliveTimeout: после смены сети TCP соединение может молча зависнуть.
+func (p *ProxyServer) checkSSHClient(client *ssh.Client) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- p.sendKeepalive(client)
+	}()
+	timer := time.NewTimer(keepaliveTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("keepalive timeout after %v", keepaliveTimeout)
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// sshConnectionLost убирает мёртвый основной клиент и переводит прокси в
+// состояние reconnecting. Возвращает false, если client уже заменён.
+func (p *ProxyServer) sshConnectionLost(client *ssh.Client, err error) bool {
+	p.clientLock.Lock()
+	if p.sshClient != client {
+		p.clientLock.Unlock()
+		return false
+	}
+	p.sshClient = nil
+	p.clientLock.Unlock()
+	client.Close()
+
+	p.recordSSHError(err)
+	p.logWarn(fmt.Sprintf("SSH connection lost: %v", err))
+	p.supervisor.set(SSHStateChange{State: SSHStateReconnecting, LastError: err.Error()})
+	p.supervisor.kick()
+	return true
+}
+
+// reconnectSSH подключается заново, пока не получится, пока попытки не
+// прекращены или пока не остановлен прокси. Во время паузы wake начинает
+// следующую попытку сразу и сбрасывает рост паузы. Если клиент тем временем
+// поставил Reload, попытки прекращаются.
+func (p *ProxyServer) reconnectSSH() {
+	attempt := 0
+	if state, _ := p.supervisor.state(); state.State == SSHStateFailed {
+		p.logMessage("Retrying SSH connection")
+	}
+
+	for {
+		if p.ctx.Err() != nil {
+			return
+		}
+		if !p.setReconnectState(SSHStateChange{State: SSHStateReconnecting, Attempt: attempt, LastError: p.lastSSHErrorText()}) {
+			return
+		}
+
+		config := p.currentConfig()
+		sshAddress := config.SSHHost + ":" + config.SSHPort
+		client, err := p.dialSSH()
+		if err == nil {
+			if p.ctx.Err() != nil || !p.setReconnectState(SSHStateChange{State: SSHStateReconnecting, Attempt: attempt}) {
+				client.Close()
+				return
+			}
+			p.metrics.sshReconnects.inc(resultSuccess)
+			p.reconnects.Add(1)
+			p.logMessage(fmt.Sprintf("Successfully reconnected to SSH at %s on attempt %d", sshAddress, attempt+1))
+			p.switchSSHClient(client)
+			return
+		}
+
+		attempt++
+		p.metrics.sshReconnects.inc(resultError)
+		p.recordSSHError(err)
+
+		reconnect := config.Reconnect.withDefaults()
+		authFailed := isAuthError(err)
+		if authFailed && reconnect.StopOnAuthError || reconnect.MaxAttempts > 0 && attempt >= reconnect.MaxAttempts {
+			if p.setReconnectState(SSHStateChange{State: SSHStateFailed, Attempt: attempt, LastError: err.Error()}) {
+				p.logWarn(fmt.Sprintf("SSH reconnect to %s failed after %d attempts, giving up until the network changes or a reconnect is requested: %v", sshAddress, attempt, err))
+			}
+			return
+		}
+
+		delay := reconnect.delay(attempt)
+		if authFailed {
+			// Учётные данные сами не исправятся быстрее: повторяем редко
+			delay = time.Duration(reconnect.MaxInterval)
+		}
+		if !p.setReconnectState(SSHStateChange{State: SSHStateReconnecting, Attempt: attempt, LastError: err.Error(), NextRetry: time.Now().Add(delay)}) {
+			return
+		}
+		msg := fmt.Sprintf("SSH reconnect to %s attempt %d failed: %v; retrying in %v", sshAddress, attempt, err, delay.Round(time.Millisecond))
+		if isNetworkError(err) {
+			p.logMessage(msg)
+		} else {
+			p.logWarn(msg)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-p.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-p.supervisor.wake:
+			timer.Stop()
+			p.logMessage("Retrying SSH connection immediately")
+			attempt = 0
+		}
+	}
+}
+
+// setReconnectState меняет состояние, пока основного клиента нет.
+// Проверка идёт под блокировкой состояния, поэтому switchSSHClient,
+// который ставит connected после клиента, не будет перезаписан.
+func (p *ProxyServer) setReconnectState(change SSHStateChange) bool {
+	return p.supervisor.setIf(change, func() bool {
+		p.clientLock.Lock()
+		defer p.clientLock.Unlock()
+		return p.sshClient == nil
+	})
+}
+
+// retrySSH будит superviseSSH и ждёт исхода ближайшей попытки.
+func (p *ProxyServer) retrySSH(ctx context.Context) error {
+	_, changed := p.supervisor.state()
+	p.supervisor.kick()
+	started := false
+	for {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("SSH reconnect: %v", ctx.Err())
+		}
+		var state SSHStateChange
+		state, changed = p.supervisor.state()
+		switch {
+		case state.State == SSHStateConnected:
+			return nil
+		case state.State == SSHStateReconnecting && state.Attempt == 0:
+			started = true
+		case started && state.LastError != "":
+			return fmt.Errorf("failed to connect to SSH server: %s", state.LastError)
+		}
+	}
+}
+
+func (p *ProxyServer) lastSSHErrorText() string {
+	p.sshErrLock.Lock()
+	defer p.sshErrLock.Unlock()
+	return p.lastSSHError
+}
+
+// waitSSHClient ждёт, пока superviseSSH восстановит основной клиент, но
+// не дольше ctx. В состоянии failed возвращает ошибку сразу: новые
+// попытки запускает только явный запрос.
+func (p *ProxyServer) waitSSHClient(ctx context.Context) (*ssh.Client, error) {
+	for {
+		p.clientLock.Lock()
+		client := p.sshClient
+		p.clientLock.Unlock()
+		if client != nil {
+			return client, nil
+		}
+
+		state, changed := p.supervisor.state()
+		if state.State == SSHStateFailed {
+			return nil, fmt.Errorf("SSH connection failed: %s", state.LastError)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("SSH connection unavailable (%s): %v", state.State, ctx.Err())
+		case <-p.ctx.Done():
+			return nil, p.ctx.Err()
+		}
+	}
+}
+
+// isAuthError - сервер отверг учётные данные.
+func isAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// watchNetwork сообщает NetworkChanged, когда меняется набор адресов
+// интерфейсов. Если адреса недоступны (на Android 11+ приложению закрыт
+// netlink), следить должно приложение через NetworkChanged.
+func (p *ProxyServer) watchNetwork() {
+	last, err := interfaceAddrs()
+	if err != nil {
+		p.logDebug(fmt.Sprintf("Network change detection disabled: %v", err))
+		return
+	}
+	ticker := time.NewTicker(networkCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		addrs, err := interfaceAddrs()
+		if err != nil || addrs == last {
+			continue
+		}
+		p.logDebug(fmt.Sprintf("Network addresses changed: %s", addrs))
+		last = addrs
+		p.NetworkChanged()
+	}
+}
+
+// interfaceAddrs возвращает адреса интерфейсов, кроме loopback, одной
+// строкой для сравнения.
+func interfaceAddrs() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	var list []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsLoopback() {
+			continue
+		}
+		list = append(list, addr.String())
+	}
+	sort.Strings(list)
+	return strings.Join(list, " "), nil
+}
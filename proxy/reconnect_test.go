@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Переподключение проверяется через переключатель перед SSH сервером:
+// в выключенном состоянии он обрывает текущие соединения и сразу
+// закрывает новые.
+
+type sshSwitch struct {
+	addr string
+
+	lock  sync.Mutex
+	up    bool
+	conns []net.Conn
+	// Подключений, пока сервер выключен, - столько было попыток
+	refused int
+}
+
+func startSSHSwitch(t *testing.T, target string) *sshSwitch {
+	ln := listen(t)
+	s := &sshSwitch{addr: ln.Addr().String(), up: true}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			if !s.up {
+				s.refused++
+				s.lock.Unlock()
+				conn.Close()
+				continue
+			}
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+			go bridge(conn, target)
+		}
+	}()
+	return s
+}
+
+func (s *sshSwitch) set(up bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.up = up
+	if !up {
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+		s.conns = nil
+	}
+}
+
+func (s *sshSwitch) refusedCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refused
+}
+
+// startSupervisedProxy подключается к SSH серверу из config и запускает
+// только superviseSSH, без слушателей прокси.
+func startSupervisedProxy(t *testing.T, config *ProxyConfig) *ProxyServer {
+	t.Helper()
+	config.LogLevel = "error"
+	config.LogPath = ""
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxyServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.sshConfig, err = newSSHClientConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if p.sshDialer, err = newSSHDialer(config); err != nil {
+		t.Fatal(err)
+	}
+	client, err := p.dialSSH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.sshClient = client
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.superviseSSH()
+	}()
+	t.Cleanup(func() {
+		p.cancel()
+		p.wg.Wait()
+		p.clientLock.Lock()
+		if p.sshClient != nil {
+			p.sshClient.Close()
+		}
+		p.clientLock.Unlock()
+	})
+	return p
+}
+
+// waitState ждёт состояния, для которого ok возвращает true.
+func waitState(t *testing.T, p *ProxyServer, ok func(SSHStateChange) bool) SSHStateChange {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		state, changed := p.supervisor.state()
+		if ok(state) {
+			return state
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("state did not change, last: %+v", state)
+		}
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	jitter := 0.5
+	c := ReconnectConfig{
+		InitialInterval: Duration(time.Second),
+		MaxInterval:     Duration(10 * time.Second),
+		Jitter:          &jitter,
+	}.withDefaults()
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		attempt := i + 1
+		for j := 0; j < 100; j++ {
+			d := c.delay(attempt)
+			if d > want || d < want/2 {
+				t.Fatalf("attempt %d: delay %v, want between %v and %v", attempt, d, want/2, want)
+			}
+		}
+	}
+}
+
+func TestReconnectDelayNoJitter(t *testing.T) {
+	// Явный 0 отключает разброс, а не подставляет значение по умолчанию
+	var jitter float64
+	c := ReconnectConfig{InitialInterval: Duration(time.Second), Jitter: &jitter}.withDefaults()
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if d := c.delay(i + 1); d != want {
+			t.Errorf("attempt %d: delay %v, want %v", i+1, d, want)
+		}
+	}
+	if c := (ReconnectConfig{}).withDefaults(); c.Jitter == nil || *c.Jitter != defaultReconnectJitter {
+		t.Errorf("default jitter %v", c.Jitter)
+	}
+}
+
+func TestReconnectValidate(t *testing.T) {
+	invalidJitter := 1.5
+	for _, c := range []ReconnectConfig{
+		{InitialInterval: Duration(-time.Second)},
+		{InitialInterval: Duration(time.Minute), MaxInterval: Duration(time.Second)},
+		{Multiplier: 0.5},
+		{Jitter: &invalidJitter},
+		{MaxAttempts: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+	if err := (ReconnectConfig{}).Validate(); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+}
+
+func TestSSHReconnect(t *testing.T) {
+	sw := startSSHSwitch(t, startSSHServer(t))
+	config := testTransportConfig(sw.addr, SSHTransport{})
+	config.Reconnect = ReconnectConfig{
+		InitialInterval:   Duration(10 * time.Millisecond),
+		MaxInterval:       Duration(50 * time.Millisecond),
+		KeepaliveInterval: Duration(20 * time.Millisecond),
+	}
+	p := startSupervisedProxy(t, config)
+
+	var lock sync.Mutex
+	maxAttempt := 0
+	cancel := p.OnSSHStateChange(func(s SSHStateChange) {
+		lock.Lock()
+		if s.Attempt > maxAttempt {
+			maxAttempt = s.Attempt
+		}
+		lock.Unlock()
+	})
+	defer cancel()
+
+	sw.set(false)
+	waitState(t, p, func(s SSHStateChange) bool { return s.Attempt >= 3 })
+
+	// Ожидающие соединения не подключаются сами
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.getConnectedSSHClient(ctx)
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	sw.set(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitState(t, p, func(s SSHStateChange) bool { return s.State == SSHStateConnected })
+	lock.Lock()
+	defer lock.Unlock()
+	if refused := sw.refusedCount(); refused != maxAttempt {
+		t.Errorf("%d connections while the server was down, but %d failed attempts: reconnects overlapped", refused, maxAttempt)
+	}
+	if p.reconnects.Load() != 1 {
+		t.Errorf("reconnects = %d, want 1", p.reconnects.Load())
+	}
+}
+
+func TestSSHReconnectNetworkChanged(t *testing.T) {
+	sw := startSSHSwitch(t, startSSHServer(t))
+	config := testTransportConfig(sw.addr, SSHTransport{})
+	config.Reconnect = ReconnectConfig{
+		InitialInterval:   Duration(time.Hour),
+		KeepaliveInterval: Duration(20 * time.Millisecond),
+	}
+	p := startSupervisedProxy(t, config)
+
+	sw.set(false)
+	state := waitState(t, p, func(s SSHStateChange) bool { return s.Attempt == 1 })
+	if until := time.Until(state.NextRetry); until < 30*time.Minute {
+		t.Fatalf("next retry in %v, want about an hour", until)
+	}
+
+	sw.set(true)
+	p.NetworkChanged()
+	waitState(t, p, func(s SSHStateChange) bool { return s.State == SSHStateConnected })
+}
+
+func TestSSHReconnectAuthRetry(t *testing.T) {
+	sw := startSSHSwitch(t, startSSHServer(t))
+	config := testTransportConfig(sw.addr, SSHTransport{})
+	config.Reconnect = ReconnectConfig{
+		InitialInterval:   Duration(10 * time.Millisecond),
+		MaxInterval:       Duration(300 * time.Millisecond),
+		KeepaliveInterval: Duration(20 * time.Millisecond),
+	}
+	p := startSupervisedProxy(t, config)
+
+	// Отказ в авторизации повторяется с паузой max_interval
+	setSSHPassword(t, p, "wrong")
+	sw.set(false)
+	sw.set(true)
+	state := waitState(t, p, func(s SSHStateChange) bool { return !s.NextRetry.IsZero() })
+	if state.State != SSHStateReconnecting || !strings.Contains(state.LastError, "unable to authenticate") {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if wait := time.Until(state.NextRetry); wait < 200*time.Millisecond {
+		t.Errorf("next retry in %v, want max_interval", wait)
+	}
+
+	// Исправленный секрет подхватывается следующей попыткой сам
+	setSSHPassword(t, p, testSSHPassword)
+	waitState(t, p, func(s SSHStateChange) bool { return s.State == SSHStateConnected })
+}
+
+func TestSSHReconnectAuthFailed(t *testing.T) {
+	sw := startSSHSwitch(t, startSSHServer(t))
+	config := testTransportConfig(sw.addr, SSHTransport{})
+	config.Reconnect = ReconnectConfig{
+		InitialInterval:   Duration(10 * time.Millisecond),
+		KeepaliveInterval: Duration(20 * time.Millisecond),
+		StopOnAuthError:   true,
+	}
+	p := startSupervisedProxy(t, config)
+
+	// С stop_on_auth_error отказ в авторизации прекращает попытки
+	setSSHPassword(t, p, "wrong")
+	sw.set(false)
+	sw.set(true)
+	state := waitState(t, p, func(s SSHStateChange) bool { return s.State == SSHStateFailed })
+	if state.Attempt != 1 || !strings.Contains(state.LastError, "unable to authenticate") {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if _, err := p.getConnectedSSHClient(context.Background()); err == nil {
+		t.Fatal("expected an error in the failed state")
+	}
+
+	// Явный запрос возобновляет попытки
+	setSSHPassword(t, p, testSSHPassword)
+	if err := p.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if state := p.SSHState(); state.State != SSHStateConnected {
+		t.Fatalf("state %q after Reconnect", state.State)
+	}
+}
+
+// setSSHPassword меняет пароль, с которым подключается p.
+func setSSHPassword(t *testing.T, p *ProxyServer, password string) {
+	t.Helper()
+	config := *p.currentConfig()
+	config.SSHPassword = password
+	sshConfig, err := newSSHClientConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.configLock.Lock()
+	p.sshConfig = sshConfig
+	p.configLock.Unlock()
+}
@@ -0,0 +1,521 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Реестр соединений. Каждое проксируемое соединение (SOCKS5, HTTP,
+// CONNECT, пробросы) регистрируется до подключения к назначению и
+// удаляется при закрытии, попадая в ограниченную историю. Число записей
+// в реестре и есть число активных соединений для лимита и статистики.
+
+const connHistorySize = 200
+
+var (
+	errConnectionNotFound = errors.New("connection not found")
+	errConnectionClosed   = errors.New("connection closed")
+)
+
+// ConnectionLimits - ограничения числа одновременных соединений,
+// 0 - без ограничения. Per* считаются для каждого клиента (IP адреса),
+// пользователя прокси и хоста назначения по отдельности.
+type ConnectionLimits struct {
+	Max            int `json:"max"`
+	PerClient      int `json:"per_client,omitempty"`
+	PerUser        int `json:"per_user,omitempty"`
+	PerDestination int `json:"per_destination,omitempty"`
+	// Сколько новое соединение ждёт свободного места, прежде чем
+	// получить отказ; 0 - отказ сразу
+	QueueTimeout Duration `json:"queue_timeout,omitempty"`
+}
+
+func (l ConnectionLimits) forScope(scope string) int {
+	switch scope {
+	case "client":
+		return l.PerClient
+	case "user":
+		return l.PerUser
+	case "destination":
+		return l.PerDestination
+	}
+	return l.Max
+}
+
+func (l ConnectionLimits) validate() error {
+	if l.Max < 0 || l.PerClient < 0 || l.PerUser < 0 || l.PerDestination < 0 || l.QueueTimeout < 0 {
+		return errors.New("connection_limits: values must not be negative")
+	}
+	return nil
+}
+
+// limitError - превышен лимит соединений.
+type limitError struct {
+	scope string // total, client, user или destination
+	max   int
+}
+
+func (e *limitError) Error() string {
+	if e.scope == "total" {
+		return "connection limit reached"
+	}
+	return fmt.Sprintf("per-%s connection limit reached", e.scope)
+}
+
+// limitKeys возвращает клиента, пользователя и хост назначения соединения
+// для лимитов соединений и скорости.
+func limitKeys(info connInfo) []limitKey {
+	var keys []limitKey
+	if host, _, err := net.SplitHostPort(info.Client); err == nil {
+		keys = append(keys, limitKey{"client", host})
+	}
+	if info.User != "" {
+		keys = append(keys, limitKey{"user", info.User})
+	}
+	if host, _, err := net.SplitHostPort(info.Target); err == nil {
+		keys = append(keys, limitKey{"destination", strings.ToLower(host)})
+	}
+	return keys
+}
+
+// connInfo описывает проксируемое соединение для журнала и статистики.
+type connInfo struct {
+	ID       uint64
+	Protocol string
+	Client   string
+	// User - пользователь прокси, если включена авторизация
+	User   string
+	Target string
+	// Rule - сработавшее правило маршрутизации, пусто для маршрута по умолчанию
+	Rule string
+	// Upstream - "direct" или адрес SSH сервера, через который идёт соединение
+	Upstream string
+}
+
+// ConnectionInfo - соединение в /connections и истории.
+type ConnectionInfo struct {
+	ID         uint64     `json:"id"`
+	Protocol   string     `json:"protocol"`
+	Client     string     `json:"client,omitempty"`
+	User       string     `json:"user,omitempty"`
+	Target     string     `json:"target"`
+	Rule       string     `json:"rule,omitempty"`
+	Upstream   string     `json:"upstream,omitempty"`
+	Sent       int64      `json:"sent"`
+	Received   int64      `json:"received"`
+	Started    time.Time  `json:"started"`
+	Closed     *time.Time `json:"closed,omitempty"`
+	AgeSeconds float64    `json:"age_seconds"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// trackedConn - запись реестра и одновременно соединение с назначением.
+// Создаётся до подключения (Conn == nil), соединение привязывается attach.
+// Считает переданные байты и при закрытии пишет итог в журнал.
+type trackedConn struct {
+	net.Conn
+	info     connInfo
+	start    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	// Корзины ограничения скорости, см. ratelimit.go
+	limits []*limitBuckets
+	// Таймауты слушателя и правила, см. timeouts.go
+	listenerTimeouts *Timeouts
+	ruleTimeouts     *Timeouts
+
+	lock   sync.Mutex
+	closed bool
+	err    string
+	once   sync.Once
+	done   chan struct{}
+	// Соединение клиента, закрывается вместе с этим (см. splice)
+	peer net.Conn
+	p    *ProxyServer
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	limited := c.p.limiter.active()
+	if limited && len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+	c.p.metrics.bytesIn.Add(int64(n))
+	if limited && n > 0 && !c.throttle(n, false) && err == nil {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	if !c.p.limiter.active() {
+		n, err := c.Conn.Write(b)
+		c.sent.Add(int64(n))
+		c.p.metrics.bytesOut.Add(int64(n))
+		return n, err
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		if !c.throttle(len(chunk), true) {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		c.sent.Add(int64(n))
+		c.p.metrics.bytesOut.Add(int64(n))
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// setRoute запоминает решение маршрутизации. Вызывается до attach, но
+// соединение уже видно в /connections, поэтому поля меняются под lock.
+func (c *trackedConn) setRoute(decision routeDecision) {
+	var upstream string
+	if decision.Action != RouteBlock {
+		upstream = c.p.upstreamName(decision.Action)
+	}
+	c.lock.Lock()
+	c.info.Rule = decision.Rule
+	c.info.Upstream = upstream
+	c.ruleTimeouts = decision.timeouts
+	c.lock.Unlock()
+}
+
+// logger возвращает логгер с полями соединения.
+func (c *trackedConn) logger() *slog.Logger {
+	return c.p.connLogger(c.info)
+}
+
+// attach привязывает установленное соединение к записи. Если запись
+// уже закрыта (остановка прокси или DELETE /connections), conn закрывается.
+func (c *trackedConn) attach(conn net.Conn) error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		conn.Close()
+		return errConnectionClosed
+	}
+	c.limits = c.p.limiter.acquire(c.info)
+	c.Conn = conn
+	c.lock.Unlock()
+
+	c.p.metrics.connection(c.info.Protocol, resultSuccess)
+	c.logger().Debug("Connected")
+	go c.watchTimeouts(c.timeouts())
+	return nil
+}
+
+// setPeer задаёт соединение клиента, которое закрывается вместе с этим:
+// при простое или DELETE /connections туннель закрывается целиком.
+func (c *trackedConn) setPeer(conn net.Conn) {
+	c.lock.Lock()
+	closed := c.closed
+	c.peer = conn
+	c.lock.Unlock()
+	if closed {
+		conn.Close()
+	}
+}
+
+// fail закрывает запись, к которой так и не было привязано соединение.
+func (c *trackedConn) fail(err error) {
+	c.p.metrics.connection(c.info.Protocol, dialResult(err))
+	c.lock.Lock()
+	c.err = err.Error()
+	c.lock.Unlock()
+	c.Close()
+}
+
+func (c *trackedConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	conn, peer := c.Conn, c.peer
+	c.lock.Unlock()
+
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	if peer != nil {
+		peer.Close()
+	}
+	c.once.Do(func() {
+		close(c.done)
+		c.p.conns.remove(c)
+		if c.limits != nil {
+			c.p.limiter.release(c.limits)
+		}
+		if conn != nil {
+			c.logger().Info("Connection closed",
+				"sent", c.sent.Load(),
+				"received", c.received.Load(),
+				"duration", time.Since(c.start).Round(time.Millisecond))
+		}
+	})
+	return err
+}
+
+func (c *trackedConn) snapshot() ConnectionInfo {
+	c.lock.Lock()
+	errText, rule, upstream := c.err, c.info.Rule, c.info.Upstream
+	c.lock.Unlock()
+	return ConnectionInfo{
+		ID:         c.info.ID,
+		Protocol:   c.info.Protocol,
+		Client:     c.info.Client,
+		User:       c.info.User,
+		Target:     c.info.Target,
+		Rule:       rule,
+		Upstream:   upstream,
+		Sent:       c.sent.Load(),
+		Received:   c.received.Load(),
+		Started:    c.start,
+		AgeSeconds: time.Since(c.start).Seconds(),
+		Error:      errText,
+	}
+}
+
+type connRegistry struct {
+	lock   sync.Mutex
+	nextID uint64
+	active map[uint64]*trackedConn
+	// Число активных соединений по клиентам, пользователям и назначениям
+	counts map[limitKey]int
+	// freed закрывается и заменяется, когда освобождается место
+	freed   chan struct{}
+	history []ConnectionInfo
+	next    int
+	full    bool
+	count   atomic.Int32
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		active:  make(map[uint64]*trackedConn),
+		counts:  make(map[limitKey]int),
+		freed:   make(chan struct{}),
+		history: make([]ConnectionInfo, connHistorySize),
+	}
+}
+
+// add регистрирует соединение, если это позволяют limits. Если задан
+// QueueTimeout, ждёт освобождения места не дольше него или до отмены ctx.
+func (r *connRegistry) add(ctx context.Context, c *trackedConn, limits ConnectionLimits) error {
+	keys := limitKeys(c.info)
+	var timeout <-chan time.Time
+	for {
+		r.lock.Lock()
+		err := r.check(keys, limits)
+		if err == nil {
+			r.nextID++
+			c.info.ID = r.nextID
+			r.active[c.info.ID] = c
+			for _, key := range keys {
+				r.counts[key]++
+			}
+			r.count.Store(int32(len(r.active)))
+			r.lock.Unlock()
+			return nil
+		}
+		freed := r.freed
+		r.lock.Unlock()
+
+		if limits.QueueTimeout <= 0 {
+			return err
+		}
+		if timeout == nil {
+			timer := time.NewTimer(time.Duration(limits.QueueTimeout))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// check проверяет лимиты для нового соединения. Вызывается под lock.
+func (r *connRegistry) check(keys []limitKey, limits ConnectionLimits) error {
+	if limits.Max > 0 && len(r.active) >= limits.Max {
+		return &limitError{scope: "total", max: limits.Max}
+	}
+	for _, key := range keys {
+		if max := limits.forScope(key.scope); max > 0 && r.counts[key] >= max {
+			return &limitError{scope: key.scope, max: max}
+		}
+	}
+	return nil
+}
+
+// wake будит ожидающих места, например после изменения лимитов.
+func (r *connRegistry) wake() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	close(r.freed)
+	r.freed = make(chan struct{})
+}
+
+func (r *connRegistry) remove(c *trackedConn) {
+	info := c.snapshot()
+	now := time.Now()
+	info.Closed = &now
+	info.AgeSeconds = now.Sub(info.Started).Seconds()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.active, c.info.ID)
+	for _, key := range limitKeys(c.info) {
+		if r.counts[key]--; r.counts[key] <= 0 {
+			delete(r.counts, key)
+		}
+	}
+	r.count.Store(int32(len(r.active)))
+	close(r.freed)
+	r.freed = make(chan struct{})
+
+	r.history[r.next] = info
+	r.next = (r.next + 1) % len(r.history)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// activeCount возвращает число активных соединений.
+func (r *connRegistry) activeCount() int32 {
+	return r.count.Load()
+}
+
+func (r *connRegistry) list() []*trackedConn {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	conns := make([]*trackedConn, 0, len(r.active))
+	for _, c := range r.active {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].info.ID < conns[j].info.ID
+	})
+	return conns
+}
+
+func (r *connRegistry) get(id uint64) *trackedConn {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.active[id]
+}
+
+// closed возвращает историю закрытых соединений, последние в конце.
+func (r *connRegistry) closed() []ConnectionInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]ConnectionInfo(nil), r.history[:r.next]...)
+	}
+	return append(append([]ConnectionInfo(nil), r.history[r.next:]...), r.history[:r.next]...)
+}
+
+// openConn регистрирует новое соединение до подключения к назначению.
+// При превышении лимита возвращает *limitError.
+func (p *ProxyServer) openConn(ctx context.Context, protocol, client, user, target string) (*trackedConn, error) {
+	c := &trackedConn{
+		info:  connInfo{Protocol: protocol, Client: client, User: user, Target: target},
+		start: time.Now(),
+		done:  make(chan struct{}),
+		p:     p,
+	}
+	if err := p.conns.add(ctx, c, p.currentConfig().ConnectionLimits); err != nil {
+		p.metrics.connection(protocol, resultLimit)
+		if le, ok := err.(*limitError); ok {
+			p.connLogger(c.info).Warn("Connection limit reached", "limit", le.scope, "max", le.max)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+type trackedConnKey struct{}
+
+func withTrackedConn(ctx context.Context, c *trackedConn) context.Context {
+	return context.WithValue(ctx, trackedConnKey{}, c)
+}
+
+// socksConn возвращает соединение, зарегистрированное в socksRules.Allow,
+// или регистрирует новое.
+func (p *ProxyServer) socksConn(ctx context.Context, protocol, addr string) (*trackedConn, error) {
+	if c, ok := ctx.Value(trackedConnKey{}).(*trackedConn); ok {
+		return c, nil
+	}
+	return p.openConn(ctx, protocol, clientAddrFromContext(ctx), clientUserFromContext(ctx), addr)
+}
+
+// Connections возвращает активные соединения в порядке открытия.
+func (p *ProxyServer) Connections() []ConnectionInfo {
+	conns := p.conns.list()
+	infos := make([]ConnectionInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.snapshot()
+	}
+	return infos
+}
+
+// ClosedConnections возвращает последние закрытые соединения
+// (не более connHistorySize), последние в конце.
+func (p *ProxyServer) ClosedConnections() []ConnectionInfo {
+	return p.conns.closed()
+}
+
+// CloseConnection принудительно закрывает соединение с номером id.
+func (p *ProxyServer) CloseConnection(id uint64) error {
+	c := p.conns.get(id)
+	if c == nil {
+		return errConnectionNotFound
+	}
+	c.logger().Info("Connection closed by admin request")
+	c.lock.Lock()
+	c.err = "closed by admin request"
+	c.lock.Unlock()
+	return c.Close()
+}
+
+// connLogger возвращает логгер с полями соединения.
+func (p *ProxyServer) connLogger(info connInfo) *slog.Logger {
+	var attrs []any
+	if info.ID != 0 {
+		attrs = append(attrs, "conn", info.ID)
+	}
+	attrs = append(attrs, "proto", info.Protocol, "target", info.Target)
+	if info.Client != "" {
+		attrs = append(attrs, "client", info.Client)
+	}
+	if info.User != "" {
+		attrs = append(attrs, "user", info.User)
+	}
+	if info.Rule != "" {
+		attrs = append(attrs, "rule", info.Rule)
+	}
+	if info.Upstream != "" {
+		attrs = append(attrs, "upstream", info.Upstream)
+	}
+	return p.Logger().With(attrs...)
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// openTestConn регистрирует соединение и привязывает к нему конец
+// net.Pipe; второй конец играет роль назначения.
+func openTestConn(t *testing.T, p *ProxyServer, client, target string) (*trackedConn, net.Conn) {
+	t.Helper()
+	tc, err := p.openConn(context.Background(), protoSOCKS5, client, "", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	if err := tc.attach(local); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		remote.Close()
+		tc.Close()
+	})
+	return tc, remote
+}
+
+func TestConnRegistry(t *testing.T) {
+	p := newBenchServer()
+	a, remote := openTestConn(t, p, "10.0.0.1:5000", "example.com:443")
+	b, _ := openTestConn(t, p, "10.0.0.2:5000", "example.org:80")
+	if a.info.ID == 0 || b.info.ID != a.info.ID+1 {
+		t.Fatalf("ids %d, %d", a.info.ID, b.info.ID)
+	}
+
+	go remote.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(a, buf); err != nil {
+		t.Fatal(err)
+	}
+	go io.ReadFull(remote, make([]byte, 3))
+	if _, err := a.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := p.Connections()
+	if len(conns) != 2 || conns[0].ID != a.info.ID || conns[1].ID != b.info.ID {
+		t.Fatalf("connections: %+v", conns)
+	}
+	if conns[0].Received != 5 || conns[0].Sent != 3 || conns[0].Target != "example.com:443" {
+		t.Errorf("accounting: %+v", conns[0])
+	}
+
+	if err := p.CloseConnection(a.info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CloseConnection(a.info.ID); err != errConnectionNotFound {
+		t.Errorf("second close: %v", err)
+	}
+	if conns := p.Connections(); len(conns) != 1 || conns[0].ID != b.info.ID {
+		t.Errorf("connections after close: %+v", conns)
+	}
+	closed := p.ClosedConnections()
+	if len(closed) != 1 || closed[0].ID != a.info.ID || closed[0].Closed == nil ||
+		closed[0].Received != 5 || closed[0].Error != "closed by admin request" {
+		t.Errorf("history: %+v", closed)
+	}
+	if n := p.conns.activeCount(); n != 1 {
+		t.Errorf("active count %d", n)
+	}
+}
+
+func TestConnHistoryRing(t *testing.T) {
+	p := newBenchServer()
+	total := connHistorySize + 5
+	var first uint64
+	for i := 0; i < total; i++ {
+		tc, err := p.openConn(context.Background(), protoHTTP, "10.0.0.1:5000", "", fmt.Sprintf("host%d:80", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = tc.info.ID
+		}
+		tc.Close()
+
+		if i == 2 {
+			if closed := p.ClosedConnections(); len(closed) != 3 || closed[2].Target != "host2:80" {
+				t.Fatalf("history before wrap: %+v", closed)
+			}
+		}
+	}
+
+	// Хранятся последние connHistorySize, старые вытеснены, порядок - по закрытию
+	closed := p.ClosedConnections()
+	if len(closed) != connHistorySize {
+		t.Fatalf("history size %d", len(closed))
+	}
+	for i, info := range closed {
+		if want := first + uint64(total-connHistorySize+i); info.ID != want {
+			t.Fatalf("history[%d] id %d, want %d", i, info.ID, want)
+		}
+	}
+	if len(p.Connections()) != 0 {
+		t.Error("closed connections still active")
+	}
+}
+
+func setConnectionLimits(p *ProxyServer, limits ConnectionLimits) {
+	config := *p.config
+	config.ConnectionLimits = limits
+	p.config = &config
+}
+
+func TestConnectionLimits(t *testing.T) {
+	p := newBenchServer()
+	setConnectionLimits(p, ConnectionLimits{Max: 3, PerClient: 2, PerDestination: 1})
+
+	open := func(client, target string) error {
+		tc, err := p.openConn(context.Background(), protoSOCKS5, client, "", target)
+		if err == nil {
+			t.Cleanup(func() { tc.Close() })
+		}
+		return err
+	}
+	for _, tt := range []struct {
+		client, target string
+		scope          string
+	}{
+		{"10.0.0.1:1", "a.example:443", ""},
+		{"10.0.0.1:2", "A.example:80", "destination"},
+		{"10.0.0.1:3", "b.example:443", ""},
+		{"10.0.0.1:4", "c.example:443", "client"},
+		{"10.0.0.2:1", "c.example:443", ""},
+		{"10.0.0.3:1", "d.example:443", "total"},
+	} {
+		err := open(tt.client, tt.target)
+		le, _ := err.(*limitError)
+		switch {
+		case tt.scope == "" && err != nil:
+			t.Errorf("%s -> %s: %v", tt.client, tt.target, err)
+		case tt.scope != "" && (le == nil || le.scope != tt.scope):
+			t.Errorf("%s -> %s: %v, want per-%s limit", tt.client, tt.target, err, tt.scope)
+		}
+	}
+}
+
+func TestConnectionLimitQueue(t *testing.T) {
+	p := newBenchServer()
+	setConnectionLimits(p, ConnectionLimits{PerClient: 1, QueueTimeout: Duration(5 * time.Second)})
+
+	first, err := p.openConn(context.Background(), protoSOCKS5, "10.0.0.1:1", "", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted := make(chan error, 1)
+	go func() {
+		tc, err := p.openConn(context.Background(), protoSOCKS5, "10.0.0.1:2", "", "example.com:443")
+		if err == nil {
+			defer tc.Close()
+		}
+		admitted <- err
+	}()
+
+	// Ожидающее соединение проходит, как только первое закрыто
+	select {
+	case err := <-admitted:
+		t.Fatalf("admitted while the limit is reached: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Fatalf("queued connection: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued connection not admitted after release")
+	}
+}
+
+func TestConnectionLimitQueueTimeout(t *testing.T) {
+	p := newBenchServer()
+	setConnectionLimits(p, ConnectionLimits{Max: 1, QueueTimeout: Duration(100 * time.Millisecond)})
+
+	tc, err := p.openConn(context.Background(), protoSOCKS5, "10.0.0.1:1", "", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	start := time.Now()
+	_, err = p.openConn(context.Background(), protoSOCKS5, "10.0.0.2:1", "", "example.org:443")
+	if le, ok := err.(*limitError); !ok || le.scope != "total" {
+		t.Fatalf("queue timeout: %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("refused after %v, want about 100ms", d)
+	}
+
+	// Отменённый контекст (клиент ушёл) снимает соединение с очереди
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	if _, err := p.openConn(ctx, protoSOCKS5, "10.0.0.2:2", "", "example.org:443"); err == nil {
+		t.Fatal("admitted with a canceled context")
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("canceled wait took %v", d)
+	}
+
+	// Без очереди отказ сразу
+	setConnectionLimits(p, ConnectionLimits{Max: 1})
+	start = time.Now()
+	if _, err := p.openConn(context.Background(), protoSOCKS5, "10.0.0.2:3", "", "example.org:443"); err == nil {
+		t.Fatal("admitted over the limit")
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("refusal without a queue took %v", d)
+	}
+}
+
+func TestConnSetRouteWhileListed(t *testing.T) {
+	p := newBenchServer()
+	tc, err := p.openConn(context.Background(), protoHTTP, "10.0.0.1:5000", "", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	// Соединение видно в /connections до выбора маршрута (проверяется с -race)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.Connections()
+		}
+	}()
+	tc.setRoute(routeDecision{Rule: "db", Action: RouteDirect})
+	<-done
+	if conns := p.Connections(); len(conns) != 1 || conns[0].Rule != "db" || conns[0].Upstream == "" {
+		t.Errorf("connections: %+v", conns)
+	}
+}
@@ -0,0 +1,477 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// currentConfig возвращает действующую конфигурацию. После Reload
+// p.config заменяется целиком, поэтому читать его нужно через эту функцию.
+func (p *ProxyServer) currentConfig() *ProxyConfig {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.config
+}
+
+// Config возвращает действующую конфигурацию (с учётом перезагрузок).
+// Возвращённое значение нельзя изменять, для изменений есть Reload.
+func (p *ProxyServer) Config() *ProxyConfig {
+	return p.currentConfig()
+}
+
+func (p *ProxyServer) currentRouter() *router {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.router
+}
+
+// SetConfigLoader задаёт функцию, которой ReloadConfig перечитывает
+// конфигурацию (по SIGHUP или через POST /reload на сервере администрирования).
+func (p *ProxyServer) SetConfigLoader(loader func() (*ProxyConfig, error)) {
+	p.configLock.Lock()
+	p.configLoader = loader
+	p.configLock.Unlock()
+}
+
+// ReloadConfig перечитывает конфигурацию и применяет изменения.
+func (p *ProxyServer) ReloadConfig() error {
+	p.configLock.RLock()
+	loader := p.configLoader
+	p.configLock.RUnlock()
+
+	if loader == nil {
+		return errors.New("config reload is not configured")
+	}
+	config, err := loader()
+	if err != nil {
+		return err
+	}
+	return p.Reload(config)
+}
+
+// Reload применяет новую конфигурацию без остановки прокси. Установленные
+// соединения продолжают работать: добавляются и удаляются только изменившиеся
+// слушатели, а при смене SSH сервера новые соединения идут через новый
+// клиент, старый закрывается после завершения своих соединений.
+func (p *ProxyServer) Reload(config *ProxyConfig) error {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	sshConfig, err := newSSHClientConfig(config)
+	if err != nil {
+		return err
+	}
+	dialer, err := newSSHDialer(config)
+	if err != nil {
+		return err
+	}
+	// Файлы списков и геобазы перечитываются при каждой перезагрузке
+	router, err := newRouter(config)
+	if err != nil {
+		return err
+	}
+
+	old := p.currentConfig()
+	var changes []string
+
+	if old.AdminAddr != config.AdminAddr {
+		p.logWarn("admin_addr change takes effect after restart")
+	}
+	if old.AdminToken != config.AdminToken {
+		// admin сервер остаётся на прежнем адресе до перезапуска
+		if config.AdminToken == "" && old.AdminAddr != "" && !isLoopback(old.AdminAddr) {
+			return fmt.Errorf("admin_token: required while the admin server listens on %s", old.AdminAddr)
+		}
+		changes = append(changes, "admin token")
+	}
+
+	if logSettingsChanged(old, config) {
+		logger, logFile, err := newLogger(config, p.logs)
+		if err != nil {
+			return err
+		}
+		p.setLogger(logger, logFile)
+		changes = append(changes, "logging")
+	}
+
+	// Новый SSH клиент поднимаем заранее: если он не подключится,
+	// конфигурация не меняется вовсе
+	var newClient *ssh.Client
+	if upstreamChanged(old, config) {
+		newClient, err = dialSSHWith(dialer, config.SSHHost+":"+config.SSHPort, sshConfig)
+		if err != nil {
+			return fmt.Errorf("failed to connect to new SSH server: %v", err)
+		}
+		changes = append(changes, fmt.Sprintf("SSH server %s@%s:%s (%s)", config.SSHUser, config.SSHHost, config.SSHPort, config.SSHTransport))
+	} else if credentialsChanged(old, config) {
+		changes = append(changes, "SSH credentials")
+	}
+	if old.SSHAlgorithms.String() != config.SSHAlgorithms.String() {
+		// Действуют с переподключения, как и новые учётные данные
+		changes = append(changes, "SSH algorithms")
+	}
+
+	p.configLock.Lock()
+	p.config = config
+	p.sshConfig = sshConfig
+	p.sshDialer = dialer
+	p.router = router
+	p.proxyType = config.ProxyType
+	p.configLock.Unlock()
+
+	if old.Reconnect.String() != config.Reconnect.String() {
+		changes = append(changes, "reconnect")
+	}
+	// Новые настройки - повод не ждать конца паузы и выйти из failed
+	if state := p.SSHState(); state.State != SSHStateConnected && newClient == nil {
+		p.supervisor.kick()
+	}
+	if !rulesEqual(old.Rules, config.Rules) {
+		changes = append(changes, fmt.Sprintf("%d routing rules", len(config.Rules)))
+	}
+	if old.Timeouts.String() != config.Timeouts.String() {
+		changes = append(changes, "timeouts")
+	}
+	if old.GeoIPPath != config.GeoIPPath || old.GeoSitePath != config.GeoSitePath {
+		changes = append(changes, "geo databases")
+	}
+	if !destFiltersEqual(old.DestinationFilter, config.DestinationFilter) {
+		changes = append(changes, "destination filter")
+	}
+	if old.ConnectionLimits != config.ConnectionLimits {
+		// Ожидающие в очереди перепроверят новые лимиты
+		p.conns.wake()
+		changes = append(changes, "connection limits")
+	}
+	if !rateLimitsEqual(old.RateLimits, config.RateLimits) {
+		p.limiter.set(config.RateLimits)
+		changes = append(changes, "rate limits")
+	}
+	if !proxyUsersEqual(old.ProxyUsers, config.ProxyUsers) {
+		changes = append(changes, fmt.Sprintf("%d proxy users", len(config.ProxyUsers)))
+	}
+
+	if newClient != nil {
+		p.switchSSHClient(newClient)
+	}
+
+	var errs []error
+	if !clientACLEqual(old.ClientACL, config.ClientACL) {
+		if err := p.proxyACL.update(config.ClientACL); err != nil {
+			errs = append(errs, fmt.Errorf("client_acl: %v", err))
+		} else {
+			changes = append(changes, "client ACL")
+		}
+	}
+	if !clientACLEqual(old.AdminACL, config.AdminACL) {
+		if err := p.adminACL.update(config.AdminACL); err != nil {
+			errs = append(errs, fmt.Errorf("admin_acl: %v", err))
+		} else {
+			changes = append(changes, "admin ACL")
+		}
+	}
+
+	// Набор методов авторизации SOCKS5 задаётся при создании сервера
+	authToggled := (len(old.ProxyUsers) == 0) != (len(config.ProxyUsers) == 0)
+	if old.LocalPort != config.LocalPort || old.ProxyType != config.ProxyType || authToggled {
+		p.stopMainListener()
+		if err := p.startMainListener(config); err != nil {
+			errs = append(errs, err)
+		}
+		changes = append(changes, fmt.Sprintf("%s listener on port %s", config.ProxyType, config.LocalPort))
+	}
+
+	changes = append(changes, p.reloadLocalForwards(config, &errs)...)
+	changes = append(changes, p.reloadRemoteForwards(old, config, &errs)...)
+
+	if len(changes) == 0 {
+		p.logMessage("Configuration reloaded, no changes")
+	} else {
+		p.logMessage("Configuration reloaded: " + strings.Join(changes, ", "))
+	}
+	return errors.Join(errs...)
+}
+
+func upstreamChanged(old, config *ProxyConfig) bool {
+	return old.SSHHost != config.SSHHost || old.SSHPort != config.SSHPort || old.SSHUser != config.SSHUser ||
+		!transportsEqual(old.SSHTransport, config.SSHTransport)
+}
+
+func transportsEqual(a, b SSHTransport) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func credentialsChanged(old, config *ProxyConfig) bool {
+	return old.SSHPassword != config.SSHPassword ||
+		old.SSHPasswordFrom != config.SSHPasswordFrom ||
+		old.KeyPath != config.KeyPath ||
+		old.KeyPassphraseFrom != config.KeyPassphraseFrom
+}
+
+// rulesEqual сравнивает и таймауты правил по значению, а не по указателю.
+// Пустой список и его отсутствие в файле равны.
+func rulesEqual(a, b []RouteRule) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+func proxyUsersEqual(a, b []ProxyUser) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+func destFiltersEqual(a, b DestinationFilter) bool {
+	return a.empty() && b.empty() || reflect.DeepEqual(a, b)
+}
+
+func (p *ProxyServer) reloadLocalForwards(config *ProxyConfig, errs *[]error) []string {
+	var changes []string
+	wanted := make(map[string]ForwardConfig, len(config.LocalForwards))
+	for _, f := range config.LocalForwards {
+		wanted[f.ListenAddr] = f
+	}
+
+	for _, f := range p.LocalForwards() {
+		if w, ok := wanted[f.ListenAddr]; !ok || w.TargetAddr != f.TargetAddr {
+			p.RemoveLocalForward(f.ListenAddr)
+			changes = append(changes, "-L "+f.String())
+		}
+	}
+	current := make(map[string]bool)
+	for _, f := range p.LocalForwards() {
+		current[f.ListenAddr] = true
+	}
+	for _, f := range config.LocalForwards {
+		if current[f.ListenAddr] {
+			// Список доступа меняется без переоткрытия порта
+			if changed, err := p.setLocalForwardACL(f); err != nil {
+				*errs = append(*errs, fmt.Errorf("local forward %s acl: %v", f, err))
+			} else if changed {
+				changes = append(changes, "-L "+f.ListenAddr+" ACL")
+			}
+			if p.setLocalForwardTimeouts(f) {
+				changes = append(changes, "-L "+f.ListenAddr+" timeouts")
+			}
+			continue
+		}
+		if err := p.addLocalForward(f); err != nil {
+			*errs = append(*errs, fmt.Errorf("local forward %s: %v", f, err))
+			continue
+		}
+		changes = append(changes, "+L "+f.String())
+	}
+	return changes
+}
+
+// reloadRemoteForwards обрабатывает -R и обратные SOCKS5 вместе: они делят
+// одно пространство адресов на стороне SSH сервера.
+func (p *ProxyServer) reloadRemoteForwards(old, config *ProxyConfig, errs *[]error) []string {
+	type remoteSpec struct {
+		target string
+		allow  string
+	}
+	specs := func(c *ProxyConfig) map[string]remoteSpec {
+		m := make(map[string]remoteSpec)
+		for _, f := range c.RemoteForwards {
+			m[f.ListenAddr] = remoteSpec{target: f.TargetAddr}
+		}
+		for _, rd := range c.ReverseDynamic {
+			m[rd.ListenAddr] = remoteSpec{target: "socks5", allow: strings.Join(rd.AllowDestinations, ",")}
+		}
+		return m
+	}
+	oldSpecs, newSpecs := specs(old), specs(config)
+
+	var changes []string
+	for addr, spec := range oldSpecs {
+		if newSpec, ok := newSpecs[addr]; !ok || newSpec != spec {
+			p.RemoveRemoteForward(addr)
+			changes = append(changes, "-R "+addr)
+		}
+	}
+	for _, f := range config.RemoteForwards {
+		if spec, ok := oldSpecs[f.ListenAddr]; ok && spec == newSpecs[f.ListenAddr] {
+			if p.setRemoteForwardTimeouts(f) {
+				changes = append(changes, "-R "+f.ListenAddr+" timeouts")
+			}
+			continue
+		}
+		if err := p.addRemoteForward(f); err != nil {
+			*errs = append(*errs, fmt.Errorf("remote forward %s: %v", f, err))
+			continue
+		}
+		changes = append(changes, "+R "+f.String())
+	}
+	for _, rd := range config.ReverseDynamic {
+		if spec, ok := oldSpecs[rd.ListenAddr]; ok && spec == newSpecs[rd.ListenAddr] {
+			continue
+		}
+		if err := p.AddReverseDynamic(rd.ListenAddr, rd.AllowDestinations); err != nil {
+			*errs = append(*errs, fmt.Errorf("reverse SOCKS5 on %s: %v", rd.ListenAddr, err))
+			continue
+		}
+		changes = append(changes, "+R "+rd.ListenAddr+" (socks5)")
+	}
+	return changes
+}
+
+// switchSSHClient делает client основным. Прежний клиент выводится из
+// работы: новые соединения через него не идут, а закрывается он после
+// завершения последнего соединения.
+func (p *ProxyServer) switchSSHClient(client *ssh.Client) {
+	p.clientLock.Lock()
+	old := p.sshClient
+	p.sshClient = client
+	p.clientLock.Unlock()
+	p.supervisor.set(SSHStateChange{State: SSHStateConnected})
+
+	go p.reestablishRemoteForwards(client)
+	if old != nil {
+		p.retireSSHClient(old)
+	}
+}
+
+func (p *ProxyServer) acquireSSHClient(client *ssh.Client) {
+	p.usersLock.Lock()
+	defer p.usersLock.Unlock()
+	if p.clientUsers == nil {
+		p.clientUsers = make(map[*ssh.Client]int)
+	}
+	p.clientUsers[client]++
+}
+
+func (p *ProxyServer) releaseSSHClient(client *ssh.Client) {
+	p.usersLock.Lock()
+	defer p.usersLock.Unlock()
+	p.clientUsers[client]--
+	if p.clientUsers[client] > 0 {
+		return
+	}
+	delete(p.clientUsers, client)
+	if p.retiredClients[client] {
+		delete(p.retiredClients, client)
+		client.Close()
+		p.logMessage("Retired SSH connection drained and closed")
+	}
+}
+
+func (p *ProxyServer) retireSSHClient(client *ssh.Client) {
+	p.usersLock.Lock()
+	defer p.usersLock.Unlock()
+	users := p.clientUsers[client]
+	if users == 0 {
+		client.Close()
+		return
+	}
+	if p.retiredClients == nil {
+		p.retiredClients = make(map[*ssh.Client]bool)
+	}
+	p.retiredClients[client] = true
+	p.logMessage(fmt.Sprintf("Old SSH connection is draining %d connections", users))
+}
+
+// sshClientCount возвращает число открытых SSH соединений: текущего
+// и выведенных из работы, у которых ещё есть соединения.
+func (p *ProxyServer) sshClientCount() int {
+	p.clientLock.Lock()
+	n := 0
+	if p.sshClient != nil {
+		n = 1
+	}
+	p.clientLock.Unlock()
+
+	p.usersLock.Lock()
+	defer p.usersLock.Unlock()
+	return n + len(p.retiredClients)
+}
+
+func (p *ProxyServer) closeRetiredSSHClients() {
+	p.usersLock.Lock()
+	defer p.usersLock.Unlock()
+	for client := range p.retiredClients {
+		client.Close()
+		delete(p.retiredClients, client)
+	}
+}
+
+// dialTunnel открывает соединение через текущий SSH клиент. Клиент
+// считается занятым, пока соединение не закрыто. ssh.Client.Dial не
+// принимает контекст, поэтому таймаут ctx отслеживается отдельно.
+func (p *ProxyServer) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := p.getConnectedSSHClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer p.metrics.observeDial(RouteTunnel, time.Now())
+	p.acquireSSHClient(client)
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	dialChan := make(chan dialResult, 1)
+	go func() {
+		conn, err := client.Dial(network, addr)
+		dialChan <- dialResult{conn, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// Канал может открыться уже после таймаута - закрываем его, и
+		// только тогда клиент освобождается
+		go func() {
+			if result := <-dialChan; result.conn != nil {
+				result.conn.Close()
+			}
+			p.releaseSSHClient(client)
+		}()
+		return nil, fmt.Errorf("dial timeout to %s:%s: %w", network, addr, ctx.Err())
+	case result := <-dialChan:
+		if result.err != nil {
+			p.metrics.channelOpenFailure(result.err)
+			p.releaseSSHClient(client)
+			return nil, result.err
+		}
+		return &sshClientConn{Conn: result.conn, release: func() { p.releaseSSHClient(client) }}, nil
+	}
+}
+
+type sshClientConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *sshClientConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite передаёт EOF назначению, канал SSH остаётся открытым на чтение.
+func (c *sshClientConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (p *ProxyServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := p.ReloadConfig(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func durationPtr(d time.Duration) *Duration {
+	v := Duration(d)
+	return &v
+}
+
+func TestReloadEqual(t *testing.T) {
+	rule := func(idle time.Duration) []RouteRule {
+		return []RouteRule{{Name: "db", Ports: []int{5432}, Action: RouteDirect, Timeouts: &Timeouts{Idle: durationPtr(idle)}}}
+	}
+	// Таймауты правил - указатели: равные значения из разных загрузок
+	// не должны считаться изменением
+	if !rulesEqual(rule(time.Minute), rule(time.Minute)) {
+		t.Error("equal rules with timeouts reported as changed")
+	}
+	if rulesEqual(rule(time.Minute), rule(time.Hour)) {
+		t.Error("changed rule timeout not detected")
+	}
+	if !rulesEqual(nil, []RouteRule{}) {
+		t.Error("nil and empty rules differ")
+	}
+
+	users := []ProxyUser{{"phone", "a"}}
+	if !proxyUsersEqual(users, []ProxyUser{{"phone", "a"}}) || proxyUsersEqual(users, []ProxyUser{{"phone", "b"}}) {
+		t.Error("proxy users comparison")
+	}
+	if !proxyUsersEqual(nil, []ProxyUser{}) {
+		t.Error("nil and empty users differ")
+	}
+
+	filter := DestinationFilter{Block: []string{"ads.example.com"}}
+	if !destFiltersEqual(filter, DestinationFilter{Block: []string{"ads.example.com"}}) {
+		t.Error("unchanged filter reported as changed")
+	}
+	if destFiltersEqual(filter, DestinationFilter{Allow: []string{"ads.example.com"}}) {
+		t.Error("changed filter not detected")
+	}
+	if !destFiltersEqual(DestinationFilter{}, DestinationFilter{Block: []string{}}) {
+		t.Error("empty filters differ")
+	}
+}
+
+func TestReloadChanges(t *testing.T) {
+	p := startSupervisedProxy(t, testTransportConfig(startSSHServer(t), SSHTransport{}))
+	sub, err := p.SubscribeLogs("info", "Configuration reloaded", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// reload применяет копию действующей конфигурации с изменениями
+	// и возвращает записанный в лог список изменений
+	reload := func(modify func(c *ProxyConfig)) string {
+		t.Helper()
+		config := *p.currentConfig()
+		modify(&config)
+		if err := p.Reload(&config); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case e := <-sub.C():
+			return strings.TrimPrefix(e.Message, "Configuration reloaded")
+		case <-time.After(2 * time.Second):
+			t.Fatal("no reload message")
+			return ""
+		}
+	}
+	rules := func() []RouteRule {
+		return []RouteRule{{Name: "db", Ports: []int{5432}, Action: RouteDirect, Timeouts: &Timeouts{Idle: durationPtr(0)}}}
+	}
+	filter := func() DestinationFilter {
+		return DestinationFilter{Block: []string{"ads.example.com"}}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		modify func(c *ProxyConfig)
+		want   string
+	}{
+		{"nothing", func(c *ProxyConfig) {}, ", no changes"},
+		{"rules", func(c *ProxyConfig) { c.Rules = rules() }, ": 1 routing rules"},
+		// Те же правила, загруженные заново
+		{"same rules", func(c *ProxyConfig) { c.Rules = rules() }, ", no changes"},
+		{"filter", func(c *ProxyConfig) { c.DestinationFilter = filter() }, ": destination filter"},
+		{"same filter", func(c *ProxyConfig) { c.DestinationFilter = filter() }, ", no changes"},
+		{"filter removed", func(c *ProxyConfig) { c.DestinationFilter = DestinationFilter{} }, ": destination filter"},
+		{"limits", func(c *ProxyConfig) {
+			c.ConnectionLimits.Max = 10
+			c.RateLimits = RateLimits{Global: Bandwidth{Download: 1 << 20}}
+		}, ": connection limits, rate limits"},
+		{"timeouts and token", func(c *ProxyConfig) {
+			c.Timeouts = Timeouts{Idle: durationPtr(time.Hour)}
+			c.AdminToken = "secret"
+		}, ": admin token, timeouts"},
+		{"reconnect", func(c *ProxyConfig) { c.Reconnect.MaxAttempts = 3 }, ": reconnect"},
+	} {
+		if got := reload(tt.modify); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
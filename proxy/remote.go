@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Состояния удалённого проброса
+const (
+	ForwardStateActive       = "active"
+	ForwardStateReconnecting = "reconnecting"
+	ForwardStateFailed       = "failed"
+)
+
+// ForwardStatus - состояние удалённого проброса для отображения в статусе.
+type ForwardStatus struct {
+	ListenAddr string `json:"listen"`
+	TargetAddr string `json:"target"`
+	State      string `json:"state"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// remoteForward - порт, открытый на стороне SSH сервера (tcpip-forward).
+// При переподключении SSH он переоткрывается на новом клиенте.
+type remoteForward struct {
+	config  ForwardConfig
+	handler func(conn net.Conn)
+
+	lock      sync.Mutex
+	listener  net.Listener
+	state     string
+	lastError string
+	removed   bool
+}
+
+func (f *remoteForward) status() ForwardStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return ForwardStatus{
+		ListenAddr: f.config.ListenAddr,
+		TargetAddr: f.config.TargetAddr,
+		State:      f.state,
+		LastError:  f.lastError,
+	}
+}
+
+// AddRemoteForward открывает listenAddr на SSH сервере и пробрасывает
+// входящие соединения на локальный targetAddr.
+func (p *ProxyServer) AddRemoteForward(listenAddr, targetAddr string) error {
+	return p.addRemoteForward(ForwardConfig{ListenAddr: listenAddr, TargetAddr: targetAddr})
+}
+
+func (p *ProxyServer) addRemoteForward(config ForwardConfig) error {
+	f := &remoteForward{config: config}
+	f.handler = func(conn net.Conn) {
+		p.handleRemoteForward(f, conn)
+	}
+	return p.addRemoteListener(f)
+}
+
+// RemoveRemoteForward закрывает порт на SSH сервере.
+func (p *ProxyServer) RemoveRemoteForward(listenAddr string) error {
+	p.forwardsLock.Lock()
+	f, exists := p.remoteForwards[listenAddr]
+	delete(p.remoteForwards, listenAddr)
+	p.forwardsLock.Unlock()
+
+	if !exists {
+		return fmt.Errorf("remote forward on %s %w", listenAddr, errForwardNotFound)
+	}
+
+	f.lock.Lock()
+	f.removed = true
+	if f.listener != nil {
+		f.listener.Close()
+		f.listener = nil
+	}
+	f.lock.Unlock()
+
+	p.logMessage(fmt.Sprintf("Remote forward removed: %s", f.config))
+	return nil
+}
+
+// setRemoteForwardTimeouts меняет таймауты открытого проброса для новых
+// соединений.
+func (p *ProxyServer) setRemoteForwardTimeouts(config ForwardConfig) bool {
+	p.forwardsLock.Lock()
+	f := p.remoteForwards[config.ListenAddr]
+	p.forwardsLock.Unlock()
+	if f == nil {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if reflect.DeepEqual(f.config.Timeouts, config.Timeouts) {
+		return false
+	}
+	f.config.Timeouts = config.Timeouts
+	return true
+}
+
+// RemoteForwards возвращает состояние всех удалённых пробросов.
+func (p *ProxyServer) RemoteForwards() []ForwardStatus {
+	p.forwardsLock.Lock()
+	forwards := make([]*remoteForward, 0, len(p.remoteForwards))
+	for _, f := range p.remoteForwards {
+		forwards = append(forwards, f)
+	}
+	p.forwardsLock.Unlock()
+
+	statuses := make([]ForwardStatus, 0, len(forwards))
+	for _, f := range forwards {
+		statuses = append(statuses, f.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ListenAddr < statuses[j].ListenAddr
+	})
+	return statuses
+}
+
+func (p *ProxyServer) addRemoteListener(f *remoteForward) error {
+	p.forwardsLock.Lock()
+	if _, exists := p.remoteForwards[f.config.ListenAddr]; exists {
+		p.forwardsLock.Unlock()
+		return fmt.Errorf("remote forward on %s %w", f.config.ListenAddr, errForwardExists)
+	}
+	if p.remoteForwards == nil {
+		p.remoteForwards = make(map[string]*remoteForward)
+	}
+	p.remoteForwards[f.config.ListenAddr] = f
+	p.forwardsLock.Unlock()
+
+	p.clientLock.Lock()
+	client := p.sshClient
+	p.clientLock.Unlock()
+
+	if client == nil {
+		// Порт откроется после переподключения
+		f.lock.Lock()
+		f.state = ForwardStateReconnecting
+		f.lock.Unlock()
+		return nil
+	}
+
+	if err := p.listenRemote(f, client); err != nil {
+		p.forwardsLock.Lock()
+		delete(p.remoteForwards, f.config.ListenAddr)
+		p.forwardsLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (p *ProxyServer) startRemoteForwards() error {
+	for _, f := range p.config.RemoteForwards {
+		if err := p.addRemoteForward(f); err != nil {
+			return fmt.Errorf("remote forward %s: %v", f, err)
+		}
+	}
+	return nil
+}
+
+func (p *ProxyServer) closeRemoteForwards() {
+	p.forwardsLock.Lock()
+	defer p.forwardsLock.Unlock()
+
+	for addr, f := range p.remoteForwards {
+		f.lock.Lock()
+		f.removed = true
+		if f.listener != nil {
+			f.listener.Close()
+			f.listener = nil
+		}
+		f.lock.Unlock()
+		delete(p.remoteForwards, addr)
+	}
+}
+
+// reestablishRemoteForwards переоткрывает удалённые порты на новом
+// SSH клиенте после переподключения.
+func (p *ProxyServer) reestablishRemoteForwards(client *ssh.Client) {
+	p.forwardsLock.Lock()
+	forwards := make([]*remoteForward, 0, len(p.remoteForwards))
+	for _, f := range p.remoteForwards {
+		forwards = append(forwards, f)
+	}
+	p.forwardsLock.Unlock()
+
+	for _, f := range forwards {
+		if err := p.listenRemote(f, client); err != nil {
+			p.logWarn(fmt.Sprintf("Failed to re-establish remote forward %s: %v", f.config, err))
+		}
+	}
+}
+
+func (p *ProxyServer) listenRemote(f *remoteForward, client *ssh.Client) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.removed {
+		return nil
+	}
+	if f.listener != nil {
+		f.listener.Close()
+		f.listener = nil
+	}
+
+	listener, err := client.Listen("tcp", f.config.ListenAddr)
+	if err != nil {
+		f.state = ForwardStateFailed
+		f.lastError = err.Error()
+		return err
+	}
+
+	f.listener = listener
+	f.state = ForwardStateActive
+	f.lastError = ""
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.serveRemoteForward(f, listener)
+	}()
+
+	p.logMessage(fmt.Sprintf("Remote forward listening: %s", f.config))
+	return nil
+}
+
+func (p *ProxyServer) serveRemoteForward(f *remoteForward, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			f.lock.Lock()
+			// Если listener не заменён и не закрыт нами - SSH соединение потеряно
+			if f.listener == listener && !f.removed {
+				f.listener = nil
+				f.state = ForwardStateReconnecting
+				f.lastError = err.Error()
+				p.logWarn(fmt.Sprintf("Remote forward %s lost: %v", f.config, err))
+			}
+			f.lock.Unlock()
+			return
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			f.handler(conn)
+		}()
+	}
+}
+
+func (p *ProxyServer) handleRemoteForward(f *remoteForward, conn net.Conn) {
+	defer conn.Close()
+
+	tc, err := p.openConn(p.ctx, protoRemoteForward, conn.RemoteAddr().String(), "", f.config.TargetAddr)
+	if err != nil {
+		return
+	}
+	tc.setRoute(routeDecision{Action: RouteDirect})
+	f.lock.Lock()
+	tc.listenerTimeouts = f.config.Timeouts
+	f.lock.Unlock()
+	logger := tc.logger().With("listen", f.config.ListenAddr)
+
+	dialCtx, cancel := withDialTimeout(p.ctx, tc.timeouts().dial)
+	targetConn, err := p.dialDirect(dialCtx, "tcp", f.config.TargetAddr)
+	cancel()
+	if err != nil {
+		tc.fail(err)
+		logger.Warn("Dial failed", "err", err)
+		return
+	}
+	if err := tc.attach(targetConn); err != nil {
+		return
+	}
+	if err := splice(conn, tc); err != nil && !isNetworkError(err) {
+		logger.Warn("Tunnel error", "err", err)
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Порт проброса открывается только на тестовом SSH сервере
+const (
+	remoteTestHost   = "127.0.0.1"
+	remoteTestPort   = 8022
+	remoteTestListen = "127.0.0.1:8022"
+)
+
+// startForwardSSHServer запускает SSH сервер, который принимает
+// tcpip-forward, пока refuse не выставлен, и сообщает о каждом принятом
+// запросе соединение, на котором он пришёл.
+func startForwardSSHServer(t *testing.T, refuse *atomic.Bool) (string, <-chan *ssh.ServerConn) {
+	forwards := make(chan *ssh.ServerConn, 10)
+	addr := startRequestSSHServer(t, func(ch ssh.NewChannel) {
+		ch.Reject(ssh.Prohibited, "no channels")
+	}, func(conn *ssh.ServerConn, req *ssh.Request) {
+		if req.Type != "tcpip-forward" {
+			req.Reply(true, nil)
+			return
+		}
+		if refuse.Load() {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		forwards <- conn
+	})
+	return addr, forwards
+}
+
+func startEchoServer(t *testing.T) string {
+	ln := listen(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startRemoteForwardProxy подключает прокси к SSH серверу через
+// переключатель с быстрым переподключением.
+func startRemoteForwardProxy(t *testing.T, sshAddr string) (*ProxyServer, *sshSwitch) {
+	sw := startSSHSwitch(t, sshAddr)
+	config := testTransportConfig(sw.addr, SSHTransport{})
+	config.Reconnect = ReconnectConfig{
+		InitialInterval:   Duration(10 * time.Millisecond),
+		MaxInterval:       Duration(50 * time.Millisecond),
+		KeepaliveInterval: Duration(20 * time.Millisecond),
+	}
+	p := startSupervisedProxy(t, config)
+	t.Cleanup(p.closeRemoteForwards)
+	return p, sw
+}
+
+func receiveForward(t *testing.T, forwards <-chan *ssh.ServerConn) *ssh.ServerConn {
+	t.Helper()
+	select {
+	case conn := <-forwards:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("tcpip-forward not requested")
+		return nil
+	}
+}
+
+// openForwarded открывает соединение на порт проброса со стороны сервера.
+func openForwarded(t *testing.T, conn *ssh.ServerConn) ssh.Channel {
+	t.Helper()
+	payload := ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{remoteTestHost, remoteTestPort, "203.0.113.1", 40000})
+	ch, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		t.Fatalf("forwarded-tcpip: %v", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch
+}
+
+// checkForwarded проверяет, что соединение на порт проброса доходит до
+// эхо-сервера.
+func checkForwarded(t *testing.T, conn *ssh.ServerConn) {
+	t.Helper()
+	ch := openForwarded(t, conn)
+	defer ch.Close()
+	if _, err := io.WriteString(ch, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(ch, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo through the forward: %q, %v", reply, err)
+	}
+}
+
+func waitForwardState(t *testing.T, p *ProxyServer, state string) ForwardStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		forwards := p.RemoteForwards()
+		if len(forwards) == 1 && forwards[0].State == state {
+			return forwards[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("forward state %+v, want %s", forwards, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteForwardReestablish(t *testing.T) {
+	var refuse atomic.Bool
+	sshAddr, forwards := startForwardSSHServer(t, &refuse)
+	p, sw := startRemoteForwardProxy(t, sshAddr)
+
+	if err := p.AddRemoteForward(remoteTestListen, startEchoServer(t)); err != nil {
+		t.Fatal(err)
+	}
+	first := receiveForward(t, forwards)
+	waitForwardState(t, p, ForwardStateActive)
+	checkForwarded(t, first)
+
+	// Обрыв SSH: проброс ждёт переподключения
+	sw.set(false)
+	waitForwardState(t, p, ForwardStateReconnecting)
+
+	// После переподключения порт открывается заново на новом соединении
+	sw.set(true)
+	waitState(t, p, func(s SSHStateChange) bool { return s.State == SSHStateConnected })
+	second := receiveForward(t, forwards)
+	if second == first {
+		t.Fatal("forward re-requested on the old connection")
+	}
+	waitForwardState(t, p, ForwardStateActive)
+	checkForwarded(t, second)
+}
+
+func TestRemoteForwardRefused(t *testing.T) {
+	var refuse atomic.Bool
+	refuse.Store(true)
+	sshAddr, forwards := startForwardSSHServer(t, &refuse)
+	p, sw := startRemoteForwardProxy(t, sshAddr)
+	target := startEchoServer(t)
+
+	// Отказ при добавлении возвращается вызывающему, проброс не остаётся
+	if err := p.AddRemoteForward(remoteTestListen, target); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("refused forward: %v", err)
+	}
+	if forwards := p.RemoteForwards(); len(forwards) != 0 {
+		t.Fatalf("refused forward listed: %+v", forwards)
+	}
+
+	refuse.Store(false)
+	if err := p.AddRemoteForward(remoteTestListen, target); err != nil {
+		t.Fatal(err)
+	}
+	receiveForward(t, forwards)
+	waitForwardState(t, p, ForwardStateActive)
+
+	// Отказ после переподключения виден в статусе проброса
+	refuse.Store(true)
+	sw.set(false)
+	waitForwardState(t, p, ForwardStateReconnecting)
+	sw.set(true)
+	waitState(t, p, func(s SSHStateChange) bool { return s.State == SSHStateConnected })
+	status := waitForwardState(t, p, ForwardStateFailed)
+	if !strings.Contains(status.LastError, "denied") {
+		t.Errorf("last error %q", status.LastError)
+	}
+}
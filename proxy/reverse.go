@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/armon/go-socks5"
+)
+
+// ReverseDynamicConfig - SOCKS5 сервер, открытый на стороне SSH сервера
+// (аналог `ssh -R port` без назначения). Соединения к целям устанавливаются
+// с этой машины, поэтому AllowDestinations обязателен: подсети, IP или
+// домены, куда разрешено ходить с удалённой стороны.
+type ReverseDynamicConfig struct {
+	ListenAddr        string   `json:"listen"`
+	AllowDestinations []string `json:"allow"`
+}
+
+// AddReverseDynamic открывает listenAddr на SSH сервере и обслуживает
+// входящие соединения как SOCKS5, подключаясь к назначениям локально.
+func (p *ProxyServer) AddReverseDynamic(listenAddr string, allowDestinations []string) error {
+	acl, err := newDestMatcherFromList(allowDestinations)
+	if err != nil {
+		return err
+	}
+	if acl.empty() {
+		return errors.New("reverse SOCKS5 requires at least one allowed destination")
+	}
+
+	socksServer, err := socks5.New(&socks5.Config{
+		Dial:     p.reverseDial,
+		Rules:    &socksRules{router: p.currentRouter, acl: acl, open: p.openConn, metrics: p.metrics, protocol: protoReverseSOCKS5},
+		Resolver: &countingResolver{metrics: p.metrics, router: p.currentRouter},
+		Logger:   log.New(&filteredLogWriter{proxy: p}, "", 0),
+	})
+	if err != nil {
+		return err
+	}
+
+	f := &remoteForward{
+		config: ForwardConfig{ListenAddr: listenAddr, TargetAddr: "socks5"},
+	}
+	f.handler = func(conn net.Conn) {
+		socksServer.ServeConn(conn)
+	}
+	return p.addRemoteListener(f)
+}
+
+func (p *ProxyServer) startReverseDynamic() error {
+	for _, rd := range p.config.ReverseDynamic {
+		if err := p.AddReverseDynamic(rd.ListenAddr, rd.AllowDestinations); err != nil {
+			return fmt.Errorf("reverse SOCKS5 on %s: %v", rd.ListenAddr, err)
+		}
+	}
+	return nil
+}
+
+func (p *ProxyServer) reverseDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	tc, err := p.socksConn(ctx, protoReverseSOCKS5, addr)
+	if err != nil {
+		return nil, err
+	}
+	decision, _ := routeFromContext(ctx)
+	decision.Action = RouteDirect
+	tc.setRoute(decision)
+	logger := tc.logger()
+	logger.Debug("Dialing")
+
+	dialCtx, cancel := withDialTimeout(ctx, tc.timeouts().dial)
+	defer cancel()
+	conn, err := p.dialDirect(dialCtx, network, addr)
+	if err != nil {
+		logger.Warn("Dial failed", "err", err)
+		tc.fail(err)
+		return nil, err
+	}
+	if err := tc.attach(conn); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
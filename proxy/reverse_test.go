@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// socksConnect выполняет запрос CONNECT по SOCKS5 через канал проброса и
+// возвращает код ответа.
+func socksConnect(t *testing.T, conn io.ReadWriter, addr string) byte {
+	t.Helper()
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, net.ParseIP(host).To4()...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("SOCKS5 greeting %v, %v", reply, err)
+	}
+	return reply[3]
+}
+
+func TestReverseDynamicDestinations(t *testing.T) {
+	var refuse atomic.Bool
+	sshAddr, forwards := startForwardSSHServer(t, &refuse)
+	config := testTransportConfig(sshAddr, SSHTransport{})
+	// Фильтр назначений действует и для обратного SOCKS5
+	config.DestinationFilter = DestinationFilter{Block: []string{"127.0.0.2/32"}}
+	p := startSupervisedProxy(t, config)
+	t.Cleanup(p.closeRemoteForwards)
+
+	if err := p.AddReverseDynamic(remoteTestListen, []string{"127.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	conn := receiveForward(t, forwards)
+	echo := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		reply  byte
+	}{
+		{"allowed", echo, 0},
+		// 2 - connection not allowed by ruleset
+		{"not in allow", net.JoinHostPort("10.0.0.1", echoPort), 2},
+		{"filtered", net.JoinHostPort("127.0.0.2", echoPort), 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := openForwarded(t, conn)
+			defer ch.Close()
+			if reply := socksConnect(t, ch, tt.target); reply != tt.reply {
+				t.Fatalf("reply %d, want %d", reply, tt.reply)
+			}
+			if tt.reply != 0 {
+				return
+			}
+			if _, err := io.WriteString(ch, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(ch, got); err != nil || string(got) != "ping" {
+				t.Fatalf("echo %q, %v", got, err)
+			}
+		})
+	}
+
+	// Запрещённые назначения не набирались
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.Connections()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, info := range p.ClosedConnections() {
+		if info.Target != echo {
+			t.Errorf("connection to a denied destination: %+v", info)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestRotatingFile(t *testing.T, f *rotatingFile) *rotatingFile {
+	t.Helper()
+	f.path = filepath.Join(t.TempDir(), "proxy.log")
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func writeLog(t *testing.T, f *rotatingFile, line string) {
+	t.Helper()
+	if _, err := f.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// logBackups возвращает содержимое копий от старой к новой.
+func logBackups(t *testing.T, f *rotatingFile) []string {
+	t.Helper()
+	prefix := strings.TrimSuffix(f.path, ".log") + "-"
+	names, err := filepath.Glob(prefix + "*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	var contents []string
+	for _, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".log")
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	f := openTestRotatingFile(t, &rotatingFile{maxSize: 10})
+
+	writeLog(t, f, "first\n")
+	writeLog(t, f, "2nd\n")
+	// Имя копии с точностью до миллисекунды
+	time.Sleep(2 * time.Millisecond)
+	writeLog(t, f, "third\n")
+	time.Sleep(2 * time.Millisecond)
+	// Строка больше лимита пишется целиком в новый файл
+	writeLog(t, f, "fourth line\n")
+
+	if got := logBackups(t, f); strings.Join(got, "|") != "first\n2nd\n|third\n" {
+		t.Errorf("backups %q", got)
+	}
+	if got := readLog(t, f.path); got != "fourth line\n" {
+		t.Errorf("current file %q", got)
+	}
+}
+
+func TestRotatingFileEvery(t *testing.T) {
+	f := openTestRotatingFile(t, &rotatingFile{every: 50 * time.Millisecond})
+
+	// Пустой файл не ротируется, сколько бы он ни был открыт
+	time.Sleep(60 * time.Millisecond)
+	writeLog(t, f, "first\n")
+	if got := logBackups(t, f); len(got) != 0 {
+		t.Fatalf("empty file rotated: %q", got)
+	}
+
+	// Интервал отсчитывается от открытия файла
+	writeLog(t, f, "second\n")
+	writeLog(t, f, "third\n")
+	if got := logBackups(t, f); strings.Join(got, "|") != "first\n" {
+		t.Errorf("backups %q", got)
+	}
+	if got := readLog(t, f.path); got != "second\nthird\n" {
+		t.Errorf("current file %q", got)
+	}
+}
+
+func TestRotatingFilePrune(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		maxBackups int
+		maxAge     time.Duration
+		keep       []string
+	}{
+		// Новая копия считается: остаётся одна из старых
+		{"max backups", 2, 0, []string{"1h"}},
+		{"max age", 0, 150 * time.Minute, []string{"1h", "2h"}},
+		{"both", 3, 90 * time.Minute, []string{"1h"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := openTestRotatingFile(t, &rotatingFile{maxSize: 1, maxBackups: tt.maxBackups, maxAge: tt.maxAge})
+			dir := filepath.Dir(f.path)
+			now := time.Now().UTC()
+			backups := map[string]string{}
+			for _, age := range []string{"1h", "2h", "3h", "240h"} {
+				d, _ := time.ParseDuration(age)
+				name := f.backupName(now.Add(-d))
+				backups[age] = name
+				if err := os.WriteFile(name, []byte(age), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Чужие файлы не трогаются
+			others := []string{"other.log", "proxy-latest.log"}
+			for _, name := range others {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			writeLog(t, f, "old\n")
+			writeLog(t, f, "new\n")
+
+			keep := map[string]bool{}
+			for _, age := range tt.keep {
+				keep[age] = true
+			}
+			for age, name := range backups {
+				_, err := os.Stat(name)
+				if kept := err == nil; kept != keep[age] {
+					t.Errorf("backup %s ago kept=%v, want %v", age, kept, keep[age])
+				}
+			}
+			if got := logBackups(t, f); len(got) == 0 || got[len(got)-1] != "old\n" {
+				t.Errorf("rotated file not kept: %q", got)
+			}
+			for _, name := range others {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("%s removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestReloadLogFile(t *testing.T) {
+	p := startSupervisedProxy(t, testTransportConfig(startSSHServer(t), SSHTransport{}))
+	t.Cleanup(func() { p.setLogger(p.Logger(), nil) })
+	dir := t.TempDir()
+
+	reload := func(modify func(c *ProxyConfig)) {
+		t.Helper()
+		config := *p.currentConfig()
+		modify(&config)
+		if err := p.Reload(&config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	currentFile := func() *rotatingFile {
+		p.logLock.RLock()
+		defer p.logLock.RUnlock()
+		return p.logFile
+	}
+
+	first := filepath.Join(dir, "first.log")
+	reload(func(c *ProxyConfig) {
+		c.LogPath = first
+		c.LogLevel = "warn"
+	})
+	firstFile := currentFile()
+	if firstFile == nil || firstFile.path != first {
+		t.Fatalf("log file %+v", firstFile)
+	}
+	p.logWarn("to the first file")
+
+	// Без изменений настроек лога логгер не пересоздаётся
+	reload(func(c *ProxyConfig) { c.Reconnect.MaxAttempts = 3 })
+	if currentFile() != firstFile {
+		t.Error("log file reopened without log changes")
+	}
+
+	// Параметры ротации тоже меняют логгер
+	reload(func(c *ProxyConfig) { c.LogMaxBackups = 2 })
+	secondFile := currentFile()
+	if secondFile == firstFile || secondFile.maxBackups != 2 {
+		t.Fatalf("log file not replaced: %+v", secondFile)
+	}
+	if _, err := firstFile.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("previous file not closed: %v", err)
+	}
+
+	second := filepath.Join(dir, "second.log")
+	reload(func(c *ProxyConfig) { c.LogPath = second })
+	if secondFile.file != nil {
+		t.Error("previous file not closed")
+	}
+	p.logWarn("to the second file")
+
+	if got := readLog(t, first); !strings.Contains(got, "to the first file") || strings.Contains(got, "second") {
+		t.Errorf("first file:\n%s", got)
+	}
+	if got := readLog(t, second); !strings.Contains(got, "to the second file") {
+		t.Errorf("second file:\n%s", got)
+	}
+
+	// Без файла логгер пишет только в stderr
+	reload(func(c *ProxyConfig) { c.LogPath = "" })
+	if currentFile() != nil {
+		t.Error("log file kept after log_path was removed")
+	}
+}
@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// Действия маршрутизации
+const (
+	RouteTunnel = "tunnel" // через SSH
+	RouteDirect = "direct" // напрямую с этой машины
+	RouteBlock  = "block"  // запретить
+)
+
+// RouteRule - правило маршрутизации. Правило срабатывает, если адрес
+// назначения подходит под любой из Domains/CIDRs и (если заданы) Ports.
+// Domains совпадают по суффиксу: "example.com" подходит и для "a.example.com".
+// Записи "geoip:ru" и "geosite:google" проверяются по базам из
+// GeoIPPath и GeoSitePath (см. geo.go).
+type RouteRule struct {
+	Name    string   `json:"name,omitempty"`
+	Domains []string `json:"domains,omitempty"`
+	CIDRs   []string `json:"cidrs,omitempty"`
+	Ports   []int    `json:"ports,omitempty"`
+	Action  string   `json:"action"`
+	// Таймауты соединений по правилу (кроме handshake)
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+}
+
+type routeDecision struct {
+	Rule   string
+	Action string
+	// Таймауты сработавшего правила
+	timeouts *Timeouts
+	// Адрес, по которому фильтр проверил имя; подключаться нужно к нему
+	ip net.IP
+}
+
+// destMatcher проверяет адрес назначения по доменам и подсетям.
+// Поиск не зависит от размера списков: домен проверяется по суффиксам
+// в map, адрес - двоичным поиском по диапазонам.
+type destMatcher struct {
+	domains map[string]struct{}
+	ips     *ipSet
+}
+
+func newDestMatcher(domains, cidrs []string) (*destMatcher, error) {
+	m := &destMatcher{domains: make(map[string]struct{}, len(domains))}
+	for _, d := range domains {
+		d = strings.TrimPrefix(strings.TrimSpace(d), "*.")
+		d = strings.ToLower(strings.Trim(d, "."))
+		if d != "" {
+			m.domains[d] = struct{}{}
+		}
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		ipNet, err := parseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	m.ips = newIPSet(nets)
+	return m, nil
+}
+
+// parseCIDR разбирает подсеть; отдельный адрес считается подсетью из одного адреса.
+func parseCIDR(c string) (*net.IPNet, error) {
+	c = strings.TrimSpace(c)
+	if !strings.Contains(c, "/") {
+		ip := net.ParseIP(c)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid CIDR %q", c)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		c = fmt.Sprintf("%s/%d", c, bits)
+	}
+	_, ipNet, err := net.ParseCIDR(c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q: %v", c, err)
+	}
+	return ipNet, nil
+}
+
+func (m *destMatcher) empty() bool {
+	return len(m.domains) == 0 && m.ips.empty()
+}
+
+func (m *destMatcher) match(host string, ip net.IP) bool {
+	if host != "" && len(m.domains) > 0 {
+		name := strings.ToLower(strings.TrimSuffix(host, "."))
+		for {
+			if _, ok := m.domains[name]; ok {
+				return true
+			}
+			dot := strings.IndexByte(name, '.')
+			if dot < 0 {
+				break
+			}
+			name = name[dot+1:]
+		}
+	}
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+	return ip != nil && m.ips.contains(ip)
+}
+
+// newDestMatcherFromList разделяет смешанный список на подсети и домены.
+func newDestMatcherFromList(entries []string) (*destMatcher, error) {
+	domains, cidrs := splitDestEntries(entries)
+	return newDestMatcher(domains, cidrs)
+}
+
+func splitDestEntries(entries []string) (domains, cidrs []string) {
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if strings.Contains(e, "/") || net.ParseIP(e) != nil {
+			cidrs = append(cidrs, e)
+		} else {
+			domains = append(domains, e)
+		}
+	}
+	return domains, cidrs
+}
+
+type compiledRule struct {
+	name     string
+	action   string
+	matcher  *destMatcher
+	geo      *geoMatcher
+	matchAll bool
+	ports    map[int]struct{}
+	timeouts *Timeouts
+}
+
+// router выбирает действие для адреса назначения по первому
+// подходящему правилу. Если ни одно не подошло - туннель.
+// Фильтр назначений проверяется раньше правил.
+type router struct {
+	rules  []compiledRule
+	filter *destFilter
+}
+
+// newRouter собирает правила и фильтр назначений конфигурации,
+// загружая файлы списков и геобаз.
+func newRouter(config *ProxyConfig) (*router, error) {
+	geo, err := loadGeoDatabases(config)
+	if err != nil {
+		return nil, err
+	}
+	r := &router{}
+	for i, rule := range config.Rules {
+		compiled, err := compileRule(i, rule, geo)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	if r.filter, err = newDestFilter(config.DestinationFilter); err != nil {
+		return nil, fmt.Errorf("destination_filter: %v", err)
+	}
+	return r, nil
+}
+
+// ruleName возвращает имя правила; безымянные нумеруются с единицы.
+func ruleName(index int, rule RouteRule) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("rule-%d", index+1)
+}
+
+// compileRule собирает правило. Без геобаз (geo == nil) записи
+// geoip:/geosite: только проверяются.
+func compileRule(index int, rule RouteRule, geo *geoDatabases) (compiledRule, error) {
+	name := ruleName(index, rule)
+	var errs []error
+	switch rule.Action {
+	case RouteTunnel, RouteDirect, RouteBlock:
+	default:
+		errs = append(errs, fmt.Errorf("rule %s: unknown action %q", name, rule.Action))
+	}
+	domains, domainCountries, domainSites := splitGeoEntries(rule.Domains)
+	cidrs, cidrCountries, cidrSites := splitGeoEntries(rule.CIDRs)
+	matcher, err := newDestMatcher(domains, cidrs)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rule %s: %v", name, err))
+	}
+	geoRule, err := newGeoMatcher(append(domainCountries, cidrCountries...), append(domainSites, cidrSites...), geo)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rule %s: %v", name, err))
+	}
+	if len(errs) > 0 {
+		return compiledRule{}, errors.Join(errs...)
+	}
+	ports := make(map[int]struct{}, len(rule.Ports))
+	for _, port := range rule.Ports {
+		ports[port] = struct{}{}
+	}
+	return compiledRule{
+		name:     name,
+		action:   rule.Action,
+		matcher:  matcher,
+		geo:      geoRule,
+		matchAll: matcher.empty() && geoRule.empty(),
+		ports:    ports,
+		timeouts: rule.Timeouts,
+	}, nil
+}
+
+func (r *router) route(host string, ip net.IP, port int) routeDecision {
+	resolved := ip != nil
+	// Подсети фильтра проверяются по адресу: иначе имя, указывающее на
+	// запрещённую подсеть (например 169.254.169.254), прошло бы фильтр
+	var checked net.IP
+	if !resolved && r.filter.needsIP() && net.ParseIP(host) == nil {
+		ip = resolveHost(host)
+		resolved = true
+		if ip == nil {
+			reason := r.filter.check(host, nil)
+			if reason == "" {
+				reason = filterUnresolved
+			}
+			return routeDecision{Rule: reason, Action: RouteBlock}
+		}
+		checked = ip
+	}
+	if reason := r.filter.check(host, ip); reason != "" {
+		return routeDecision{Rule: reason, Action: RouteBlock}
+	}
+	for _, rule := range r.rules {
+		if len(rule.ports) > 0 {
+			if _, ok := rule.ports[port]; !ok {
+				continue
+			}
+		}
+		// Имя разрешаем только когда дошли до правила с geoip
+		if rule.geo.needsIP() && !resolved {
+			ip = resolveHost(host)
+			resolved = true
+		}
+		if rule.matchAll || rule.matcher.match(host, ip) || rule.geo.match(host, ip) {
+			return routeDecision{Rule: rule.name, Action: rule.action, timeouts: rule.timeouts, ip: checked}
+		}
+	}
+	return routeDecision{Action: RouteTunnel, ip: checked}
+}
+
+// routeAddr разбирает "host:port" и выбирает маршрут. Если фильтр
+// разрешил имя, подключаться нужно к decision.dialAddr(addr).
+func (r *router) routeAddr(addr string) routeDecision {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.Atoi(portStr)
+	return r.route(host, nil, port)
+}
+
+// dialAddr возвращает адрес для подключения: проверенный фильтром IP
+// вместо имени, чтобы повторный запрос DNS не подменил его (DNS rebinding).
+func (d routeDecision) dialAddr(addr string) string {
+	if d.ip == nil {
+		return addr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(d.ip.String(), port)
+}
+
+type routeKey struct{}
+
+func withRoute(ctx context.Context, decision routeDecision) context.Context {
+	return context.WithValue(ctx, routeKey{}, decision)
+}
+
+func routeFromContext(ctx context.Context) (routeDecision, bool) {
+	decision, ok := ctx.Value(routeKey{}).(routeDecision)
+	return decision, ok
+}
+
+// socksRules применяет правила маршрутизации в SOCKS5 сервере. Решение
+// сохраняется в контексте и используется диалером.
+type socksRules struct {
+	router func() *router
+	// acl, если задан, ограничивает допустимые назначения
+	acl *destMatcher
+	// open регистрирует соединение, чтобы при превышении лимита клиент
+	// получил отказ по правилам, а не "host unreachable"
+	open func(ctx context.Context, protocol, client, user, target string) (*trackedConn, error)
+	// Для учёта заблокированных соединений в метриках
+	metrics  *metrics
+	protocol string
+}
+
+func (s *socksRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		// BIND и ASSOCIATE библиотека отклонит сама
+		return ctx, true
+	}
+	dest := req.DestAddr
+	if req.RemoteAddr != nil {
+		// Тот же ключ, что у handshakeListener: AddrSpec.String() не берёт
+		// IPv6 в скобки
+		ctx = withClientAddr(ctx, clientKey(req.RemoteAddr.IP, req.RemoteAddr.Port))
+	}
+	if req.AuthContext != nil && req.AuthContext.Payload["Username"] != "" {
+		ctx = withClientUser(ctx, req.AuthContext.Payload["Username"])
+	}
+	if s.acl != nil && !s.acl.match(dest.FQDN, dest.IP) {
+		s.blocked()
+		return ctx, false
+	}
+	decision := s.router().route(dest.FQDN, dest.IP, dest.Port)
+	if decision.Action == RouteBlock {
+		s.blocked()
+		return ctx, false
+	}
+	if s.open != nil {
+		tc, err := s.open(ctx, s.protocol, clientAddrFromContext(ctx), clientUserFromContext(ctx), socksTarget(dest))
+		if err != nil {
+			return ctx, false
+		}
+		tc.setRoute(decision)
+		ctx = withTrackedConn(ctx, tc)
+	}
+	return withRoute(ctx, decision), true
+}
+
+// socksTarget возвращает назначение запроса, с именем хоста, если оно известно.
+func socksTarget(dest *socks5.AddrSpec) string {
+	if dest.FQDN != "" {
+		return net.JoinHostPort(dest.FQDN, strconv.Itoa(dest.Port))
+	}
+	return dest.Address()
+}
+
+func (s *socksRules) blocked() {
+	if s.metrics != nil {
+		s.metrics.connection(s.protocol, resultBlocked)
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Источники секретов (пароль SSH, пароль ключа):
+//
+//	env:NAME        - переменная окружения
+//	file:/path      - первая строка файла, доступного только владельцу
+//	stdin           - строка из stdin, читается один раз за время работы
+//	cmd:pass show x - первая строка вывода внешней команды
+//
+// Секреты читаются при каждом подключении, поэтому переподключение
+// подхватывает изменившийся пароль.
+const (
+	secretEnv   = "env:"
+	secretFile  = "file:"
+	secretCmd   = "cmd:"
+	secretStdin = "stdin"
+)
+
+const secretCommandTimeout = 30 * time.Second
+
+var stdinSecret struct {
+	once  sync.Once
+	value string
+	err   error
+}
+
+func validateSecretSource(spec string) error {
+	switch {
+	case spec == secretStdin:
+		return nil
+	case strings.HasPrefix(spec, secretEnv), strings.HasPrefix(spec, secretFile), strings.HasPrefix(spec, secretCmd):
+		if strings.TrimSpace(spec[strings.IndexByte(spec, ':')+1:]) == "" {
+			return fmt.Errorf("empty secret source %q", spec)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown secret source %q, expected env:, file:, cmd: or stdin", spec)
+}
+
+// resolveSecret читает секрет из источника spec.
+func resolveSecret(spec string) (string, error) {
+	switch {
+	case spec == secretStdin:
+		stdinSecret.once.Do(func() {
+			stdinSecret.value, stdinSecret.err = firstLine(os.Stdin)
+		})
+		return stdinSecret.value, stdinSecret.err
+
+	case strings.HasPrefix(spec, secretEnv):
+		name := strings.TrimPrefix(spec, secretEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+
+	case strings.HasPrefix(spec, secretFile):
+		return readSecretFile(strings.TrimPrefix(spec, secretFile))
+
+	case strings.HasPrefix(spec, secretCmd):
+		return runSecretCommand(strings.TrimPrefix(spec, secretCmd))
+	}
+	return "", validateSecretSource(spec)
+}
+
+func readSecretFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("secret file %s is accessible by others (mode %04o), expected 0600", path, info.Mode().Perm())
+	}
+	return firstLine(f)
+}
+
+func runSecretCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("secret command %q failed: %v", command, err)
+	}
+	return firstLine(strings.NewReader(string(out)))
+}
+
+func firstLine(f io.Reader) (string, error) {
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("secret is empty")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
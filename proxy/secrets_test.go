@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestValidateSecretSource(t *testing.T) {
+	for spec, ok := range map[string]bool{
+		"env:SSH_PASSWORD":  true,
+		"file:/run/secret":  true,
+		"cmd:pass show ssh": true,
+		"stdin":             true,
+		"env:":              false,
+		"file:  ":           false,
+		"cmd:":              false,
+		"vault:ssh":         false,
+		"SSH_PASSWORD":      false,
+		"":                  false,
+	} {
+		if err := validateSecretSource(spec); (err == nil) != ok {
+			t.Errorf("%q: %v", spec, err)
+		}
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("TEST_SECRET", "from env")
+	t.Setenv("TEST_SECRET_EMPTY", "")
+
+	dir := t.TempDir()
+	writeSecret := func(name, content string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		// umask не должен влиять на проверку прав
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	private := writeSecret("private", "from file\r\nsecond line\n", 0o600)
+	noNewline := writeSecret("no-newline", "last", 0o400)
+	shared := writeSecret("shared", "visible\n", 0o644)
+	empty := writeSecret("empty", "", 0o600)
+
+	for _, tt := range []struct {
+		spec, want string
+		err        string
+	}{
+		{spec: "env:TEST_SECRET", want: "from env"},
+		{spec: "env:TEST_SECRET_EMPTY", want: ""},
+		{spec: "env:TEST_SECRET_UNSET", err: "is not set"},
+		{spec: "file:" + private, want: "from file"},
+		{spec: "file:" + noNewline, want: "last"},
+		{spec: "file:" + shared, err: "accessible by others"},
+		{spec: "file:" + empty, err: "secret is empty"},
+		{spec: "file:" + filepath.Join(dir, "missing"), err: "no such file"},
+		{spec: "vault:x", err: "unknown secret source"},
+	} {
+		if runtime.GOOS == "windows" && strings.Contains(tt.err, "accessible") {
+			continue
+		}
+		got, err := resolveSecret(tt.spec)
+		switch {
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: %q, %v, want error %q", tt.spec, got, err, tt.err)
+		case tt.err == "" && (err != nil || got != tt.want):
+			t.Errorf("%s: %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveSecretCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	for _, tt := range []struct {
+		spec, want string
+		err        string
+	}{
+		{spec: "cmd:printf 'pw\\nignored\\n'", want: "pw"},
+		{spec: "cmd:echo $((6 * 7))", want: "42"},
+		{spec: "cmd:exit 3", err: "exit status 3"},
+		{spec: "cmd:true", err: "secret is empty"},
+	} {
+		got, err := resolveSecret(tt.spec)
+		switch {
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: %q, %v, want error %q", tt.spec, got, err, tt.err)
+		case tt.err == "" && (err != nil || got != tt.want):
+			t.Errorf("%s: %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Копирование данных туннеля. Протоколы вроде rsync и git закрывают
+// свою сторону на запись (half-close) и продолжают читать ответ, поэтому
+// EOF в одну сторону не закрывает туннель: другой стороне передаётся
+// CloseWrite, а копирование в обратную сторону продолжается.
+//
+// Буферы берутся из пула. Если обе стороны - TCP (прямой маршрут) и
+// скорость не ограничена, данные передаются в ядре (splice на Linux), а
+// байты учитываются раз в spliceAccountInterval.
+//
+// SOCKS5 туннели копирует сам go-socks5: ответ клиенту он отправляет после
+// возврата из Dial и владеет соединением клиента, поэтому splice там не
+// вызвать. Его цикл делает то же самое: io.Copy попадает в ReadFrom и
+// WriteTo trackedConn, после EOF вызывается CloseWrite, и туннель ждёт
+// оба направления.
+
+const (
+	copyBufferSize = 32 << 10
+	// Как часто прерывать передачу в ядре, чтобы учесть байты
+	spliceAccountInterval = time.Second
+)
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// closeWriter - соединение с половинным закрытием: TCP и каналы SSH.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice копирует данные между клиентом и назначением, пока не
+// завершатся оба направления, и закрывает оба соединения. Возвращает
+// первую ошибку копирования.
+func splice(client net.Conn, target *trackedConn) error {
+	target.setPeer(client)
+
+	errc := make(chan error, 2)
+	copyHalf := func(dst net.Conn, copy func() (int64, error)) {
+		_, err := copy()
+		if err == nil {
+			if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+				errc <- nil
+				return
+			}
+		}
+		// Ошибка или половинное закрытие не поддерживается -
+		// закрываем туннель целиком
+		target.Close()
+		if errors.Is(err, net.ErrClosed) {
+			// Туннель уже закрыт другим направлением или по таймауту
+			err = nil
+		}
+		errc <- err
+	}
+	go copyHalf(target, func() (int64, error) { return target.ReadFrom(client) })
+	go copyHalf(client, func() (int64, error) { return target.WriteTo(client) })
+
+	err := <-errc
+	if err2 := <-errc; err == nil {
+		err = err2
+	}
+	target.Close()
+	return err
+}
+
+// CloseWrite закрывает соединение с назначением на запись.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// ReadFrom передаёт данные от клиента назначению.
+func (c *trackedConn) ReadFrom(r io.Reader) (int64, error) {
+	if dst, src := tcpConnOf(c.Conn), tcpConnOf(r); dst != nil && src != nil {
+		return c.spliceTCP(dst, src, true)
+	}
+	return copyBuffered(c, r)
+}
+
+// WriteTo передаёт данные от назначения клиенту.
+func (c *trackedConn) WriteTo(w io.Writer) (int64, error) {
+	if dst, src := tcpConnOf(w), tcpConnOf(c.Conn); dst != nil && src != nil {
+		return c.spliceTCP(dst, src, false)
+	}
+	return copyBuffered(w, c)
+}
+
+// spliceTCP копирует между TCP соединениями средствами ядра. Дедлайн
+// чтения прерывает передачу раз в spliceAccountInterval, чтобы учесть
+// байты для статистики и таймаута простоя. Если включилось ограничение
+// скорости, остаток копируется через буфер.
+func (c *trackedConn) spliceTCP(dst, src *net.TCPConn, upload bool) (int64, error) {
+	defer src.SetReadDeadline(time.Time{})
+	var written int64
+	for !c.p.limiter.active() {
+		src.SetReadDeadline(time.Now().Add(spliceAccountInterval))
+		n, err := dst.ReadFrom(src)
+		written += n
+		c.account(n, upload)
+		if err == nil {
+			return written, nil
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return written, err
+		}
+		select {
+		case <-c.done:
+			return written, net.ErrClosed
+		default:
+		}
+	}
+	src.SetReadDeadline(time.Time{})
+	var n int64
+	var err error
+	if upload {
+		n, err = copyBuffered(c, src)
+	} else {
+		n, err = copyBuffered(dst, c)
+	}
+	return written + n, err
+}
+
+// account учитывает байты, переданные мимо Read и Write.
+func (c *trackedConn) account(n int64, upload bool) {
+	if upload {
+		c.sent.Add(n)
+		c.p.metrics.bytesOut.Add(n)
+	} else {
+		c.received.Add(n)
+		c.p.metrics.bytesIn.Add(n)
+	}
+}
+
+// copyBuffered - io.Copy с буфером из пула. В отличие от io.CopyBuffer
+// не вызывает ReadFrom/WriteTo, так что подходит для их реализации.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	bufp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bufp)
+	buf := *bufp
+
+	var written int64
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return written, nil
+		}
+		if er != nil {
+			return written, er
+		}
+	}
+}
+
+// tcpConnOf возвращает TCP соединение, если данные можно читать и писать
+// прямо в него, минуя обёртку.
+func tcpConnOf(v interface{}) *net.TCPConn {
+	switch c := v.(type) {
+	case *net.TCPConn:
+		return c
+	case *handshakeConn:
+		return tcpConnOf(c.Conn)
+	case *bufferedConn:
+		if c.r.Buffered() == 0 {
+			return tcpConnOf(c.Conn)
+		}
+	}
+	return nil
+}
+
+// bufferedConn отдаёт сначала данные, которые клиент прислал вместе
+// с запросом CONNECT и которые уже прочитал HTTP сервер.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Сравнение копирования туннеля с прежней реализацией: io.Copy между
+// timeoutConn, то есть новый буфер на каждое направление и дедлайн на
+// каждое чтение и запись.
+//
+//	go test ./proxy -run '^$' -bench Copy -benchmem
+
+const benchChunk = 64 << 10
+
+func newBenchServer() *ProxyServer {
+	return &ProxyServer{
+		config:  DefaultConfig(),
+		metrics: newMetrics(),
+		limiter: newRateLimiter(RateLimits{}),
+		conns:   newConnRegistry(),
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+// legacyTimeoutConn - timeoutConn из версии до пула буферов, с теми же
+// таймаутами, что у туннелей CONNECT: дедлайн на каждое чтение и запись.
+type legacyTimeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *legacyTimeoutConn) Read(b []byte) (n int, err error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *legacyTimeoutConn) Write(b []byte) (n int, err error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// tcpPair возвращает два конца TCP соединения через loopback.
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		b.Fatal("accept failed")
+	}
+	return dialed, conn
+}
+
+// benchTunnel передаёт b.N порций от клиента к назначению через copy.
+// copy получает серверную сторону клиента и соединение с назначением.
+func benchTunnel(b *testing.B, copy func(client net.Conn, target *trackedConn) error) {
+	p := newBenchServer()
+	clientApp, client := tcpPair(b)
+	target, targetApp := tcpPair(b)
+	defer clientApp.Close()
+	defer targetApp.Close()
+
+	tc, err := p.openConn(context.Background(), "bench", client.RemoteAddr().String(), "", targetApp.LocalAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := tc.attach(target); err != nil {
+		b.Fatal(err)
+	}
+	defer tc.Close()
+	defer client.Close()
+
+	b.SetBytes(benchChunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		buf := make([]byte, benchChunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := clientApp.Write(buf); err != nil {
+				break
+			}
+		}
+		clientApp.(*net.TCPConn).CloseWrite()
+	}()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, targetApp)
+		received <- n
+	}()
+	if err := copy(client, tc); err != nil {
+		b.Fatal(err)
+	}
+	tc.CloseWrite()
+	if n := <-received; n != int64(b.N)*benchChunk {
+		b.Fatalf("received %d bytes, want %d", n, int64(b.N)*benchChunk)
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) {
+		benchTunnel(b, func(client net.Conn, target *trackedConn) error {
+			dst := &legacyTimeoutConn{Conn: target.Conn, readTimeout: 60 * time.Second, writeTimeout: 30 * time.Second}
+			src := &legacyTimeoutConn{Conn: client, readTimeout: 60 * time.Second, writeTimeout: 30 * time.Second}
+			_, err := io.Copy(dst, src)
+			return err
+		})
+	})
+	b.Run("pooled", func(b *testing.B) {
+		benchTunnel(b, func(client net.Conn, target *trackedConn) error {
+			// Без *net.TCPConn со стороны клиента - как у туннелей через SSH
+			_, err := target.ReadFrom(struct{ io.Reader }{client})
+			return err
+		})
+	})
+	b.Run("splice", func(b *testing.B) {
+		benchTunnel(b, func(client net.Conn, target *trackedConn) error {
+			_, err := target.ReadFrom(client)
+			return err
+		})
+	})
+}
+
+// BenchmarkCopyShort - короткие соединения, где важны выделения буферов.
+func BenchmarkCopyShort(b *testing.B) {
+	payload := bytes.Repeat([]byte{'x'}, 4<<10)
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.Copy(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{bytes.NewReader(payload)})
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			copyBuffered(io.Discard, bytes.NewReader(payload))
+		}
+	})
+}
+
+// startSplice соединяет client и target через splice и возвращает канал
+// с её результатом.
+func startSplice(t *testing.T, p *ProxyServer, client, target net.Conn) <-chan error {
+	t.Helper()
+	tc, err := p.openConn(context.Background(), protoHTTPS, client.RemoteAddr().String(), "", target.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.attach(target); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- splice(client, tc) }()
+	return done
+}
+
+// halfClose пишет data, закрывает conn на запись и проверяет, что
+// другая сторона получила data и EOF.
+func halfClose(t *testing.T, conn, peer net.Conn, data string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != data {
+		t.Fatalf("read %q, %v, want %q and EOF", got, err, data)
+	}
+}
+
+func TestSpliceHalfClose(t *testing.T) {
+	for _, clientFirst := range []bool{true, false} {
+		p := newBenchServer()
+		clientApp, client := tcpPair(t)
+		target, targetApp := tcpPair(t)
+		defer clientApp.Close()
+		defer targetApp.Close()
+		done := startSplice(t, p, client, target)
+
+		// Первая сторона закрывает запись, а ответ в обратную сторону
+		// ещё идёт: туннель не закрыт, пока не завершены оба направления
+		first, firstPeer, second, secondPeer := clientApp, targetApp, targetApp, clientApp
+		if !clientFirst {
+			first, firstPeer, second, secondPeer = targetApp, clientApp, clientApp, targetApp
+		}
+		halfClose(t, first, firstPeer, "request")
+		select {
+		case err := <-done:
+			t.Fatalf("client first %v: tunnel closed after one direction: %v", clientFirst, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		halfClose(t, second, secondPeer, "response")
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("client first %v: %v", clientFirst, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("client first %v: tunnel not closed after both directions", clientFirst)
+		}
+	}
+}
+
+// Назначение через канал SSH: копирование через буфер, CloseWrite канала
+func TestSpliceHalfCloseSSH(t *testing.T) {
+	// Сервер читает запрос до EOF и только потом отвечает
+	addr := startChannelSSHServer(t, func(nc ssh.NewChannel) {
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		defer ch.Close()
+		data, _ := io.ReadAll(ch)
+		ch.Write(append([]byte("echo "), data...))
+		ch.CloseWrite()
+	})
+	p := startSupervisedProxy(t, testTransportConfig(addr, SSHTransport{}))
+	target, err := p.dialTunnel(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := target.(closeWriter); !ok {
+		t.Fatal("tunnel connection does not support CloseWrite")
+	}
+
+	clientApp, client := tcpPair(t)
+	defer clientApp.Close()
+	done := startSplice(t, p, client, target)
+
+	// EOF клиента доходит до сервера как CloseWrite канала, а ответ
+	// после него приходит клиенту
+	if _, err := clientApp.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	clientApp.(*net.TCPConn).CloseWrite()
+	clientApp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(clientApp)
+	if err != nil || string(got) != "echo hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel not closed")
+	}
+}
+
+// SOCKS5 туннели копирует go-socks5 (см. startSocksProxy); половинное
+// закрытие работает и у них
+func TestSOCKSHalfClose(t *testing.T) {
+	config := DefaultConfig()
+	config.Rules = []RouteRule{{Action: RouteDirect}}
+	p := newACLTestServer(t, config)
+	if err := p.startSocksProxy("127.0.0.1:0", config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.listener.Close()
+		p.wg.Wait()
+	})
+
+	// Назначение отвечает, только получив EOF
+	target := listen(t)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("echo "), data...))
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	addr := target.Addr().(*net.TCPAddr)
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, addr.IP.To4()...)
+	request = append(request, byte(addr.Port>>8), byte(addr.Port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 || reply[3] != 0 {
+		t.Fatalf("SOCKS5 reply %v, %v", reply, err)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "echo hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
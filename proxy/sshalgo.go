@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Алгоритмы SSH транспорта. На слабых Android устройствах без AES-NI
+// chacha20-poly1305 заметно быстрее aes-gcm, а строгие серверы требуют
+// урезанных списков. Сжатие (zlib@openssh.com) x/crypto/ssh не
+// поддерживает, поэтому настройки для него нет.
+
+// SSHAlgorithms - списки алгоритмов в порядке предпочтения; пустой
+// список - значения библиотеки по умолчанию.
+type SSHAlgorithms struct {
+	Ciphers  []string `json:"ciphers,omitempty"`
+	KEX      []string `json:"kex,omitempty"`
+	MACs     []string `json:"macs,omitempty"`
+	HostKeys []string `json:"host_keys,omitempty"`
+}
+
+// Алгоритмы, которые реализует golang.org/x/crypto/ssh
+var (
+	sshCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc",
+		"arcfour256", "arcfour128", "arcfour",
+	}
+	sshKEX = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	}
+	sshMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+	}
+	sshHostKeys = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+		ssh.CertAlgoED25519v01,
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01,
+	}
+)
+
+// Validate проверяет, что все алгоритмы поддерживаются.
+func (a SSHAlgorithms) Validate() error {
+	var errs []error
+	check := func(field string, values, supported []string) {
+		seen := make(map[string]bool, len(values))
+		for _, v := range values {
+			switch {
+			case !containsString(supported, v):
+				errs = append(errs, fmt.Errorf("ssh_algorithms.%s: unsupported algorithm %q, supported: %s",
+					field, v, strings.Join(supported, ", ")))
+			case seen[v]:
+				errs = append(errs, fmt.Errorf("ssh_algorithms.%s: %q listed twice", field, v))
+			}
+			seen[v] = true
+		}
+	}
+	check("ciphers", a.Ciphers, sshCiphers)
+	check("kex", a.KEX, sshKEX)
+	check("macs", a.MACs, sshMACs)
+	check("host_keys", a.HostKeys, sshHostKeys)
+	return errors.Join(errs...)
+}
+
+// apply задаёт списки в конфигурации клиента.
+func (a SSHAlgorithms) apply(config *ssh.ClientConfig) {
+	config.Ciphers = a.Ciphers
+	config.KeyExchanges = a.KEX
+	config.MACs = a.MACs
+	config.HostKeyAlgorithms = a.HostKeys
+}
+
+func (a SSHAlgorithms) String() string {
+	return fmt.Sprint(a.Ciphers, a.KEX, a.MACs, a.HostKeys)
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSSHAlgorithms(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		algos SSHAlgorithms
+		errs  []string
+	}{
+		{"defaults", SSHAlgorithms{}, nil},
+		{"all fields", SSHAlgorithms{
+			Ciphers:  []string{"chacha20-poly1305@openssh.com", "aes128-ctr"},
+			KEX:      []string{"curve25519-sha256"},
+			MACs:     []string{"hmac-sha2-256-etm@openssh.com"},
+			HostKeys: []string{"ssh-ed25519", "rsa-sha2-256"},
+		}, nil},
+		{"unknown cipher", SSHAlgorithms{Ciphers: []string{"aes128-ctr", "blowfish-cbc"}}, []string{
+			`ssh_algorithms.ciphers: unsupported algorithm "blowfish-cbc"`,
+		}},
+		{"unknown in every list", SSHAlgorithms{
+			KEX:      []string{"sntrup761x25519-sha512@openssh.com"},
+			MACs:     []string{"umac-64@openssh.com"},
+			HostKeys: []string{"ssh-ed448"},
+		}, []string{
+			`ssh_algorithms.kex: unsupported algorithm "sntrup761x25519-sha512@openssh.com"`,
+			`ssh_algorithms.macs: unsupported algorithm "umac-64@openssh.com"`,
+			`ssh_algorithms.host_keys: unsupported algorithm "ssh-ed448"`,
+		}},
+		// Имена сравниваются точно
+		{"case", SSHAlgorithms{Ciphers: []string{"AES128-CTR"}}, []string{`unsupported algorithm "AES128-CTR"`}},
+		{"duplicate", SSHAlgorithms{MACs: []string{"hmac-sha2-256", "hmac-sha2-256"}}, []string{
+			`ssh_algorithms.macs: "hmac-sha2-256" listed twice`,
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.algos.Validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				for _, want := range tt.errs {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not mention %q", err, want)
+					}
+				}
+				if got := len(strings.Split(err.Error(), "\n")); got != len(tt.errs) {
+					t.Errorf("%d errors, want %d: %v", got, len(tt.errs), err)
+				}
+				return
+			}
+
+			// Списки доходят до конфигурации клиента как есть
+			config := testTransportConfig("127.0.0.1:22", SSHTransport{})
+			config.SSHAlgorithms = tt.algos
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			sshConfig, err := newSSHClientConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				field     string
+				got, want []string
+			}{
+				{"Ciphers", sshConfig.Ciphers, tt.algos.Ciphers},
+				{"KeyExchanges", sshConfig.KeyExchanges, tt.algos.KEX},
+				{"MACs", sshConfig.MACs, tt.algos.MACs},
+				{"HostKeyAlgorithms", sshConfig.HostKeyAlgorithms, tt.algos.HostKeys},
+			} {
+				if !reflect.DeepEqual(c.got, c.want) {
+					t.Errorf("%s = %v, want %v", c.field, c.got, c.want)
+				}
+			}
+		})
+	}
+}
+
+// Настроенный шифр действительно согласуется с сервером
+func TestSSHAlgorithmsHandshake(t *testing.T) {
+	addr := startSSHServer(t)
+	for _, algos := range []SSHAlgorithms{
+		{Ciphers: []string{"chacha20-poly1305@openssh.com"}, KEX: []string{"curve25519-sha256"}},
+		{Ciphers: []string{"aes256-ctr"}, MACs: []string{"hmac-sha2-512"}, HostKeys: []string{"ssh-ed25519"}},
+	} {
+		config := testTransportConfig(addr, SSHTransport{})
+		config.SSHAlgorithms = algos
+		checkSSH(t, config)
+	}
+
+	// Ключ хоста сервера - ed25519, других он предложить не может
+	config := testTransportConfig(addr, SSHTransport{})
+	config.SSHAlgorithms = SSHAlgorithms{HostKeys: []string{"rsa-sha2-256"}}
+	if client, err := DialSSH(config); err == nil {
+		client.Close()
+		t.Error("handshake succeeded without a common host key algorithm")
+	}
+}
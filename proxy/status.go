@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// Состояния SSH соединения
+const (
+	SSHStateConnected    = "connected"
+	SSHStateReconnecting = "reconnecting"
+	// Попытки прекращены до явного запроса, см. reconnect.go
+	SSHStateFailed = "failed"
+)
+
+// Status - снимок состояния работающего прокси.
+type Status struct {
+	SSHAddress        string          `json:"ssh_address"`
+	SSHTransport      string          `json:"ssh_transport"`
+	SSHConnected      bool            `json:"ssh_connected"`
+	SSHState          string          `json:"ssh_state"`
+	ReconnectAttempt  int             `json:"reconnect_attempt,omitempty"`
+	NextReconnectAt   *time.Time      `json:"next_reconnect_at,omitempty"`
+	UptimeSeconds     float64         `json:"uptime_seconds"`
+	Reconnects        int64           `json:"reconnects"`
+	LastError         string          `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time      `json:"last_error_at,omitempty"`
+	ProxyType         string          `json:"proxy_type"`
+	LocalPort         string          `json:"local_port"`
+	ActiveConnections int32           `json:"active_connections"`
+	LocalForwards     []ForwardConfig `json:"local_forwards"`
+	RemoteForwards    []ForwardStatus `json:"remote_forwards"`
+}
+
+// Status возвращает текущее состояние прокси.
+func (p *ProxyServer) Status() Status {
+	p.clientLock.Lock()
+	connected := p.sshClient != nil
+	p.clientLock.Unlock()
+
+	state := p.SSHState()
+	var nextReconnectAt *time.Time
+	if !state.NextRetry.IsZero() {
+		nextReconnectAt = &state.NextRetry
+	}
+
+	p.sshErrLock.Lock()
+	lastError := p.lastSSHError
+	var lastErrorAt *time.Time
+	if lastError != "" {
+		at := p.lastSSHErrorAt
+		lastErrorAt = &at
+	}
+	p.sshErrLock.Unlock()
+
+	config := p.currentConfig()
+	return Status{
+		SSHAddress:        config.SSHHost + ":" + config.SSHPort,
+		SSHTransport:      config.SSHTransport.String(),
+		SSHConnected:      connected,
+		SSHState:          state.State,
+		ReconnectAttempt:  state.Attempt,
+		NextReconnectAt:   nextReconnectAt,
+		UptimeSeconds:     time.Since(p.startedAt).Seconds(),
+		Reconnects:        p.reconnects.Load(),
+		LastError:         lastError,
+		LastErrorAt:       lastErrorAt,
+		ProxyType:         config.ProxyType,
+		LocalPort:         config.LocalPort,
+		ActiveConnections: p.conns.activeCount(),
+		LocalForwards:     p.LocalForwards(),
+		RemoteForwards:    p.RemoteForwards(),
+	}
+}
+
+func (p *ProxyServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.Status())
+}
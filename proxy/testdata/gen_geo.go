@@ -0,0 +1,200 @@
+//go:build ignore
+
+// Генерирует маленькие базы для тестов geo.go: MaxMind DB с записями 24,
+// 28 и 32 бита и geosite.dat. Запуск из каталога proxy:
+//
+//	go run testdata/gen_geo.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+)
+
+// Сети тестовых баз и коды стран. DE записана как registered_country
+// через указатель, US используется двумя сетями.
+var networks = []struct {
+	prefix  string
+	country string
+}{
+	{"1.2.3.0/24", "RU"},
+	{"2.0.0.0/8", "DE"},
+	{"8.8.8.8/32", "US"},
+	{"2001:db8::/32", "US"},
+}
+
+func main() {
+	for _, size := range []int{24, 28, 32} {
+		write(fmt.Sprintf("testdata/country-v6-%d.mmdb", size), buildMMDB(6, size))
+	}
+	write("testdata/country-v4.mmdb", buildMMDB(4, 24))
+	write("testdata/geosite.dat", buildGeoSite())
+}
+
+func write(path string, data []byte) {
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Значения секции данных MaxMind DB
+
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	out := []byte{7<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func mmdbUint(typ byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	n := 4
+	for n > 0 && b[4-n] == 0 {
+		n--
+	}
+	return append([]byte{typ<<5 | byte(n)}, b[4-n:]...)
+}
+
+// mmdbPointer - указатель длиной 11 бит.
+func mmdbPointer(offset int) []byte {
+	return []byte{1<<5 | byte(offset>>8&7), byte(offset)}
+}
+
+// node - узел дерева; записи - индекс узла, -1 (нет данных) или
+// -2-k (запись данных k).
+type node [2]int
+
+func buildMMDB(ipVersion, recordSize int) []byte {
+	// Секция данных: отдельная страна для DE, на неё ссылается указатель
+	var data []byte
+	countryDE := len(data)
+	data = append(data, mmdbMap(mmdbString("iso_code"), mmdbString("DE"))...)
+	offsets := map[string]int{}
+	for _, code := range []string{"RU", "DE", "US"} {
+		offsets[code] = len(data)
+		if code == "DE" {
+			data = append(data, mmdbMap(mmdbString("registered_country"), mmdbPointer(countryDE))...)
+			continue
+		}
+		data = append(data, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(code)))...)
+	}
+
+	tree := []node{{-1, -1}}
+	for _, n := range networks {
+		prefix := netip.MustParsePrefix(n.prefix)
+		addr := prefix.Addr()
+		bits := prefix.Bits()
+		if ipVersion == 4 && !addr.Is4() {
+			continue
+		}
+		raw := addr.AsSlice()
+		if ipVersion == 6 && addr.Is4() {
+			// IPv4 в IPv6 дереве - под ::/96
+			raw = append(make([]byte, 12), raw...)
+			bits += 96
+		}
+		cur := 0
+		for i := 0; i < bits; i++ {
+			bit := int(raw[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				tree[cur][bit] = -2 - offsets[n.country]
+				break
+			}
+			if tree[cur][bit] < 0 {
+				tree = append(tree, node{-1, -1})
+				tree[cur][bit] = len(tree) - 1
+			}
+			cur = tree[cur][bit]
+		}
+	}
+
+	nodeCount := len(tree)
+	value := func(v int) uint32 {
+		switch {
+		case v >= 0:
+			return uint32(v)
+		case v == -1:
+			return uint32(nodeCount)
+		default:
+			return uint32(nodeCount + 16 + (-2 - v))
+		}
+	}
+	var out bytes.Buffer
+	for _, n := range tree {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>20&0xf0 | r>>24&0x0f), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 32:
+			binary.Write(&out, binary.BigEndian, [2]uint32{l, r})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data)
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	out.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, uint32(nodeCount)),
+		mmdbString("record_size"), mmdbUint(5, uint32(recordSize)),
+		mmdbString("ip_version"), mmdbUint(5, uint32(ipVersion)),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+	))
+	return out.Bytes()
+}
+
+// Поля protobuf
+
+func varint(v uint64) []byte {
+	return binary.AppendUvarint(nil, v)
+}
+
+func field(num int, value []byte) []byte {
+	out := varint(uint64(num)<<3 | 2)
+	out = append(out, varint(uint64(len(value)))...)
+	return append(out, value...)
+}
+
+func varintField(num int, v uint64) []byte {
+	return append(varint(uint64(num)<<3), varint(v)...)
+}
+
+func domain(typ uint64, value string, attrs ...string) []byte {
+	out := append(varintField(1, typ), field(2, []byte(value))...)
+	for _, a := range attrs {
+		attr := append(field(1, []byte(a)), varintField(2, 1)...)
+		out = append(out, field(3, attr)...)
+	}
+	return out
+}
+
+func site(code string, domains ...[]byte) []byte {
+	out := field(1, []byte(code))
+	for _, d := range domains {
+		out = append(out, field(2, d)...)
+	}
+	return out
+}
+
+func buildGeoSite() []byte {
+	var out []byte
+	out = append(out, field(1, site("OTHER", domain(2, "other.com")))...)
+	out = append(out, field(1, site("TEST",
+		domain(2, "Example.COM"),
+		domain(3, "exact.example.org"),
+		domain(0, "keyword"),
+		domain(1, `^ads[0-9]+\.example\.net$`, "ads"),
+		domain(2, "tracker.example.io", "ads", "cn"),
+	))...)
+	return out
+}
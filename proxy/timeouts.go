@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Таймауты соединений. Задаются в общем разделе timeouts, у пробросов и у
+// правил маршрутизации; незаданное значение берётся с уровня выше:
+// правило -> проброс -> timeouts -> значения по умолчанию.
+
+// Значения по умолчанию; idle и max_lifetime по умолчанию отключены
+const (
+	defaultDialTimeout      = 15 * time.Second
+	defaultHandshakeTimeout = 30 * time.Second
+	// Как часто проверять простой соединений (не реже чем idle/4)
+	idleCheckInterval = 5 * time.Second
+)
+
+// Timeouts - таймауты соединения, 0 отключает таймаут.
+type Timeouts struct {
+	// Подключение к назначению (напрямую или через SSH)
+	Dial *Duration `json:"dial,omitempty"`
+	// Рукопожатие SOCKS5 и заголовки HTTP запроса клиента
+	Handshake *Duration `json:"handshake,omitempty"`
+	// Нет данных ни в одну сторону
+	Idle *Duration `json:"idle,omitempty"`
+	// Предельное время жизни соединения
+	MaxLifetime *Duration `json:"max_lifetime,omitempty"`
+}
+
+func (t *Timeouts) validate() error {
+	if t == nil {
+		return nil
+	}
+	for _, d := range []*Duration{t.Dial, t.Handshake, t.Idle, t.MaxLifetime} {
+		if d != nil && *d < 0 {
+			return fmt.Errorf("timeouts must not be negative")
+		}
+	}
+	return nil
+}
+
+// String перечисляет заданные значения; нужен и для сравнения
+// конфигураций при Reload.
+func (t *Timeouts) String() string {
+	if t == nil {
+		return "{}"
+	}
+	var parts []string
+	for _, f := range []struct {
+		name  string
+		value *Duration
+	}{{"dial", t.Dial}, {"handshake", t.Handshake}, {"idle", t.Idle}, {"max_lifetime", t.MaxLifetime}} {
+		if f.value != nil {
+			parts = append(parts, f.name+"="+time.Duration(*f.value).String())
+		}
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// connTimeouts - действующие таймауты соединения.
+type connTimeouts struct {
+	dial        time.Duration
+	handshake   time.Duration
+	idle        time.Duration
+	maxLifetime time.Duration
+}
+
+// resolveTimeouts накладывает уровни от общего к частному.
+func resolveTimeouts(layers ...*Timeouts) connTimeouts {
+	t := connTimeouts{
+		dial:      defaultDialTimeout,
+		handshake: defaultHandshakeTimeout,
+	}
+	set := func(dst *time.Duration, src *Duration) {
+		if src != nil {
+			*dst = time.Duration(*src)
+		}
+	}
+	for _, l := range layers {
+		if l == nil {
+			continue
+		}
+		set(&t.dial, l.Dial)
+		set(&t.handshake, l.Handshake)
+		set(&t.idle, l.Idle)
+		set(&t.maxLifetime, l.MaxLifetime)
+	}
+	return t
+}
+
+// timeouts возвращает таймауты соединения по действующей конфигурации.
+func (c *trackedConn) timeouts() connTimeouts {
+	return resolveTimeouts(&c.p.currentConfig().Timeouts, c.listenerTimeouts, c.ruleTimeouts)
+}
+
+// withDialTimeout ограничивает время подключения; 0 - без ограничения.
+func withDialTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// watchTimeouts закрывает соединение, если в обе стороны не было данных
+// дольше idle или оно живёт дольше maxLifetime. Активность видна по
+// счётчикам байт, которые проверяются по таймеру, а не отметкой времени
+// при каждом чтении.
+func (c *trackedConn) watchTimeouts(t connTimeouts) {
+	var tick, lifetime <-chan time.Time
+	if t.idle > 0 {
+		interval := t.idle / 4
+		if interval > idleCheckInterval {
+			interval = idleCheckInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if t.maxLifetime > 0 {
+		timer := time.NewTimer(t.maxLifetime - time.Since(c.start))
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	if tick == nil && lifetime == nil {
+		return
+	}
+
+	lastBytes := c.sent.Load() + c.received.Load()
+	lastActive := time.Now()
+	var reason string
+	for reason == "" {
+		select {
+		case <-c.done:
+			return
+		case <-lifetime:
+			reason = "max lifetime exceeded"
+		case now := <-tick:
+			if bytes := c.sent.Load() + c.received.Load(); bytes != lastBytes {
+				lastBytes, lastActive = bytes, now
+			} else if now.Sub(lastActive) >= t.idle {
+				reason = "idle timeout"
+			}
+		}
+	}
+	c.logger().Debug("Closing connection", "reason", reason)
+	c.lock.Lock()
+	c.err = reason
+	c.lock.Unlock()
+	c.Close()
+}
+
+// handshakeListener ограничивает время рукопожатия SOCKS5: дедлайн
+// ставится при accept и снимается, когда сервер переходит к подключению
+// (см. takeHandshakeConn). Соединение клиента запоминается, чтобы
+// таймауты туннеля закрывали и его.
+type handshakeListener struct {
+	net.Listener
+	p *ProxyServer
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &handshakeConn{Conn: conn, p: l.p, key: netAddrKey(conn.RemoteAddr())}
+	if t := resolveTimeouts(&l.p.currentConfig().Timeouts).handshake; t > 0 {
+		conn.SetDeadline(time.Now().Add(t))
+	}
+	l.p.handshakes.Store(c.key, c)
+	return c, nil
+}
+
+// clientKey - адрес клиента для p.handshakes и журнала. go-socks5 отдаёт
+// адрес клиента без зоны IPv6, поэтому зона не входит в ключ и при accept.
+func clientKey(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+func netAddrKey(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return clientKey(tcp.IP, tcp.Port)
+	}
+	return addr.String()
+}
+
+type handshakeConn struct {
+	net.Conn
+	p    *ProxyServer
+	key  string
+	once sync.Once
+}
+
+func (c *handshakeConn) Close() error {
+	c.once.Do(func() { c.p.handshakes.CompareAndDelete(c.key, c) })
+	return c.Conn.Close()
+}
+
+func (c *handshakeConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// takeHandshakeConn снимает дедлайн рукопожатия с соединения клиента
+// и возвращает его.
+func (p *ProxyServer) takeHandshakeConn(client string) net.Conn {
+	v, ok := p.handshakes.LoadAndDelete(client)
+	if !ok {
+		return nil
+	}
+	c := v.(*handshakeConn)
+	c.Conn.SetDeadline(time.Time{})
+	return c
+}
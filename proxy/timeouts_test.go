@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestResolveTimeouts(t *testing.T) {
+	// Без настроек простой и время жизни не ограничены
+	want := connTimeouts{dial: defaultDialTimeout, handshake: defaultHandshakeTimeout}
+	if got := resolveTimeouts(); got != want {
+		t.Errorf("defaults %+v, want %+v", got, want)
+	}
+
+	global := &Timeouts{Dial: durationPtr(5 * time.Second), Idle: durationPtr(5 * time.Minute)}
+	forward := &Timeouts{MaxLifetime: durationPtr(time.Hour)}
+	rule := &Timeouts{Idle: durationPtr(0)}
+	want = connTimeouts{dial: 5 * time.Second, handshake: defaultHandshakeTimeout, maxLifetime: time.Hour}
+	if got := resolveTimeouts(global, forward, nil, rule); got != want {
+		t.Errorf("layers %+v, want %+v", got, want)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	for _, tt := range []struct {
+		addr *net.TCPAddr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, "10.0.0.1:5000"},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5000}, "[fe80::1]:5000"},
+		// go-socks5 теряет зону, ключ при accept должен совпасть
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5000, Zone: "eth0"}, "[fe80::1]:5000"},
+	} {
+		got := netAddrKey(tt.addr)
+		if got != tt.want || got != clientKey(tt.addr.IP, tt.addr.Port) {
+			t.Errorf("%s: %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDialTunnelTimeout(t *testing.T) {
+	// Сервер отвечает на открытие канала только после таймаута
+	open := make(chan struct{})
+	closed := make(chan struct{})
+	addr := startChannelSSHServer(t, func(nc ssh.NewChannel) {
+		<-open
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		io.Copy(io.Discard, ch)
+		close(closed)
+	})
+	p := startSupervisedProxy(t, testTransportConfig(addr, SSHTransport{}))
+
+	ctx, cancel := withDialTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	conn, err := p.dialTunnel(ctx, "tcp", "example.com:80")
+	if conn != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dial: %v, %v", conn, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("timed out after %v", d)
+	}
+
+	// Канал, открытый после таймаута, закрывается, а клиент освобождается
+	close(open)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("late channel not closed")
+	}
+	inUse := func() int {
+		p.usersLock.Lock()
+		defer p.usersLock.Unlock()
+		return len(p.clientUsers)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for inUse() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("SSH client still in use")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func setTimeouts(p *ProxyServer, timeouts Timeouts) {
+	config := *p.config
+	config.Timeouts = timeouts
+	p.config = &config
+}
+
+// waitClosed ждёт закрытия соединения и возвращает причину из истории.
+func waitClosed(t *testing.T, p *ProxyServer, tc *trackedConn, within time.Duration) string {
+	t.Helper()
+	select {
+	case <-tc.done:
+	case <-time.After(within):
+		t.Fatalf("connection still open after %v", within)
+	}
+	for _, info := range p.ClosedConnections() {
+		if info.ID == tc.info.ID {
+			return info.Error
+		}
+	}
+	t.Fatal("closed connection not in history")
+	return ""
+}
+
+func TestWatchTimeoutsIdle(t *testing.T) {
+	p := newBenchServer()
+	setTimeouts(p, Timeouts{Idle: durationPtr(200 * time.Millisecond)})
+	tc, _ := openTestConn(t, p, "10.0.0.1:5000", "example.com:443")
+
+	start := time.Now()
+	if reason := waitClosed(t, p, tc, 2*time.Second); reason != "idle timeout" {
+		t.Errorf("closed with %q", reason)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("closed after %v, before the idle timeout", d)
+	}
+}
+
+func TestWatchTimeoutsActive(t *testing.T) {
+	p := newBenchServer()
+	setTimeouts(p, Timeouts{Idle: durationPtr(200 * time.Millisecond)})
+	tc, remote := openTestConn(t, p, "10.0.0.1:5000", "example.com:443")
+	go io.Copy(io.Discard, remote)
+
+	// Данные идут чаще, чем истекает idle: соединение остаётся открытым
+	for i := 0; i < 12; i++ {
+		if _, err := tc.Write([]byte("ping")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-tc.done:
+		t.Fatal("active connection closed")
+	default:
+	}
+
+	// После остановки трафика срабатывает idle
+	if reason := waitClosed(t, p, tc, 2*time.Second); reason != "idle timeout" {
+		t.Errorf("closed with %q", reason)
+	}
+}
+
+func TestWatchTimeoutsMaxLifetime(t *testing.T) {
+	p := newBenchServer()
+	setTimeouts(p, Timeouts{MaxLifetime: durationPtr(300 * time.Millisecond)})
+	tc, remote := openTestConn(t, p, "10.0.0.1:5000", "example.com:443")
+	go io.Copy(io.Discard, remote)
+
+	// Активность не продлевает время жизни
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				tc.Write([]byte("ping"))
+			}
+		}
+	}()
+	start := time.Now()
+	if reason := waitClosed(t, p, tc, 2*time.Second); reason != "max lifetime exceeded" {
+		t.Errorf("closed with %q", reason)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("closed after %v", d)
+	}
+}
+
+// Таймауты проброса, открытого через API, действуют, хотя его нет в конфигурации
+func TestForwardTimeoutsFromAPI(t *testing.T) {
+	addr := startChannelSSHServer(t, func(nc ssh.NewChannel) {
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		io.Copy(io.Discard, ch)
+		ch.Close()
+	})
+	p := startSupervisedProxy(t, testTransportConfig(addr, SSHTransport{}))
+	if err := p.setupAdminServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.logServer.Close()
+		p.closeLocalForwards()
+	})
+	base := "http://" + p.logListener.Addr().String()
+
+	body := `{"type":"local","listen":"127.0.0.1:0","target":"db.internal:5432","timeouts":{"idle":"200ms"}}`
+	if code, resp := adminRequest(t, "POST", base+"/forwards", body, nil); code != http.StatusCreated {
+		t.Fatalf("POST /forwards: %d %s", code, resp)
+	}
+	p.forwardsLock.Lock()
+	listen := p.localForwards["127.0.0.1:0"].listener.Addr().String()
+	p.forwardsLock.Unlock()
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("forward not closed by its idle timeout: %v", err)
+	}
+	closed := p.ClosedConnections()
+	if len(closed) != 1 || closed[0].Error != "idle timeout" {
+		t.Errorf("history: %+v", closed)
+	}
+}
@@ -0,0 +1,423 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
+)
+
+// Транспорты проверяются на локальных заменах: SSH сервер из x/crypto,
+// TLS и WebSocket мосты до него, HTTP CONNECT и SOCKS5 прокси.
+
+const (
+	testSSHUser     = "u"
+	testSSHPassword = "pw"
+)
+
+// startSSHServer запускает SSH сервер, который принимает только
+// рукопожатие и глобальные запросы.
+func startSSHServer(t *testing.T) string {
+	return startChannelSSHServer(t, func(ch ssh.NewChannel) {
+		ch.Reject(ssh.Prohibited, "no channels")
+	})
+}
+
+// startChannelSSHServer запускает SSH сервер, который передаёт каналы
+// в handle.
+func startChannelSSHServer(t *testing.T, handle func(ssh.NewChannel)) string {
+	return startRequestSSHServer(t, handle, func(_ *ssh.ServerConn, req *ssh.Request) {
+		req.Reply(true, nil)
+	})
+}
+
+// startRequestSSHServer запускает SSH сервер, который передаёт каналы
+// в handle, а глобальные запросы в request.
+func startRequestSSHServer(t *testing.T, handle func(ssh.NewChannel), request func(*ssh.ServerConn, *ssh.Request)) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == testSSHUser && string(password) == testSSHPassword {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln := listen(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go func() {
+					for req := range reqs {
+						request(sconn, req)
+					}
+				}()
+				for ch := range chans {
+					go handle(ch)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func listen(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// bridge передаёт данные между conn и target.
+func bridge(conn net.Conn, target string) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ssh.example.com"},
+		DNSNames:     []string{"ssh.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTLSBridge - замена stunnel: TLS снаружи, SSH внутри. Запоминает
+// SNI последнего клиента.
+func startTLSBridge(t *testing.T, target string, sni *string) string {
+	ln := listen(t)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			*sni = hello.ServerName
+			return nil, nil
+		},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go bridge(tls.Server(conn, config), target)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startWSBridge - замена nginx с WebSocket прокси до SSH.
+func startWSBridge(t *testing.T, target string, secure bool, requests chan<- *http.Request) string {
+	ws := websocket.Server{Handler: func(conn *websocket.Conn) {
+		conn.PayloadType = websocket.BinaryFrame
+		bridge(conn, target)
+	}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r:
+		default:
+		}
+		ws.ServeHTTP(w, r)
+	})
+	var server *httptest.Server
+	if secure {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// startConnectProxy - HTTP прокси с Basic авторизацией.
+func startConnectProxy(t *testing.T, user, password string) string {
+	ln := listen(t)
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					conn.Close()
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != want {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					conn.Close()
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				bridge(conn, req.Host)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startSOCKS5Proxy(t *testing.T, user, password string) string {
+	server, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{user: password},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := listen(t)
+	go server.Serve(ln)
+	return ln.Addr().String()
+}
+
+// startSOCKS4Proxy - SOCKS4/4a прокси, который требует пользователя user.
+func startSOCKS4Proxy(t *testing.T, user string) string {
+	ln := listen(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				r := bufio.NewReader(conn)
+				header := make([]byte, 8)
+				if _, err := io.ReadFull(r, header); err != nil || header[0] != 4 || header[1] != 1 {
+					conn.Close()
+					return
+				}
+				id, _ := r.ReadString(0)
+				host := net.IP(header[4:8]).String()
+				if header[4] == 0 && header[7] != 0 {
+					host, _ = r.ReadString(0)
+					host = strings.TrimSuffix(host, "\x00")
+				}
+				if strings.TrimSuffix(id, "\x00") != user {
+					conn.Write([]byte{0, 93, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+				port := int(header[2])<<8 | int(header[3])
+				bridge(conn, net.JoinHostPort(host, strconv.Itoa(port)))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func testTransportConfig(addr string, transport SSHTransport) *ProxyConfig {
+	config := DefaultConfig()
+	host, port, _ := net.SplitHostPort(addr)
+	config.SSHHost = host
+	config.SSHPort = port
+	config.SSHUser = testSSHUser
+	config.SSHPassword = testSSHPassword
+	config.SSHTransport = transport
+	return config
+}
+
+func checkSSH(t *testing.T, config *ProxyConfig) {
+	t.Helper()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := DialSSH(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if ok, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil || !ok {
+		t.Fatalf("keepalive: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestSSHTransports(t *testing.T) {
+	sshAddr := startSSHServer(t)
+
+	t.Run("tcp", func(t *testing.T) {
+		checkSSH(t, testTransportConfig(sshAddr, SSHTransport{}))
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		var sni string
+		addr := startTLSBridge(t, sshAddr, &sni)
+		checkSSH(t, testTransportConfig(addr, SSHTransport{
+			Type:               transportTLS,
+			SNI:                "ssh.example.com",
+			InsecureSkipVerify: true,
+		}))
+		if sni != "ssh.example.com" {
+			t.Errorf("SNI = %q, want ssh.example.com", sni)
+		}
+	})
+
+	t.Run("tls rejects unknown certificate", func(t *testing.T) {
+		var sni string
+		addr := startTLSBridge(t, sshAddr, &sni)
+		if _, err := DialSSH(testTransportConfig(addr, SSHTransport{Type: transportTLS})); err == nil {
+			t.Fatal("self-signed certificate accepted without insecure_skip_verify")
+		}
+	})
+
+	for _, secure := range []bool{false, true} {
+		kind := transportWS
+		if secure {
+			kind = transportWSS
+		}
+		t.Run(kind, func(t *testing.T) {
+			requests := make(chan *http.Request, 1)
+			addr := startWSBridge(t, sshAddr, secure, requests)
+			checkSSH(t, testTransportConfig(addr, SSHTransport{
+				Type:               kind,
+				Path:               "/tunnel",
+				Headers:            map[string]string{"Host": "cdn.example.com", "X-Token": "secret"},
+				InsecureSkipVerify: secure,
+			}))
+			r := <-requests
+			if r.URL.Path != "/tunnel" || r.Host != "cdn.example.com" || r.Header.Get("X-Token") != "secret" {
+				t.Errorf("request %s host %s token %q", r.URL.Path, r.Host, r.Header.Get("X-Token"))
+			}
+		})
+	}
+
+	t.Run("http proxy", func(t *testing.T) {
+		proxyAddr := startConnectProxy(t, "alice", "s3cret")
+		checkSSH(t, testTransportConfig(sshAddr, SSHTransport{Proxy: "http://alice:s3cret@" + proxyAddr}))
+		_, err := DialSSH(testTransportConfig(sshAddr, SSHTransport{Proxy: "http://alice:wrong@" + proxyAddr}))
+		if err == nil {
+			t.Fatal("wrong proxy password accepted")
+		}
+	})
+
+	t.Run("socks5 proxy", func(t *testing.T) {
+		proxyAddr := startSOCKS5Proxy(t, "bob", "pa55")
+		checkSSH(t, testTransportConfig(sshAddr, SSHTransport{Proxy: "socks5://bob:pa55@" + proxyAddr}))
+	})
+
+	t.Run("socks4 proxy", func(t *testing.T) {
+		proxyAddr := startSOCKS4Proxy(t, "carol")
+		checkSSH(t, testTransportConfig(sshAddr, SSHTransport{Proxy: "socks4://carol@" + proxyAddr}))
+		_, port, _ := net.SplitHostPort(sshAddr)
+		checkSSH(t, testTransportConfig("localhost:"+port, SSHTransport{Proxy: "socks4a://carol@" + proxyAddr}))
+		if _, err := DialSSH(testTransportConfig(sshAddr, SSHTransport{Proxy: "socks4://dave@" + proxyAddr})); err == nil {
+			t.Fatal("rejected SOCKS4 request succeeded")
+		}
+	})
+
+	t.Run("proxy from environment", func(t *testing.T) {
+		proxyAddr := startConnectProxy(t, "alice", "s3cret")
+		t.Setenv("HTTPS_PROXY", "alice:s3cret@"+proxyAddr)
+		t.Setenv("NO_PROXY", "")
+		checkSSH(t, testTransportConfig(sshAddr, SSHTransport{Proxy: proxyFromEnv}))
+
+		// Закрытый порт: с NO_PROXY прокси не используется
+		t.Setenv("ALL_PROXY", "socks5://127.0.0.1:1")
+		t.Setenv("NO_PROXY", "example.com,127.0.0.0/8")
+		checkSSH(t, testTransportConfig(sshAddr, SSHTransport{Proxy: proxyFromEnv}))
+	})
+
+	t.Run("wss via http proxy", func(t *testing.T) {
+		requests := make(chan *http.Request, 1)
+		addr := startWSBridge(t, sshAddr, true, requests)
+		proxyAddr := startConnectProxy(t, "alice", "s3cret")
+		checkSSH(t, testTransportConfig(addr, SSHTransport{
+			Type:               transportWSS,
+			InsecureSkipVerify: true,
+			Proxy:              "http://alice:s3cret@" + proxyAddr,
+		}))
+	})
+}
+
+func TestSSHTransportValidate(t *testing.T) {
+	for _, tr := range []SSHTransport{
+		{Type: "quic"},
+		{SNI: "example.com"},
+		{Type: transportTLS, Path: "/ssh"},
+		{Type: transportWS, Path: "ssh"},
+		{Proxy: "ftp://proxy:21"},
+		{Proxy: "http://proxy"},
+		{Proxy: "https://proxy:443"},
+	} {
+		if err := tr.Validate(); err == nil {
+			t.Errorf("%+v: expected error", tr)
+		}
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "example.com, .corp.local,10.0.0.0/8,192.168.1.1,*.test:22")
+	for host, want := range map[string]bool{
+		"example.com":     true,
+		"ssh.example.com": true,
+		"badexample.com":  false,
+		"git.corp.local":  true,
+		"10.1.2.3":        true,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"a.test":          true,
+		"example.org":     false,
+	} {
+		if got := noProxy(host); got != want {
+			t.Errorf("noProxy(%q) = %v, want %v", host, got, want)
+		}
+	}
+	t.Setenv("NO_PROXY", "*")
+	if !noProxy("anything") {
+		t.Error("NO_PROXY=* does not match")
+	}
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Прокси до SSH сервера (ssh_transport.proxy): HTTP CONNECT с Basic
+// авторизацией, SOCKS5 и SOCKS4/4a. Значение "env" берёт адрес из
+// ALL_PROXY или HTTPS_PROXY с учётом NO_PROXY, как curl.
+
+const proxyFromEnv = "env"
+
+// Переменные окружения с адресом прокси, по приоритету
+var proxyEnvVars = []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"}
+
+// parseProxyURL разбирает адрес прокси; без схемы - HTTP прокси.
+func parseProxyURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h", "socks4", "socks4a":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected http, socks5, socks4 or socks4a", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("%s: %v", u.Redacted(), err)
+	}
+	return u, nil
+}
+
+// upstreamProxy возвращает прокси до SSH сервера или nil, если
+// подключаться нужно напрямую.
+func upstreamProxy(config *ProxyConfig) (*url.URL, error) {
+	raw := config.SSHTransport.Proxy
+	switch raw {
+	case "":
+		return nil, nil
+	case proxyFromEnv:
+	default:
+		return parseProxyURL(raw)
+	}
+	for _, name := range proxyEnvVars {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		if noProxy(config.SSHHost) {
+			return nil, nil
+		}
+		u, err := parseProxyURL(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return u, nil
+	}
+	return nil, nil
+}
+
+// noProxy проверяет host по NO_PROXY: "*", имена (с поддоменами), адреса
+// и подсети через запятую.
+func noProxy(host string) bool {
+	value := os.Getenv("NO_PROXY")
+	if value == "" {
+		value = os.Getenv("no_proxy")
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		if entry == "" {
+			continue
+		}
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(entry); (err == nil && cidr.Contains(ip)) || ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// newProxyDialer подключается через прокси u.
+func newProxyDialer(u *url.URL, next sshDialer) (sshDialer, error) {
+	switch u.Scheme {
+	case "http":
+		return &httpConnectDialer{next: next, addr: u.Host, user: u.User}, nil
+	case "socks4", "socks4a":
+		return &socks4Dialer{next: next, addr: u.Host, user: u.User.Username(), remoteDNS: u.Scheme == "socks4a"}, nil
+	default:
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, forwardDialer{next})
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer), nil
+	}
+}
+
+// forwardDialer приводит sshDialer к proxy.Dialer; SOCKS5 клиент
+// x/net/proxy вызывает DialContext, если он есть.
+type forwardDialer struct {
+	sshDialer
+}
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// httpConnectDialer открывает туннель запросом CONNECT.
+type httpConnectDialer struct {
+	next sshDialer
+	addr string
+	user *url.Userinfo
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.next.DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %v", d.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.addr, err)
+	}
+	// Ответ читается по байту до конца заголовков, чтобы не захватить
+	// начало SSH баннера
+	br := bufio.NewReaderSize(&byteReader{conn}, 1)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.addr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", d.addr, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// byteReader читает не больше байта за раз.
+type byteReader struct {
+	conn net.Conn
+}
+
+func (r *byteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.conn.Read(b)
+}
+
+// socks4Dialer подключается через SOCKS4; SOCKS4a передаёт прокси имя
+// хоста, SOCKS4 - только IPv4 адрес, разрешённый локально.
+type socks4Dialer struct {
+	next      sshDialer
+	addr      string
+	user      string
+	remoteDNS bool
+}
+
+func (d *socks4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	ip := net.ParseIP(host).To4()
+	var hostname string
+	if ip == nil && net.ParseIP(host) == nil {
+		if d.remoteDNS {
+			// 0.0.0.x означает, что имя хоста идёт после пользователя
+			ip, hostname = net.IPv4(0, 0, 0, 1).To4(), host
+		} else {
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+			if err != nil {
+				return nil, err
+			}
+			ip = ips[0].To4()
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("proxy %s: SOCKS4 supports only IPv4 addresses", d.addr)
+	}
+
+	req := []byte{4, 1, byte(port >> 8), byte(port)}
+	req = append(req, ip...)
+	req = append(append(req, d.user...), 0)
+	if hostname != "" {
+		req = append(append(req, hostname...), 0)
+	}
+
+	conn, err := d.next.DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %v", d.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	resp := make([]byte, 8)
+	if _, err := conn.Write(req); err == nil {
+		_, err = io.ReadFull(conn, resp)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.addr, err)
+	}
+	if resp[1] != 90 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: SOCKS4 request for %s rejected (code %d)", d.addr, addr, resp[1])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}